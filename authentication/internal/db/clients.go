@@ -0,0 +1,134 @@
+package db
+
+import (
+	"authentication/internal/models"
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// EnsureClientsTable creates the table of OAuth2 service clients if it doesn't exist.
+func (db *DB) EnsureClientsTable() error {
+	_, err := db.Conn.Exec(`
+	CREATE TABLE IF NOT EXISTS oauth_clients (
+		client_id VARCHAR(64) PRIMARY KEY,
+		name VARCHAR(100) NOT NULL DEFAULT '',
+		secret_hash TEXT NOT NULL,
+		scopes TEXT[] NOT NULL,
+		created_at TIMESTAMP NOT NULL
+	)`)
+	if err != nil {
+		return err
+	}
+	_, err = db.Conn.Exec(`
+	ALTER TABLE oauth_clients
+		ADD COLUMN IF NOT EXISTS redirect_uris TEXT[] NOT NULL DEFAULT '{}',
+		ADD COLUMN IF NOT EXISTS public BOOLEAN NOT NULL DEFAULT false`)
+	if err != nil {
+		return err
+	}
+	_, err = db.Conn.Exec(`
+	CREATE TABLE IF NOT EXISTS oidc_codes (
+		code_hash TEXT PRIMARY KEY,
+		client_id VARCHAR(64) NOT NULL REFERENCES oauth_clients(client_id) ON DELETE CASCADE,
+		username VARCHAR(255) NOT NULL REFERENCES users(username) ON DELETE CASCADE ON UPDATE CASCADE,
+		redirect_uri TEXT NOT NULL,
+		scope TEXT NOT NULL,
+		nonce TEXT NOT NULL,
+		code_challenge TEXT NOT NULL,
+		auth_time TIMESTAMP NOT NULL,
+		expires_at TIMESTAMP NOT NULL
+	)`)
+	return err
+}
+
+// CreateClient registers a service client.
+func (db *DB) CreateClient(ctx context.Context, c *models.Client) error {
+	c.CreatedAt = time.Now()
+	_, err := db.Conn.ExecContext(ctx, "INSERT INTO oauth_clients (client_id, name, secret_hash, scopes, redirect_uris, public, created_at) VALUES ($1, $2, $3, $4, $5, $6, $7)",
+		c.ClientID, c.Name, c.SecretHash, pq.Array(c.Scopes), pq.Array(c.RedirectURIs), c.Public, c.CreatedAt)
+	return err
+}
+
+// UpsertServiceClient registers a confidential service client, or resets the
+// secret and scopes of an existing one.
+func (db *DB) UpsertServiceClient(ctx context.Context, c *models.Client) error {
+	c.CreatedAt = time.Now()
+	_, err := db.Conn.ExecContext(ctx, `
+	INSERT INTO oauth_clients (client_id, name, secret_hash, scopes, redirect_uris, public, created_at) VALUES ($1, $2, $3, $4, '{}', false, $5)
+	ON CONFLICT (client_id) DO UPDATE SET secret_hash = EXCLUDED.secret_hash, scopes = EXCLUDED.scopes, redirect_uris = '{}', public = false`,
+		c.ClientID, c.Name, c.SecretHash, pq.Array(c.Scopes), c.CreatedAt)
+	return err
+}
+
+// GetClient fetches a service client by ID.
+func (db *DB) GetClient(ctx context.Context, clientID string) (*models.Client, error) {
+	var c models.Client
+	err := db.Conn.QueryRowContext(ctx, "SELECT client_id, name, secret_hash, scopes, redirect_uris, public, created_at FROM oauth_clients WHERE client_id=$1", clientID).
+		Scan(&c.ClientID, &c.Name, &c.SecretHash, pq.Array(&c.Scopes), pq.Array(&c.RedirectURIs), &c.Public, &c.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// ListClients returns every service client ordered by ID.
+func (db *DB) ListClients(ctx context.Context) ([]models.Client, error) {
+	rows, err := db.Conn.QueryContext(ctx, "SELECT client_id, name, secret_hash, scopes, redirect_uris, public, created_at FROM oauth_clients ORDER BY client_id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	clients := []models.Client{}
+	for rows.Next() {
+		var c models.Client
+		if err := rows.Scan(&c.ClientID, &c.Name, &c.SecretHash, pq.Array(&c.Scopes), pq.Array(&c.RedirectURIs), &c.Public, &c.CreatedAt); err != nil {
+			return nil, err
+		}
+		clients = append(clients, c)
+	}
+	return clients, rows.Err()
+}
+
+// DeleteClient removes a service client. It reports false if there is no such client.
+func (db *DB) DeleteClient(ctx context.Context, clientID string) (bool, error) {
+	res, err := db.Conn.ExecContext(ctx, "DELETE FROM oauth_clients WHERE client_id=$1", clientID)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// CreateAuthorizationCode stores a new authorization code and drops expired ones.
+func (db *DB) CreateAuthorizationCode(ctx context.Context, c *models.AuthorizationCode) error {
+	if _, err := db.Conn.ExecContext(ctx, "DELETE FROM oidc_codes WHERE expires_at < $1", time.Now()); err != nil {
+		return err
+	}
+	_, err := db.Conn.ExecContext(ctx, `
+	INSERT INTO oidc_codes (code_hash, client_id, username, redirect_uri, scope, nonce, code_challenge, auth_time, expires_at)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+		c.CodeHash, c.ClientID, c.Username, c.RedirectURI, c.Scope, c.Nonce, c.CodeChallenge, c.AuthTime, c.ExpiresAt)
+	return err
+}
+
+// ConsumeAuthorizationCode deletes and returns the unexpired authorization
+// code whose hash is codeHash, or nil if there is none. A code can only be
+// redeemed once.
+func (db *DB) ConsumeAuthorizationCode(ctx context.Context, codeHash string) (*models.AuthorizationCode, error) {
+	var c models.AuthorizationCode
+	err := db.Conn.QueryRowContext(ctx, `
+	DELETE FROM oidc_codes WHERE code_hash=$1
+	RETURNING code_hash, client_id, username, redirect_uri, scope, nonce, code_challenge, auth_time, expires_at`, codeHash).
+		Scan(&c.CodeHash, &c.ClientID, &c.Username, &c.RedirectURI, &c.Scope, &c.Nonce, &c.CodeChallenge, &c.AuthTime, &c.ExpiresAt)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && time.Now().After(c.ExpiresAt)) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
@@ -2,7 +2,10 @@ package db
 
 import (
 	"authentication/internal/models"
+	"context"
 	"database/sql"
+	"errors"
+	"shared/tracing"
 	"time"
 
 	_ "github.com/lib/pq"
@@ -13,7 +16,7 @@ type DB struct {
 }
 
 func NewDB(dbURL string) (*DB, error) {
-	conn, err := sql.Open("postgres", dbURL)
+	conn, err := tracing.OpenDB("postgres", dbURL)
 	if err != nil {
 		return nil, err
 	}
@@ -23,6 +26,11 @@ func NewDB(dbURL string) (*DB, error) {
 	return &DB{Conn: conn}, nil
 }
 
+// Ping checks that the database is reachable.
+func (db *DB) Ping(ctx context.Context) error {
+	return db.Conn.PingContext(ctx)
+}
+
 // EnsureUsersTable creates the users table if it doesn't exist
 func (db *DB) EnsureUsersTable() error {
 	query := `CREATE TABLE IF NOT EXISTS users (
@@ -33,33 +41,292 @@ func (db *DB) EnsureUsersTable() error {
 		created_at TIMESTAMP NOT NULL,
 		updated_at TIMESTAMP NOT NULL
 	)`
-	_, err := db.Conn.Exec(query)
+	if _, err := db.Conn.Exec(query); err != nil {
+		return err
+	}
+	_, err := db.Conn.Exec(`
+	ALTER TABLE users
+		ADD COLUMN IF NOT EXISTS failed_logins INT NOT NULL DEFAULT 0,
+		ADD COLUMN IF NOT EXISTS locked_until TIMESTAMP,
+		ADD COLUMN IF NOT EXISTS display_name VARCHAR(100) NOT NULL DEFAULT '',
+		ADD COLUMN IF NOT EXISTS pending_email VARCHAR(255) NOT NULL DEFAULT '',
+		ADD COLUMN IF NOT EXISTS email_token_hash TEXT NOT NULL DEFAULT '',
+		ADD COLUMN IF NOT EXISTS email_token_expires TIMESTAMP,
+		ADD COLUMN IF NOT EXISTS email_verified BOOLEAN NOT NULL DEFAULT false,
+		ADD COLUMN IF NOT EXISTS totp_secret TEXT NOT NULL DEFAULT '',
+		ADD COLUMN IF NOT EXISTS totp_enabled BOOLEAN NOT NULL DEFAULT false,
+		ADD COLUMN IF NOT EXISTS totp_last_step BIGINT NOT NULL DEFAULT 0,
+		ADD COLUMN IF NOT EXISTS reset_token_hash TEXT NOT NULL DEFAULT '',
+		ADD COLUMN IF NOT EXISTS reset_token_expires TIMESTAMP`)
+	if err != nil {
+		return err
+	}
+	// Emails are unique regardless of case; see EmailConstraint
+	_, err = db.Conn.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS ` + EmailConstraint + ` ON users (LOWER(email))`)
+	if err != nil {
+		return err
+	}
+	_, err = db.Conn.Exec(`
+	CREATE TABLE IF NOT EXISTS recovery_codes (
+		id SERIAL PRIMARY KEY,
+		username VARCHAR(255) NOT NULL REFERENCES users(username) ON DELETE CASCADE ON UPDATE CASCADE,
+		code_hash TEXT NOT NULL,
+		used_at TIMESTAMP
+	)`)
 	return err
 }
 
+// EmailConstraint is the unique index violated by a duplicate email.
+const EmailConstraint = "users_email_key"
+
 // CreateUser inserts a new user into the database
-func (db *DB) CreateUser(u *models.User) error {
+func (db *DB) CreateUser(ctx context.Context, u *models.User) error {
 	now := time.Now()
 	u.CreatedAt = now
 	u.UpdatedAt = now
-	_, err := db.Conn.Exec("INSERT INTO users (username, password, email, created_at, updated_at) VALUES ($1, $2, $3, $4, $5)", u.Username, u.Password, u.Email, u.CreatedAt, u.UpdatedAt)
+	_, err := db.Conn.ExecContext(ctx, "INSERT INTO users (username, password, email, created_at, updated_at) VALUES ($1, $2, $3, $4, $5)", u.Username, u.Password, u.Email, u.CreatedAt, u.UpdatedAt)
 	return err
 }
 
 // GetUserByUsername fetches a user by username
-func (db *DB) GetUserByUsername(username string) (*models.User, error) {
-	row := db.Conn.QueryRow("SELECT id, username, password, email, created_at, updated_at FROM users WHERE username=$1", username)
+func (db *DB) GetUserByUsername(ctx context.Context, username string) (*models.User, error) {
+	return scanUser(db.Conn.QueryRowContext(ctx, "SELECT "+userColumns+" FROM users WHERE username=$1", username))
+}
+
+// GetUserByID fetches a user by ID, the subject of OpenID Connect tokens
+func (db *DB) GetUserByID(ctx context.Context, id int) (*models.User, error) {
+	return scanUser(db.Conn.QueryRowContext(ctx, "SELECT "+userColumns+" FROM users WHERE id=$1", id))
+}
+
+// userColumns is the column list read by scanUser.
+const userColumns = "id, username, password, email, email_verified, display_name, pending_email, created_at, updated_at, failed_logins, locked_until, totp_secret, totp_enabled"
+
+func scanUser(row *sql.Row) (*models.User, error) {
 	var u models.User
-	err := row.Scan(&u.ID, &u.Username, &u.Password, &u.Email, &u.CreatedAt, &u.UpdatedAt)
+	var lockedUntil sql.NullTime
+	err := row.Scan(&u.ID, &u.Username, &u.Password, &u.Email, &u.EmailVerified, &u.DisplayName, &u.PendingEmail, &u.CreatedAt, &u.UpdatedAt, &u.FailedLogins, &lockedUntil, &u.TOTPSecret, &u.MFAEnabled)
 	if err != nil {
 		return nil, err
 	}
+	if lockedUntil.Valid {
+		u.LockedUntil = &lockedUntil.Time
+	}
 	return &u, nil
 }
 
-// UpdateUserPassword updates a user's password and updated_at
-func (db *DB) UpdateUserPassword(username, newPassword string) error {
+// UpdateUserPassword updates a user's password hash and updated_at, and
+// invalidates any password reset token
+func (db *DB) UpdateUserPassword(ctx context.Context, username, passwordHash string) error {
 	now := time.Now()
-	_, err := db.Conn.Exec("UPDATE users SET password=$1, updated_at=$2 WHERE username=$3", newPassword, now, username)
+	_, err := db.Conn.ExecContext(ctx, "UPDATE users SET password=$1, reset_token_hash='', reset_token_expires=NULL, updated_at=$2 WHERE username=$3", passwordHash, now, username)
+	return err
+}
+
+// RehashUserPassword replaces the stored password of username with a new
+// hash of the same password, unless the password was changed meanwhile
+func (db *DB) RehashUserPassword(ctx context.Context, username, oldStored, passwordHash string) error {
+	_, err := db.Conn.ExecContext(ctx, "UPDATE users SET password=$1 WHERE username=$2 AND password=$3", passwordHash, username, oldStored)
+	return err
+}
+
+// SetResetToken stores the hash of the token that lets the owner of the
+// account reset its password, replacing any earlier one
+func (db *DB) SetResetToken(ctx context.Context, username, tokenHash string, expires time.Time) error {
+	_, err := db.Conn.ExecContext(ctx, "UPDATE users SET reset_token_hash=$1, reset_token_expires=$2 WHERE username=$3", tokenHash, expires, username)
+	return err
+}
+
+// GetUserByResetToken fetches the user a valid password reset token was sent to
+func (db *DB) GetUserByResetToken(ctx context.Context, tokenHash string) (*models.User, error) {
+	return scanUser(db.Conn.QueryRowContext(ctx, "SELECT "+userColumns+" FROM users WHERE reset_token_hash=$1 AND reset_token_hash <> '' AND reset_token_expires > $2", tokenHash, time.Now()))
+}
+
+// ResetPassword sets the password hash of the user a valid reset token was
+// sent to and uses the token up. It returns false if the token is invalid,
+// expired or was used already
+func (db *DB) ResetPassword(ctx context.Context, tokenHash, passwordHash string) (bool, error) {
+	now := time.Now()
+	res, err := db.Conn.ExecContext(ctx, `
+	UPDATE users SET password=$1, reset_token_hash='', reset_token_expires=NULL, updated_at=$2
+	WHERE reset_token_hash=$3 AND reset_token_hash <> '' AND reset_token_expires > $2`, passwordHash, now, tokenHash)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// RecordFailedLogin counts a failed login for username and returns the number
+// of failures since the last successful login.
+func (db *DB) RecordFailedLogin(ctx context.Context, username string) (int, error) {
+	var failures int
+	err := db.Conn.QueryRowContext(ctx, "UPDATE users SET failed_logins = failed_logins + 1 WHERE username=$1 RETURNING failed_logins", username).Scan(&failures)
+	return failures, err
+}
+
+// LockUser refuses logins for username until the given time.
+func (db *DB) LockUser(ctx context.Context, username string, until time.Time) error {
+	_, err := db.Conn.ExecContext(ctx, "UPDATE users SET locked_until=$1 WHERE username=$2", until, username)
+	return err
+}
+
+// ResetFailedLogins clears the failure count after a successful login.
+func (db *DB) ResetFailedLogins(ctx context.Context, username string) error {
+	_, err := db.Conn.ExecContext(ctx, "UPDATE users SET failed_logins=0, locked_until=NULL WHERE username=$1 AND (failed_logins <> 0 OR locked_until IS NOT NULL)", username)
+	return err
+}
+
+// UnlockUser clears the failure count and any lock of username. It reports
+// false if there is no such user.
+func (db *DB) UnlockUser(ctx context.Context, username string) (bool, error) {
+	res, err := db.Conn.ExecContext(ctx, "UPDATE users SET failed_logins=0, locked_until=NULL, updated_at=$1 WHERE username=$2", time.Now(), username)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// UpdateDisplayName changes the display name of username.
+func (db *DB) UpdateDisplayName(ctx context.Context, username, displayName string) error {
+	_, err := db.Conn.ExecContext(ctx, "UPDATE users SET display_name=$1, updated_at=$2 WHERE username=$3", displayName, time.Now(), username)
+	return err
+}
+
+// SetPendingEmail records an email change that takes effect once the token
+// whose SHA-256 hash is tokenHash is presented before expires. It replaces any
+// earlier pending change.
+func (db *DB) SetPendingEmail(ctx context.Context, username, email, tokenHash string, expires time.Time) error {
+	_, err := db.Conn.ExecContext(ctx, "UPDATE users SET pending_email=$1, email_token_hash=$2, email_token_expires=$3, updated_at=$4 WHERE username=$5", email, tokenHash, expires, time.Now(), username)
+	return err
+}
+
+// ConfirmPendingEmail makes the pending email of username its email if
+// tokenHash matches an unexpired token. It reports false otherwise.
+func (db *DB) ConfirmPendingEmail(ctx context.Context, username, tokenHash string) (bool, error) {
+	res, err := db.Conn.ExecContext(ctx, `
+	UPDATE users SET email=pending_email, email_verified=true, pending_email='', email_token_hash='', email_token_expires=NULL, updated_at=$1
+	WHERE username=$2 AND pending_email <> '' AND email_token_hash=$3 AND email_token_expires > $1`, time.Now(), username, tokenHash)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// EmailInUse reports whether a user other than username has email, ignoring case.
+func (db *DB) EmailInUse(ctx context.Context, email, username string) (bool, error) {
+	var exists bool
+	err := db.Conn.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM users WHERE LOWER(email)=LOWER($1) AND username<>$2)", email, username).Scan(&exists)
+	return exists, err
+}
+
+// SetEmailToken stores the hash of the token that verifies the current email
+// of username, replacing any earlier one.
+func (db *DB) SetEmailToken(ctx context.Context, username, tokenHash string, expires time.Time) error {
+	_, err := db.Conn.ExecContext(ctx, "UPDATE users SET email_token_hash=$1, email_token_expires=$2 WHERE username=$3 AND NOT email_verified", tokenHash, expires, username)
 	return err
 }
+
+// VerifyEmail marks the email of the user holding the unexpired token whose
+// hash is tokenHash as verified and returns the username, or "" if no user
+// holds such a token.
+func (db *DB) VerifyEmail(ctx context.Context, tokenHash string) (string, error) {
+	var username string
+	err := db.Conn.QueryRowContext(ctx, `
+	UPDATE users SET email_verified=true, email_token_hash='', email_token_expires=NULL, updated_at=$1
+	WHERE email_token_hash=$2 AND pending_email='' AND email_token_expires > $1
+	RETURNING username`, time.Now(), tokenHash).Scan(&username)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return username, err
+}
+
+// DeleteUser removes username. It reports false if there is no such user.
+func (db *DB) DeleteUser(ctx context.Context, username string) (bool, error) {
+	res, err := db.Conn.ExecContext(ctx, "DELETE FROM users WHERE username=$1", username)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// SetTOTPSecret stores the secret of a TOTP enrolment awaiting confirmation.
+// It reports false if username already has TOTP enabled.
+func (db *DB) SetTOTPSecret(ctx context.Context, username, secret string) (bool, error) {
+	res, err := db.Conn.ExecContext(ctx, "UPDATE users SET totp_secret=$1, totp_last_step=0, updated_at=$2 WHERE username=$3 AND NOT totp_enabled", secret, time.Now(), username)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// EnableTOTP turns on TOTP for username after the first code, from step, was
+// confirmed, and replaces its recovery codes with codeHashes.
+func (db *DB) EnableTOTP(ctx context.Context, username string, step int64, codeHashes []string) error {
+	tx, err := db.Conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, "UPDATE users SET totp_enabled=true, totp_last_step=$1, updated_at=$2 WHERE username=$3", step, time.Now(), username); err != nil {
+		return err
+	}
+	if err := replaceRecoveryCodes(ctx, tx, username, codeHashes); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// DisableTOTP turns off TOTP for username and removes its recovery codes.
+func (db *DB) DisableTOTP(ctx context.Context, username string) error {
+	tx, err := db.Conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, "UPDATE users SET totp_enabled=false, totp_secret='', totp_last_step=0, updated_at=$1 WHERE username=$2", time.Now(), username); err != nil {
+		return err
+	}
+	if err := replaceRecoveryCodes(ctx, tx, username, nil); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func replaceRecoveryCodes(ctx context.Context, tx *sql.Tx, username string, codeHashes []string) error {
+	if _, err := tx.ExecContext(ctx, "DELETE FROM recovery_codes WHERE username=$1", username); err != nil {
+		return err
+	}
+	for _, hash := range codeHashes {
+		if _, err := tx.ExecContext(ctx, "INSERT INTO recovery_codes (username, code_hash) VALUES ($1, $2)", username, hash); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UseTOTPStep records that the code of step was used by username. It reports
+// false if that step or a later one was used before, so a code cannot be replayed.
+func (db *DB) UseTOTPStep(ctx context.Context, username string, step int64) (bool, error) {
+	res, err := db.Conn.ExecContext(ctx, "UPDATE users SET totp_last_step=$1 WHERE username=$2 AND totp_last_step < $1", step, username)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// UseRecoveryCode consumes the unused recovery code of username whose hash is
+// codeHash. It reports false if there is none.
+func (db *DB) UseRecoveryCode(ctx context.Context, username, codeHash string) (bool, error) {
+	res, err := db.Conn.ExecContext(ctx, "UPDATE recovery_codes SET used_at=$1 WHERE username=$2 AND code_hash=$3 AND used_at IS NULL", time.Now(), username, codeHash)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
@@ -2,113 +2,304 @@ package handlers
 
 import (
 	"authentication/internal/db"
+	"authentication/internal/mail"
+	"authentication/internal/metrics"
 	"authentication/internal/models"
+	"authentication/internal/oidc"
+	"authentication/internal/password"
+	"authentication/internal/ratelimit"
+	"database/sql"
 	"encoding/json"
+	"errors"
+	"log/slog"
 	"net/http"
-	"os"
+	"shared/audit"
+	"shared/problem"
+	"shared/validate"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/lib/pq"
 )
 
-var jwtSecret = []byte(os.Getenv("JWT_SECRET"))
-
 type AuthHandler struct {
-	DB *db.DB
+	DB        *db.DB
+	JWTSecret []byte
+	Limits    Limits
+	Mailer    mail.Mailer
+	Audit     *audit.Log
+	// TOTPIssuer names the service in authenticator apps.
+	TOTPIssuer string
+	OIDC       OIDC
+	// RequireVerifiedEmail refuses tokens to users who have not verified their email.
+	RequireVerifiedEmail bool
+}
+
+// OIDC configures the OpenID Connect provider.
+type OIDC struct {
+	// Issuer is the public base URL of the service, e.g. http://localhost:8000/api/auth behind the gateway.
+	Issuer string
+	// Key signs ID tokens.
+	Key *oidc.Key
+}
+
+// record writes an audit log entry; an empty actor is the user or client of the request's token.
+func (h *AuthHandler) record(r *http.Request, actor, action, target, outcome string) {
+	h.Audit.Record(r, audit.Event{Actor: actor, Action: action, Target: target, Outcome: outcome})
 }
 
 func (h *AuthHandler) RegisterHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		problem.MethodNotAllowed(w, r)
+		return
+	}
+	var req struct {
+		Username string `json:"username" validate:"required,min=3,max=64"`
+		Password string `json:"password" validate:"required,min=8,max=128"`
+		Email    string `json:"email" validate:"required,email,max=255"`
+	}
+	if !validate.DecodeJSON(w, r, &req) {
 		return
 	}
-	var u models.User
-	if err := json.NewDecoder(r.Body).Decode(&u); err != nil {
-		http.Error(w, "Invalid request", http.StatusBadRequest)
+	if !allow(w, r, h.Limits.RegisterPerIP, ratelimit.ClientIP(r, h.Limits.TrustProxy), "register", "ip") {
 		return
 	}
-	if u.Username == "" || u.Password == "" || u.Email == "" {
-		http.Error(w, "Username, password, and email required", http.StatusBadRequest)
+	hash, err := password.Hash(req.Password)
+	if err != nil {
+		problem.Internal(w, r, err)
 		return
 	}
-	if err := h.DB.CreateUser(&u); err != nil {
-		http.Error(w, "User registration failed", http.StatusInternalServerError)
+	u := models.User{Username: req.Username, Password: hash, Email: req.Email}
+	if err := h.DB.CreateUser(r.Context(), &u); err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+			h.record(r, req.Username, "user.register", req.Username, audit.OutcomeFailure)
+			if pqErr.Constraint == db.EmailConstraint {
+				problem.Write(w, r, http.StatusConflict, problem.CodeEmailExists, "A user with this email address already exists.")
+				return
+			}
+			problem.Write(w, r, http.StatusConflict, problem.CodeUserExists, "A user with this username already exists.")
+			return
+		}
+		problem.Internal(w, r, err)
 		return
 	}
+	h.record(r, u.Username, "user.register", u.Username, audit.OutcomeSuccess)
+	// The account exists either way; a failed mail can be retried with /verify-email/resend
+	if err := h.sendVerification(r, u.Username, u.Email); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to send verification email", "username", u.Username, "error", err)
+	}
 	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(map[string]string{"message": "User registered successfully"})
+	json.NewEncoder(w).Encode(map[string]string{"message": "User registered successfully. Check your email for the verification code."})
 }
 
 func (h *AuthHandler) LoginHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		problem.MethodNotAllowed(w, r)
+		return
+	}
+	var req struct {
+		Username string `json:"username" validate:"required,max=64"`
+		Password string `json:"password" validate:"required,max=128"`
+	}
+	if !validate.DecodeJSON(w, r, &req) {
+		return
+	}
+	if !allow(w, r, h.Limits.LoginPerIP, ratelimit.ClientIP(r, h.Limits.TrustProxy), "login", "ip") ||
+		!allow(w, r, h.Limits.LoginPerUser, req.Username, "login", "username") {
+		return
+	}
+	user, err := h.DB.GetUserByUsername(r.Context(), req.Username)
+	if errors.Is(err, sql.ErrNoRows) {
+		password.CheckNone(req.Password)
+		metrics.LoginsFailed.Inc()
+		h.record(r, req.Username, "user.login", req.Username, audit.OutcomeFailure)
+		problem.Write(w, r, http.StatusUnauthorized, problem.CodeInvalidCredentials, "Invalid credentials.")
+		return
+	}
+	if err != nil {
+		problem.Internal(w, r, err)
+		return
+	}
+	// A locked account is refused before the password is checked so guessing cannot continue
+	if locked(w, r, user) {
+		h.record(r, user.Username, "user.login", user.Username, audit.OutcomeDenied)
 		return
 	}
-	var req models.User
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request", http.StatusBadRequest)
+	ok, err := h.checkPassword(r, user, req.Password)
+	if err != nil {
+		problem.Internal(w, r, err)
+		return
+	}
+	if !ok {
+		metrics.LoginsFailed.Inc()
+		h.record(r, user.Username, "user.login", user.Username, audit.OutcomeFailure)
+		if err := h.recordFailedLogin(r, user.Username); err != nil {
+			problem.Internal(w, r, err)
+			return
+		}
+		problem.Write(w, r, http.StatusUnauthorized, problem.CodeInvalidCredentials, "Invalid credentials.")
+		return
+	}
+	if h.RequireVerifiedEmail && !user.EmailVerified {
+		h.record(r, user.Username, "user.login", user.Username, audit.OutcomeDenied)
+		problem.Write(w, r, http.StatusForbidden, problem.CodeEmailNotVerified, "Verify your email address before logging in.")
 		return
 	}
-	user, err := h.DB.GetUserByUsername(req.Username)
-	if err != nil || user.Password != req.Password {
-		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+	// With MFA on, failures are only reset once the second factor is passed too
+	if user.MFAEnabled {
+		h.writeMFAChallenge(w, r, user.Username)
 		return
 	}
+	h.completeLogin(w, r, user)
+}
+
+// checkPassword reports whether pw is the password of user. A password
+// stored in plaintext or with an outdated cost is replaced by a new hash.
+func (h *AuthHandler) checkPassword(r *http.Request, user *models.User, pw string) (bool, error) {
+	ok, rehash := password.Check(user.Password, pw)
+	if !ok || !rehash {
+		return ok, nil
+	}
+	hash, err := password.Hash(pw)
+	if err != nil {
+		return false, err
+	}
+	if err := h.DB.RehashUserPassword(r.Context(), user.Username, user.Password, hash); err != nil {
+		return false, err
+	}
+	user.Password = hash
+	return true, nil
+}
+
+// completeLogin clears the failed login count of user and issues its access token.
+func (h *AuthHandler) completeLogin(w http.ResponseWriter, r *http.Request, user *models.User) {
+	if user.FailedLogins > 0 || user.LockedUntil != nil {
+		if err := h.DB.ResetFailedLogins(r.Context(), user.Username); err != nil {
+			problem.Internal(w, r, err)
+			return
+		}
+	}
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
 		"username": user.Username,
 		"exp":      time.Now().Add(time.Hour * 24).Unix(),
 	})
-	tokenString, err := token.SignedString(jwtSecret)
+	tokenString, err := token.SignedString(h.JWTSecret)
 	if err != nil {
-		http.Error(w, "Could not generate token", http.StatusInternalServerError)
+		problem.Internal(w, r, err)
 		return
 	}
+	metrics.LoginsSucceeded.Inc()
+	h.record(r, user.Username, "user.login", user.Username, audit.OutcomeSuccess)
 	json.NewEncoder(w).Encode(map[string]string{"token": tokenString})
 }
 
-func (h *AuthHandler) UpdatePasswordHandler(w http.ResponseWriter, r *http.Request, username string) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
+// locked answers 423 with Retry-After and returns true while user is locked out.
+func locked(w http.ResponseWriter, r *http.Request, user *models.User) bool {
+	if user.LockedUntil == nil || !time.Now().Before(*user.LockedUntil) {
+		return false
 	}
-	var req struct {
-		NewPassword string `json:"new_password"`
+	metrics.LoginsFailed.Inc()
+	setRetryAfter(w, time.Until(*user.LockedUntil))
+	problem.Write(w, r, http.StatusLocked, problem.CodeAccountLocked, "The account is temporarily locked after too many failed logins.")
+	return true
+}
+
+// recordFailedLogin counts a failed login and locks the account once the
+// failures reach the lockout threshold.
+func (h *AuthHandler) recordFailedLogin(r *http.Request, username string) error {
+	failures, err := h.DB.RecordFailedLogin(r.Context(), username)
+	if err != nil {
+		return err
 	}
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request", http.StatusBadRequest)
-		return
+	lockout := h.Limits.lockoutFor(failures)
+	if lockout == 0 {
+		return nil
 	}
-	if req.NewPassword == "" {
-		http.Error(w, "New password required", http.StatusBadRequest)
+	metrics.AccountsLocked.Inc()
+	slog.WarnContext(r.Context(), "Account locked after failed logins", "username", username, "failures", failures, "lockout", lockout.String())
+	return h.DB.LockUser(r.Context(), username, time.Now().Add(lockout))
+}
+
+// UnlockHandler handles POST /admin/users/{username}/unlock, clearing the
+// failed login count and any lockout of the account.
+func (h *AuthHandler) UnlockHandler(w http.ResponseWriter, r *http.Request) {
+	username := r.PathValue("username")
+	found, err := h.DB.UnlockUser(r.Context(), username)
+	if err != nil {
+		problem.Internal(w, r, err)
 		return
 	}
-	if err := h.DB.UpdateUserPassword(username, req.NewPassword); err != nil {
-		http.Error(w, "Password update failed", http.StatusInternalServerError)
+	if !found {
+		problem.Write(w, r, http.StatusNotFound, problem.CodeUserNotFound, "No user named "+username+".")
 		return
 	}
-	json.NewEncoder(w).Encode(map[string]string{"message": "Password updated successfully"})
+	slog.InfoContext(r.Context(), "Account unlocked", "username", username, "by", r.Context().Value("username"))
+	h.record(r, "", "user.unlock", username, audit.OutcomeSuccess)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Account unlocked"})
 }
 
-func (h *AuthHandler) ResetPasswordHandler(w http.ResponseWriter, r *http.Request) {
+// UpdatePasswordHandler handles POST /update-password. The current password,
+// and with MFA on a code or recovery code, must be sent too so a stolen
+// token alone cannot take over the account.
+func (h *AuthHandler) UpdatePasswordHandler(w http.ResponseWriter, r *http.Request, username string) {
 	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		problem.MethodNotAllowed(w, r)
 		return
 	}
 	var req struct {
-		Username    string `json:"username"`
-		NewPassword string `json:"new_password"`
+		CurrentPassword string `json:"current_password" validate:"required,max=128"`
+		NewPassword     string `json:"new_password" validate:"required,min=8,max=128"`
+		Code            string `json:"code" validate:"max=6"`
+		RecoveryCode    string `json:"recovery_code" validate:"max=32"`
+	}
+	if !validate.DecodeJSON(w, r, &req) {
+		return
+	}
+	user, err := h.DB.GetUserByUsername(r.Context(), username)
+	if errors.Is(err, sql.ErrNoRows) {
+		problem.Write(w, r, http.StatusNotFound, problem.CodeUserNotFound, "The account no longer exists.")
+		return
+	}
+	if err != nil {
+		problem.Internal(w, r, err)
+		return
+	}
+	ok, err := h.checkPassword(r, user, req.CurrentPassword)
+	if err != nil {
+		problem.Internal(w, r, err)
+		return
 	}
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request", http.StatusBadRequest)
+	if !ok {
+		h.record(r, username, "user.password.change", username, audit.OutcomeFailure)
+		problem.Write(w, r, http.StatusForbidden, problem.CodeInvalidCredentials, "The current password is incorrect.")
 		return
 	}
-	if req.Username == "" || req.NewPassword == "" {
-		http.Error(w, "Username and new password required", http.StatusBadRequest)
+	if user.MFAEnabled {
+		if (req.Code == "") == (req.RecoveryCode == "") {
+			problem.Validation(w, r, []problem.FieldError{{Field: "code", Code: "required", Message: "exactly one of code and recovery_code is required"}})
+			return
+		}
+		ok, err := h.checkSecondFactor(r, user, req.Code, req.RecoveryCode)
+		if err != nil {
+			problem.Internal(w, r, err)
+			return
+		}
+		if !ok {
+			h.record(r, username, "user.password.change", username, audit.OutcomeFailure)
+			problem.Write(w, r, http.StatusForbidden, problem.CodeInvalidMFACode, "The code is invalid.")
+			return
+		}
+	}
+	hash, err := password.Hash(req.NewPassword)
+	if err != nil {
+		problem.Internal(w, r, err)
 		return
 	}
-	if err := h.DB.UpdateUserPassword(req.Username, req.NewPassword); err != nil {
-		http.Error(w, "Password reset failed", http.StatusInternalServerError)
+	if err := h.DB.UpdateUserPassword(r.Context(), username, hash); err != nil {
+		problem.Internal(w, r, err)
 		return
 	}
-	json.NewEncoder(w).Encode(map[string]string{"message": "Password reset successfully"})
+	h.record(r, username, "user.password.change", username, audit.OutcomeSuccess)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Password updated successfully"})
 }
@@ -0,0 +1,57 @@
+package handlers
+
+import (
+	"authentication/internal/metrics"
+	"authentication/internal/ratelimit"
+	"math"
+	"net/http"
+	"shared/problem"
+	"strconv"
+	"time"
+)
+
+// Limits throttles the public endpoints and locks accounts after repeated
+// failed logins.
+type Limits struct {
+	LoginPerIP    *ratelimit.Limiter
+	LoginPerUser  *ratelimit.Limiter
+	RegisterPerIP *ratelimit.Limiter
+	// TrustProxy takes the client IP from X-Forwarded-For.
+	TrustProxy bool
+
+	LockoutThreshold   int
+	LockoutDuration    time.Duration
+	LockoutMaxDuration time.Duration
+}
+
+// lockoutFor returns how long to lock an account after failures failed
+// logins in a row: nothing below the threshold, then LockoutDuration doubled
+// for every failure past it, capped at LockoutMaxDuration.
+func (l Limits) lockoutFor(failures int) time.Duration {
+	if failures < l.LockoutThreshold {
+		return 0
+	}
+	d := l.LockoutDuration
+	for i := l.LockoutThreshold; i < failures && d < l.LockoutMaxDuration; i++ {
+		d *= 2
+	}
+	return min(d, l.LockoutMaxDuration)
+}
+
+// allow takes a token for key from limiter, answering 429 with Retry-After
+// when there is none. endpoint and limit label the rejection in metrics.
+func allow(w http.ResponseWriter, r *http.Request, limiter *ratelimit.Limiter, key, endpoint, limit string) bool {
+	ok, retryAfter := limiter.Allow(key)
+	if ok {
+		return true
+	}
+	metrics.RateLimited.WithLabelValues(endpoint, limit).Inc()
+	setRetryAfter(w, retryAfter)
+	problem.Write(w, r, http.StatusTooManyRequests, problem.CodeRateLimited, "Too many attempts, try again later.")
+	return false
+}
+
+// setRetryAfter sets the Retry-After header to d rounded up to whole seconds.
+func setRetryAfter(w http.ResponseWriter, d time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(d.Seconds()))))
+}
@@ -0,0 +1,266 @@
+package handlers
+
+import (
+	"authentication/internal/metrics"
+	"authentication/internal/models"
+	"authentication/internal/totp"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"shared/audit"
+	"shared/problem"
+	"shared/validate"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	// mfaChallengeTTL is how long a client has to send the second factor after the password.
+	mfaChallengeTTL = 5 * time.Minute
+	// recoveryCodeCount is how many recovery codes a confirmed enrolment gets.
+	recoveryCodeCount = 10
+)
+
+// mfaKey signs MFA challenge tokens. It is derived from the JWT secret but
+// differs from it, so a challenge token is never accepted as an access token.
+func (h *AuthHandler) mfaKey() []byte {
+	mac := hmac.New(sha256.New, h.JWTSecret)
+	mac.Write([]byte("mfa-challenge"))
+	return mac.Sum(nil)
+}
+
+// writeMFAChallenge answers a correct password of an MFA user with a
+// short-lived token to exchange at /login/mfa together with a code.
+func (h *AuthHandler) writeMFAChallenge(w http.ResponseWriter, r *http.Request, username string) {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"sub": username,
+		"exp": time.Now().Add(mfaChallengeTTL).Unix(),
+	})
+	tokenString, err := token.SignedString(h.mfaKey())
+	if err != nil {
+		problem.Internal(w, r, err)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"mfa_required": true, "mfa_token": tokenString})
+}
+
+// LoginMFAHandler handles POST /login/mfa, the second login step. It takes
+// the MFA token from LoginHandler and either a TOTP code or a recovery code,
+// and issues the access token. Wrong codes count as failed logins.
+func (h *AuthHandler) LoginMFAHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		problem.MethodNotAllowed(w, r)
+		return
+	}
+	var req struct {
+		MFAToken     string `json:"mfa_token" validate:"required,max=2048"`
+		Code         string `json:"code" validate:"max=6"`
+		RecoveryCode string `json:"recovery_code" validate:"max=32"`
+	}
+	if !validate.DecodeJSON(w, r, &req) {
+		return
+	}
+	if (req.Code == "") == (req.RecoveryCode == "") {
+		problem.Validation(w, r, []problem.FieldError{{Field: "code", Code: "required", Message: "exactly one of code and recovery_code is required"}})
+		return
+	}
+	token, err := jwt.Parse(req.MFAToken, func(token *jwt.Token) (interface{}, error) {
+		return h.mfaKey(), nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
+	if err != nil || !token.Valid {
+		problem.Write(w, r, http.StatusUnauthorized, problem.CodeInvalidToken, "The MFA token is invalid or has expired. Log in again.")
+		return
+	}
+	username, _ := token.Claims.GetSubject()
+	if !allow(w, r, h.Limits.LoginPerUser, username, "login_mfa", "username") {
+		return
+	}
+	user, err := h.DB.GetUserByUsername(r.Context(), username)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && !user.MFAEnabled) {
+		problem.Write(w, r, http.StatusUnauthorized, problem.CodeInvalidToken, "The MFA token is invalid or has expired. Log in again.")
+		return
+	}
+	if err != nil {
+		problem.Internal(w, r, err)
+		return
+	}
+	if locked(w, r, user) {
+		h.record(r, user.Username, "user.login", user.Username, audit.OutcomeDenied)
+		return
+	}
+
+	ok, err := h.checkSecondFactor(r, user, req.Code, req.RecoveryCode)
+	if err != nil {
+		problem.Internal(w, r, err)
+		return
+	}
+	if !ok {
+		metrics.LoginsFailed.Inc()
+		h.record(r, user.Username, "user.login.mfa", user.Username, audit.OutcomeFailure)
+		if err := h.recordFailedLogin(r, user.Username); err != nil {
+			problem.Internal(w, r, err)
+			return
+		}
+		problem.Write(w, r, http.StatusUnauthorized, problem.CodeInvalidMFACode, "The code is invalid.")
+		return
+	}
+	h.completeLogin(w, r, user)
+}
+
+// checkSecondFactor verifies and consumes a TOTP code or, if code is empty, a
+// recovery code of user.
+func (h *AuthHandler) checkSecondFactor(r *http.Request, user *models.User, code, recoveryCode string) (bool, error) {
+	if code != "" {
+		step, ok := totp.Validate(user.TOTPSecret, code, time.Now())
+		if !ok {
+			return false, nil
+		}
+		return h.DB.UseTOTPStep(r.Context(), user.Username, step)
+	}
+	return h.DB.UseRecoveryCode(r.Context(), user.Username, hashToken(normalizeRecoveryCode(recoveryCode)))
+}
+
+// EnrollTOTPHandler handles POST /mfa/totp/enroll. It creates a new secret
+// for the user to add to an authenticator app; MFA is only switched on once
+// a code from the app is confirmed with ConfirmTOTPHandler.
+func (h *AuthHandler) EnrollTOTPHandler(w http.ResponseWriter, r *http.Request, username string) {
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		problem.Internal(w, r, err)
+		return
+	}
+	ok, err := h.DB.SetTOTPSecret(r.Context(), username, secret)
+	if err != nil {
+		problem.Internal(w, r, err)
+		return
+	}
+	if !ok {
+		problem.Write(w, r, http.StatusConflict, problem.CodeMFAAlreadyEnabled, "MFA is already enabled. Disable it before enrolling again.")
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{
+		"secret":      secret,
+		"otpauth_uri": totp.URI(h.TOTPIssuer, username, secret),
+	})
+}
+
+// ConfirmTOTPHandler handles POST /mfa/totp/confirm. A valid code proves the
+// authenticator app is set up; MFA is enabled and the recovery codes are
+// returned. They are stored hashed and cannot be shown again.
+func (h *AuthHandler) ConfirmTOTPHandler(w http.ResponseWriter, r *http.Request, username string) {
+	var req struct {
+		Code string `json:"code" validate:"required,max=6"`
+	}
+	if !validate.DecodeJSON(w, r, &req) {
+		return
+	}
+	user, err := h.DB.GetUserByUsername(r.Context(), username)
+	if err != nil {
+		problem.Internal(w, r, err)
+		return
+	}
+	if user.MFAEnabled {
+		problem.Write(w, r, http.StatusConflict, problem.CodeMFAAlreadyEnabled, "MFA is already enabled.")
+		return
+	}
+	if user.TOTPSecret == "" {
+		problem.Write(w, r, http.StatusConflict, problem.CodeConflict, "Start an enrolment at /mfa/totp/enroll first.")
+		return
+	}
+	step, ok := totp.Validate(user.TOTPSecret, req.Code, time.Now())
+	if !ok {
+		problem.Write(w, r, http.StatusBadRequest, problem.CodeInvalidMFACode, "The code is invalid.")
+		return
+	}
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		if codes[i], err = newRecoveryCode(); err != nil {
+			problem.Internal(w, r, err)
+			return
+		}
+		hashes[i] = hashToken(normalizeRecoveryCode(codes[i]))
+	}
+	if err := h.DB.EnableTOTP(r.Context(), username, step, hashes); err != nil {
+		problem.Internal(w, r, err)
+		return
+	}
+	h.record(r, username, "user.mfa.enable", username, audit.OutcomeSuccess)
+	json.NewEncoder(w).Encode(map[string]interface{}{"mfa_enabled": true, "recovery_codes": codes})
+}
+
+// DisableTOTPHandler handles DELETE /mfa/totp. The password and a current
+// code or recovery code are required, so a stolen token alone cannot turn MFA off.
+func (h *AuthHandler) DisableTOTPHandler(w http.ResponseWriter, r *http.Request, username string) {
+	var req struct {
+		Password     string `json:"password" validate:"required,max=128"`
+		Code         string `json:"code" validate:"max=6"`
+		RecoveryCode string `json:"recovery_code" validate:"max=32"`
+	}
+	if !validate.DecodeJSON(w, r, &req) {
+		return
+	}
+	if (req.Code == "") == (req.RecoveryCode == "") {
+		problem.Validation(w, r, []problem.FieldError{{Field: "code", Code: "required", Message: "exactly one of code and recovery_code is required"}})
+		return
+	}
+	user, err := h.DB.GetUserByUsername(r.Context(), username)
+	if err != nil {
+		problem.Internal(w, r, err)
+		return
+	}
+	if !user.MFAEnabled {
+		problem.Write(w, r, http.StatusConflict, problem.CodeConflict, "MFA is not enabled.")
+		return
+	}
+	ok, err := h.checkPassword(r, user, req.Password)
+	if err != nil {
+		problem.Internal(w, r, err)
+		return
+	}
+	if !ok {
+		h.record(r, username, "user.mfa.disable", username, audit.OutcomeFailure)
+		problem.Write(w, r, http.StatusForbidden, problem.CodeInvalidCredentials, "The password is incorrect.")
+		return
+	}
+	ok, err = h.checkSecondFactor(r, user, req.Code, req.RecoveryCode)
+	if err != nil {
+		problem.Internal(w, r, err)
+		return
+	}
+	if !ok {
+		h.record(r, username, "user.mfa.disable", username, audit.OutcomeFailure)
+		problem.Write(w, r, http.StatusForbidden, problem.CodeInvalidMFACode, "The code is invalid.")
+		return
+	}
+	if err := h.DB.DisableTOTP(r.Context(), username); err != nil {
+		problem.Internal(w, r, err)
+		return
+	}
+	h.record(r, username, "user.mfa.disable", username, audit.OutcomeSuccess)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// newRecoveryCode returns a random code formatted as four groups of four
+// characters for easy copying.
+func newRecoveryCode() (string, error) {
+	b := make([]byte, 10)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	s := strings.ToLower(base32.StdEncoding.EncodeToString(b))
+	return s[0:4] + "-" + s[4:8] + "-" + s[8:12] + "-" + s[12:16], nil
+}
+
+// normalizeRecoveryCode drops separators and case so codes match however
+// they were typed.
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
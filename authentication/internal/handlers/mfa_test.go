@@ -0,0 +1,107 @@
+package handlers
+
+import (
+	"authentication/internal/db"
+	"authentication/internal/models"
+	"authentication/internal/totp"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// factorStore is a database/sql driver that keeps one user's last used
+// TOTP step and unused recovery code hashes, and applies the conditional
+// updates of UseTOTPStep and UseRecoveryCode to them.
+type factorStore struct {
+	mu       sync.Mutex
+	lastStep int64
+	unused   map[string]bool
+}
+
+func (f *factorStore) Connect(context.Context) (driver.Conn, error) { return &factorConn{f}, nil }
+func (f *factorStore) Driver() driver.Driver                        { return nil }
+
+type factorConn struct{ f *factorStore }
+
+func (c *factorConn) Prepare(string) (driver.Stmt, error) { return nil, errors.New("not supported") }
+func (c *factorConn) Close() error                        { return nil }
+func (c *factorConn) Begin() (driver.Tx, error)           { return nil, errors.New("not supported") }
+
+func (c *factorConn) ExecContext(_ context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	c.f.mu.Lock()
+	defer c.f.mu.Unlock()
+	switch {
+	case strings.HasPrefix(query, "UPDATE users SET totp_last_step="):
+		step := args[0].Value.(int64)
+		if step <= c.f.lastStep {
+			return driver.RowsAffected(0), nil
+		}
+		c.f.lastStep = step
+		return driver.RowsAffected(1), nil
+	case strings.HasPrefix(query, "UPDATE recovery_codes SET used_at="):
+		hash := args[2].Value.(string)
+		if !c.f.unused[hash] {
+			return driver.RowsAffected(0), nil
+		}
+		delete(c.f.unused, hash)
+		return driver.RowsAffected(1), nil
+	}
+	return nil, errors.New("unexpected statement " + query)
+}
+
+func TestCheckSecondFactorRefusesReuse(t *testing.T) {
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		t.Fatalf("GenerateSecret: %v", err)
+	}
+	f := &factorStore{unused: map[string]bool{hashToken(normalizeRecoveryCode("abcd-efgh-ijkl-mnop")): true}}
+	conn := sql.OpenDB(f)
+	defer conn.Close()
+	h := &AuthHandler{DB: &db.DB{Conn: conn}}
+	user := &models.User{Username: "alice", MFAEnabled: true, TOTPSecret: secret}
+	r := httptest.NewRequest(http.MethodPost, "/login/mfa", nil)
+
+	code := func(step int64) string {
+		c, err := totp.Code(secret, step)
+		if err != nil {
+			t.Fatalf("Code: %v", err)
+		}
+		return c
+	}
+	// The codes are checked against the clock, so keep clear of the end of a step
+	if left := totp.Period - time.Duration(time.Now().UnixNano()%int64(totp.Period)); left < time.Second {
+		time.Sleep(left)
+	}
+	now := totp.Step(time.Now())
+	// The accepted drift means a code one step back is still valid until a later one is used
+	tests := []struct {
+		name         string
+		code         string
+		recoveryCode string
+		want         bool
+	}{
+		{name: "previous step", code: code(now - 1), want: true},
+		{name: "current step", code: code(now), want: true},
+		{name: "current step replayed", code: code(now), want: false},
+		{name: "previous step after a later one", code: code(now - 1), want: false},
+		{name: "recovery code", recoveryCode: "ABCD EFGH IJKL MNOP", want: true},
+		{name: "recovery code reused", recoveryCode: "abcd-efgh-ijkl-mnop", want: false},
+		{name: "unknown recovery code", recoveryCode: "aaaa-bbbb-cccc-dddd", want: false},
+	}
+	for _, tt := range tests {
+		ok, err := h.checkSecondFactor(r, user, tt.code, tt.recoveryCode)
+		if err != nil {
+			t.Fatalf("%s: checkSecondFactor: %v", tt.name, err)
+		}
+		if ok != tt.want {
+			t.Errorf("%s: checkSecondFactor = %v, want %v", tt.name, ok, tt.want)
+		}
+	}
+}
@@ -0,0 +1,252 @@
+package handlers
+
+import (
+	"authentication/internal/models"
+	"authentication/internal/ratelimit"
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"shared/audit"
+	"shared/problem"
+	"shared/validate"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/lib/pq"
+)
+
+// serviceTokenTTL is the lifetime of client-credentials access tokens.
+const serviceTokenTTL = time.Hour
+
+// TokenHandler handles POST /oauth/token, the OAuth2 token endpoint. It
+// supports the client_credentials grant for services and the
+// authorization_code grant with PKCE for OpenID Connect clients.
+// Confidential clients authenticate with HTTP Basic or the client_id and
+// client_secret form fields; public clients send only client_id. Errors
+// follow RFC 6749 section 5.2 rather than problem+json so standard OAuth2
+// clients understand them.
+func (h *AuthHandler) TokenHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		problem.MethodNotAllowed(w, r)
+		return
+	}
+	validate.LimitBody(w, r)
+	if err := r.ParseForm(); err != nil {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", "The request body must be form encoded.")
+		return
+	}
+	grant := r.PostForm.Get("grant_type")
+	if grant != "client_credentials" && grant != "authorization_code" {
+		writeOAuthError(w, http.StatusBadRequest, "unsupported_grant_type", "Only the client_credentials and authorization_code grants are supported.")
+		return
+	}
+	if !allow(w, r, h.Limits.LoginPerIP, ratelimit.ClientIP(r, h.Limits.TrustProxy), "oauth_token", "ip") {
+		return
+	}
+	client, ok := h.authenticateClient(w, r)
+	if !ok {
+		return
+	}
+	if grant == "authorization_code" {
+		h.authorizationCodeGrant(w, r, client)
+		return
+	}
+	h.clientCredentialsGrant(w, r, client)
+}
+
+// authenticateClient identifies the calling client, checking the secret of
+// confidential clients. On failure it writes the error and returns false.
+func (h *AuthHandler) authenticateClient(w http.ResponseWriter, r *http.Request) (*models.Client, bool) {
+	clientID, secret, ok := clientCredentials(r)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Basic realm="oauth"`)
+		writeOAuthError(w, http.StatusUnauthorized, "invalid_client", "Client authentication is required.")
+		return nil, false
+	}
+	client, err := h.DB.GetClient(r.Context(), clientID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		problem.Internal(w, r, err)
+		return nil, false
+	}
+	if err != nil || (!client.Public && subtle.ConstantTimeCompare([]byte(client.SecretHash), []byte(hashToken(secret))) != 1) {
+		slog.WarnContext(r.Context(), "Client authentication failed", "client_id", clientID)
+		h.record(r, "client:"+clientID, "oauth.token", clientID, audit.OutcomeFailure)
+		w.Header().Set("WWW-Authenticate", `Basic realm="oauth"`)
+		writeOAuthError(w, http.StatusUnauthorized, "invalid_client", "Client authentication failed.")
+		return nil, false
+	}
+	return client, true
+}
+
+// clientCredentialsGrant issues a service token carrying the client's
+// scopes, or the requested subset of them.
+func (h *AuthHandler) clientCredentialsGrant(w http.ResponseWriter, r *http.Request, client *models.Client) {
+	if client.Public {
+		writeOAuthError(w, http.StatusBadRequest, "unauthorized_client", "Public clients cannot use the client_credentials grant.")
+		return
+	}
+	scopes := client.Scopes
+	if requested := strings.Fields(r.PostForm.Get("scope")); len(requested) > 0 {
+		for _, s := range requested {
+			if !slices.Contains(client.Scopes, s) {
+				writeOAuthError(w, http.StatusBadRequest, "invalid_scope", "The client may not request scope "+s+".")
+				return
+			}
+		}
+		scopes = requested
+	}
+	now := time.Now()
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"sub":       client.ClientID,
+		"client_id": client.ClientID,
+		"scope":     strings.Join(scopes, " "),
+		"iat":       now.Unix(),
+		"exp":       now.Add(serviceTokenTTL).Unix(),
+	})
+	tokenString, err := token.SignedString(h.JWTSecret)
+	if err != nil {
+		problem.Internal(w, r, err)
+		return
+	}
+	writeTokenResponse(w, map[string]interface{}{
+		"access_token": tokenString,
+		"token_type":   "Bearer",
+		"expires_in":   int(serviceTokenTTL.Seconds()),
+		"scope":        strings.Join(scopes, " "),
+	})
+	h.record(r, "client:"+client.ClientID, "oauth.token", client.ClientID, audit.OutcomeSuccess)
+}
+
+// clientCredentials returns the client ID and secret from HTTP Basic auth,
+// whose parts are form encoded per RFC 6749, or from the form body. The
+// secret is empty for public clients.
+func clientCredentials(r *http.Request) (id, secret string, ok bool) {
+	if id, secret, ok := r.BasicAuth(); ok {
+		id, err1 := url.QueryUnescape(id)
+		secret, err2 := url.QueryUnescape(secret)
+		return id, secret, err1 == nil && err2 == nil && id != ""
+	}
+	id, secret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	return id, secret, id != ""
+}
+
+func writeTokenResponse(w http.ResponseWriter, body map[string]interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(body)
+}
+
+func writeOAuthError(w http.ResponseWriter, status int, code, description string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": code, "error_description": description})
+}
+
+// CreateClientHandler handles POST /admin/clients, registering a service
+// client. The generated secret is returned once and only its hash is kept.
+func (h *AuthHandler) CreateClientHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ClientID     string   `json:"client_id" validate:"required,max=64"`
+		Name         string   `json:"name" validate:"max=100"`
+		Scopes       []string `json:"scopes" validate:"required,max=10,dive,oneof=products orders payments openid profile email"`
+		RedirectURIs []string `json:"redirect_uris" validate:"max=10,dive,required,max=2000"`
+		Public       bool     `json:"public"`
+	}
+	if !validate.DecodeJSON(w, r, &req) {
+		return
+	}
+	if errs := validateClientRegistration(req.Scopes, req.RedirectURIs, req.Public); len(errs) > 0 {
+		problem.Validation(w, r, errs)
+		return
+	}
+	client := models.Client{ClientID: req.ClientID, Name: req.Name, Scopes: req.Scopes, RedirectURIs: req.RedirectURIs, Public: req.Public}
+	var secret string
+	if !client.Public {
+		var err error
+		if secret, client.SecretHash, err = newToken(); err != nil {
+			problem.Internal(w, r, err)
+			return
+		}
+	}
+	if err := h.DB.CreateClient(r.Context(), &client); err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+			problem.Write(w, r, http.StatusConflict, problem.CodeClientExists, "A client with this ID already exists.")
+			return
+		}
+		problem.Internal(w, r, err)
+		return
+	}
+	slog.InfoContext(r.Context(), "Service client registered", "client_id", client.ClientID, "scopes", client.Scopes, "by", r.Context().Value("username"))
+	h.record(r, "", "client.create", client.ClientID, audit.OutcomeSuccess)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(struct {
+		models.Client
+		ClientSecret string `json:"client_secret,omitempty"`
+	}{client, secret})
+}
+
+// EnsureServiceClient registers a client-credentials client with a known
+// secret, as configured at startup, replacing the secret and scopes of an
+// existing client with the same ID.
+func (h *AuthHandler) EnsureServiceClient(ctx context.Context, clientID, secret string, scopes []string) error {
+	return h.DB.UpsertServiceClient(ctx, &models.Client{ClientID: clientID, Name: clientID, SecretHash: hashToken(secret), Scopes: scopes})
+}
+
+// validateClientRegistration checks the rules between fields of a client
+// registration: OpenID Connect clients need redirect URIs and the openid
+// scope, and public clients can only be OpenID Connect clients.
+func validateClientRegistration(scopes, redirectURIs []string, public bool) []problem.FieldError {
+	var errs []problem.FieldError
+	for i, raw := range redirectURIs {
+		u, err := url.Parse(raw)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.Fragment != "" {
+			errs = append(errs, problem.FieldError{Field: fmt.Sprintf("redirect_uris[%d]", i), Code: "invalid", Message: "must be an absolute http(s) URL without a fragment"})
+		}
+	}
+	oidc := slices.Contains(scopes, "openid")
+	if oidc != (len(redirectURIs) > 0) {
+		errs = append(errs, problem.FieldError{Field: "redirect_uris", Code: "invalid", Message: "OpenID Connect clients need both the openid scope and redirect URIs"})
+	}
+	if public && !oidc {
+		errs = append(errs, problem.FieldError{Field: "public", Code: "invalid", Message: "only OpenID Connect clients can be public"})
+	}
+	return errs
+}
+
+// ListClientsHandler handles GET /admin/clients.
+func (h *AuthHandler) ListClientsHandler(w http.ResponseWriter, r *http.Request) {
+	clients, err := h.DB.ListClients(r.Context())
+	if err != nil {
+		problem.Internal(w, r, err)
+		return
+	}
+	json.NewEncoder(w).Encode(clients)
+}
+
+// DeleteClientHandler handles DELETE /admin/clients/{client_id}. Tokens
+// already issued stay valid until they expire.
+func (h *AuthHandler) DeleteClientHandler(w http.ResponseWriter, r *http.Request) {
+	clientID := r.PathValue("client_id")
+	found, err := h.DB.DeleteClient(r.Context(), clientID)
+	if err != nil {
+		problem.Internal(w, r, err)
+		return
+	}
+	if !found {
+		problem.Write(w, r, http.StatusNotFound, problem.CodeClientNotFound, "No client with ID "+clientID+".")
+		return
+	}
+	slog.InfoContext(r.Context(), "Service client deleted", "client_id", clientID, "by", r.Context().Value("username"))
+	h.record(r, "", "client.delete", clientID, audit.OutcomeSuccess)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,519 @@
+package handlers
+
+import (
+	"authentication/internal/metrics"
+	"authentication/internal/models"
+	"authentication/internal/password"
+	"authentication/internal/ratelimit"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"shared/audit"
+	"shared/problem"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	// authorizationCodeTTL is how long a client has to redeem an authorization code.
+	authorizationCodeTTL = 5 * time.Minute
+	// oidcTokenTTL is the lifetime of access and ID tokens issued to OpenID Connect clients.
+	oidcTokenTTL = time.Hour
+	// csrfCookie holds the token the login form of /authorize must echo.
+	csrfCookie = "authorize_csrf"
+	// csrfTokenTTL is how long the login form can be submitted.
+	csrfTokenTTL = 30 * time.Minute
+)
+
+// DiscoveryHandler handles GET /.well-known/openid-configuration.
+func (h *AuthHandler) DiscoveryHandler(w http.ResponseWriter, r *http.Request) {
+	issuer := h.OIDC.Issuer
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"issuer":                                issuer,
+		"authorization_endpoint":                issuer + "/authorize",
+		"token_endpoint":                        issuer + "/oauth/token",
+		"userinfo_endpoint":                     issuer + "/userinfo",
+		"jwks_uri":                              issuer + "/.well-known/jwks.json",
+		"response_types_supported":              []string{"code"},
+		"response_modes_supported":              []string{"query"},
+		"grant_types_supported":                 []string{"authorization_code", "client_credentials"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"scopes_supported":                      []string{"openid", "profile", "email"},
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post", "none"},
+		"code_challenge_methods_supported":      []string{"S256"},
+		"claims_supported":                      []string{"sub", "iss", "aud", "exp", "iat", "auth_time", "nonce", "preferred_username", "name", "email", "email_verified"},
+	})
+}
+
+// JWKSHandler handles GET /.well-known/jwks.json, publishing the key ID tokens are signed with.
+func (h *AuthHandler) JWKSHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.OIDC.Key.JWKS())
+}
+
+// authorizeRequest holds the parameters of an authorization request, which
+// are carried through the login form as hidden fields.
+type authorizeRequest struct {
+	ClientID      string
+	ClientName    string
+	RedirectURI   string
+	Scope         string
+	State         string
+	Nonce         string
+	CodeChallenge string
+}
+
+var loginPage = template.Must(template.New("login").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head><meta charset="utf-8"><title>Sign in</title></head>
+<body>
+<h1>Sign in to {{if .Request.ClientName}}{{.Request.ClientName}}{{else}}{{.Request.ClientID}}{{end}}</h1>
+{{if .Error}}<p role="alert">{{.Error}}</p>{{end}}
+<form method="post">
+<input type="hidden" name="csrf_token" value="{{.CSRFToken}}">
+<input type="hidden" name="response_type" value="code">
+<input type="hidden" name="client_id" value="{{.Request.ClientID}}">
+<input type="hidden" name="redirect_uri" value="{{.Request.RedirectURI}}">
+<input type="hidden" name="scope" value="{{.Request.Scope}}">
+<input type="hidden" name="state" value="{{.Request.State}}">
+<input type="hidden" name="nonce" value="{{.Request.Nonce}}">
+<input type="hidden" name="code_challenge" value="{{.Request.CodeChallenge}}">
+<input type="hidden" name="code_challenge_method" value="S256">
+<label>Username <input name="username" value="{{.Username}}" autocomplete="username" required></label>
+<label>Password <input name="password" type="password" autocomplete="current-password" required></label>
+{{if .AskCode}}<label>Authenticator code <input name="code" inputmode="numeric" autocomplete="one-time-code"></label>{{end}}
+<button type="submit">Sign in</button>
+</form>
+</body>
+</html>
+`))
+
+// AuthorizeHandler handles /authorize, the OpenID Connect authorization
+// endpoint for the authorization code flow with PKCE. GET shows a login form;
+// POST checks the credentials with the same rate limits, lockout and MFA
+// rules as /login and redirects back to the client with a code.
+func (h *AuthHandler) AuthorizeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		problem.MethodNotAllowed(w, r)
+		return
+	}
+	if r.Method == http.MethodPost {
+		r.Body = http.MaxBytesReader(w, r.Body, 64<<10)
+	}
+	if err := r.ParseForm(); err != nil {
+		problem.Write(w, r, http.StatusBadRequest, problem.CodeBadRequest, "The request could not be parsed.")
+		return
+	}
+	req, ok := h.parseAuthorizeRequest(w, r)
+	if !ok {
+		return
+	}
+	// The login form must not be framed by other sites
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.Header().Set("Content-Security-Policy", "frame-ancestors 'none'")
+	w.Header().Set("Cache-Control", "no-store")
+	if r.Method == http.MethodGet {
+		h.renderLogin(w, r, http.StatusOK, map[string]interface{}{"Request": req})
+		return
+	}
+	// A credential POST must come from our own login form
+	if !h.sameOrigin(r) {
+		problem.Write(w, r, http.StatusForbidden, problem.CodeForbidden, "Cross-origin sign-in requests are not allowed.")
+		return
+	}
+	if !validCSRFToken(r) {
+		h.renderLogin(w, r, http.StatusForbidden, map[string]interface{}{"Request": req, "Error": "The sign-in form expired, please try again."})
+		return
+	}
+
+	username := r.PostForm.Get("username")
+	user, msg, askCode, err := h.authenticateForm(r, username, r.PostForm.Get("password"), r.PostForm.Get("code"))
+	if err != nil {
+		problem.Internal(w, r, err)
+		return
+	}
+	if user == nil {
+		// Being asked for the MFA code is not a failure yet
+		if username != "" && !(askCode && r.PostForm.Get("code") == "") {
+			h.record(r, username, "oidc.authorize", req.ClientID, audit.OutcomeFailure)
+		}
+		h.renderLogin(w, r, http.StatusUnauthorized, map[string]interface{}{"Request": req, "Error": msg, "Username": username, "AskCode": askCode})
+		return
+	}
+
+	code, hash, err := newToken()
+	if err != nil {
+		problem.Internal(w, r, err)
+		return
+	}
+	now := time.Now()
+	err = h.DB.CreateAuthorizationCode(r.Context(), &models.AuthorizationCode{
+		CodeHash:      hash,
+		ClientID:      req.ClientID,
+		Username:      user.Username,
+		RedirectURI:   req.RedirectURI,
+		Scope:         req.Scope,
+		Nonce:         req.Nonce,
+		CodeChallenge: req.CodeChallenge,
+		AuthTime:      now,
+		ExpiresAt:     now.Add(authorizationCodeTTL),
+	})
+	if err != nil {
+		problem.Internal(w, r, err)
+		return
+	}
+	metrics.LoginsSucceeded.Inc()
+	h.record(r, user.Username, "oidc.authorize", req.ClientID, audit.OutcomeSuccess)
+	http.SetCookie(w, h.csrfCookie("", -1))
+	redirectWithParams(w, r, req.RedirectURI, url.Values{"code": {code}, "state": {req.State}})
+}
+
+// renderLogin shows the login form with a fresh CSRF token, which is also set
+// as a cookie. A forged cross-site POST has neither the cookie, which is
+// SameSite, nor the token from the form.
+func (h *AuthHandler) renderLogin(w http.ResponseWriter, r *http.Request, status int, data map[string]interface{}) {
+	token, _, err := newToken()
+	if err != nil {
+		problem.Internal(w, r, err)
+		return
+	}
+	http.SetCookie(w, h.csrfCookie(token, int(csrfTokenTTL.Seconds())))
+	data["CSRFToken"] = token
+	w.WriteHeader(status)
+	loginPage.Execute(w, data)
+}
+
+// csrfCookie returns the CSRF cookie with value, or a cookie deleting it for a negative maxAge.
+func (h *AuthHandler) csrfCookie(value string, maxAge int) *http.Cookie {
+	return &http.Cookie{
+		Name:     csrfCookie,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(h.OIDC.Issuer, "https://"),
+		SameSite: http.SameSiteStrictMode,
+	}
+}
+
+// validCSRFToken reports whether the form echoes the token of the CSRF cookie.
+func validCSRFToken(r *http.Request) bool {
+	cookie, err := r.Cookie(csrfCookie)
+	if err != nil || cookie.Value == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(r.PostForm.Get("csrf_token"))) == 1
+}
+
+// sameOrigin reports whether a browser sent r from the issuer's own origin.
+// Browsers send Origin with every POST; a request without it is left to the
+// CSRF token.
+func (h *AuthHandler) sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	issuer, err := url.Parse(h.OIDC.Issuer)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(origin, issuer.Scheme+"://"+issuer.Host)
+}
+
+// parseAuthorizeRequest validates the authorization request. Problems with
+// the client or redirect URI are shown to the user, since redirecting to an
+// unverified URI would be an open redirect; anything else is reported to the
+// client by redirecting back with an error.
+func (h *AuthHandler) parseAuthorizeRequest(w http.ResponseWriter, r *http.Request) (*authorizeRequest, bool) {
+	client, err := h.DB.GetClient(r.Context(), r.Form.Get("client_id"))
+	if errors.Is(err, sql.ErrNoRows) {
+		problem.Write(w, r, http.StatusBadRequest, problem.CodeClientNotFound, "Unknown client_id.")
+		return nil, false
+	}
+	if err != nil {
+		problem.Internal(w, r, err)
+		return nil, false
+	}
+	redirectURI := r.Form.Get("redirect_uri")
+	if !slices.Contains(client.RedirectURIs, redirectURI) {
+		problem.Write(w, r, http.StatusBadRequest, problem.CodeBadRequest, "redirect_uri is not registered for this client.")
+		return nil, false
+	}
+
+	req := &authorizeRequest{
+		ClientID:      client.ClientID,
+		ClientName:    client.Name,
+		RedirectURI:   redirectURI,
+		Scope:         r.Form.Get("scope"),
+		State:         r.Form.Get("state"),
+		Nonce:         r.Form.Get("nonce"),
+		CodeChallenge: r.Form.Get("code_challenge"),
+	}
+	fail := func(code, description string) (*authorizeRequest, bool) {
+		redirectWithParams(w, r, redirectURI, url.Values{"error": {code}, "error_description": {description}, "state": {req.State}})
+		return nil, false
+	}
+	if r.Form.Get("response_type") != "code" {
+		return fail("unsupported_response_type", "Only response_type=code is supported.")
+	}
+	scopes := strings.Fields(req.Scope)
+	if !slices.Contains(scopes, "openid") {
+		return fail("invalid_scope", "The openid scope is required.")
+	}
+	for _, s := range scopes {
+		if !slices.Contains(client.Scopes, s) {
+			return fail("invalid_scope", "The client may not request scope "+s+".")
+		}
+	}
+	if r.Form.Get("code_challenge_method") != "S256" || len(req.CodeChallenge) != 43 {
+		return fail("invalid_request", "PKCE with code_challenge_method=S256 is required.")
+	}
+	if len(req.State) > 512 || len(req.Nonce) > 512 {
+		return fail("invalid_request", "state and nonce must be at most 512 characters.")
+	}
+	return req, true
+}
+
+// authenticateForm checks login form credentials. It returns the user on
+// success, or a message for the form and whether to ask for an MFA code.
+func (h *AuthHandler) authenticateForm(r *http.Request, username, pw, code string) (user *models.User, msg string, askCode bool, err error) {
+	const invalid = "Invalid username or password."
+	if username == "" || pw == "" || len(username) > 64 || len(pw) > 128 {
+		return nil, invalid, false, nil
+	}
+	if ok, _ := h.Limits.LoginPerIP.Allow(ratelimit.ClientIP(r, h.Limits.TrustProxy)); !ok {
+		metrics.RateLimited.WithLabelValues("authorize", "ip").Inc()
+		return nil, "Too many attempts, try again later.", false, nil
+	}
+	if ok, _ := h.Limits.LoginPerUser.Allow(username); !ok {
+		metrics.RateLimited.WithLabelValues("authorize", "username").Inc()
+		return nil, "Too many attempts, try again later.", false, nil
+	}
+	user, err = h.DB.GetUserByUsername(r.Context(), username)
+	if errors.Is(err, sql.ErrNoRows) {
+		password.CheckNone(pw)
+		metrics.LoginsFailed.Inc()
+		return nil, invalid, false, nil
+	}
+	if err != nil {
+		return nil, "", false, err
+	}
+	if user.LockedUntil != nil && time.Now().Before(*user.LockedUntil) {
+		metrics.LoginsFailed.Inc()
+		return nil, "The account is temporarily locked after too many failed logins.", false, nil
+	}
+	ok, err := h.checkPassword(r, user, pw)
+	if err != nil {
+		return nil, "", false, err
+	}
+	if !ok {
+		metrics.LoginsFailed.Inc()
+		return nil, invalid, false, h.recordFailedLogin(r, user.Username)
+	}
+	if h.RequireVerifiedEmail && !user.EmailVerified {
+		return nil, "Verify your email address before logging in.", false, nil
+	}
+	if user.MFAEnabled {
+		if code == "" {
+			return nil, "Enter the code from your authenticator app.", true, nil
+		}
+		ok, err := h.checkSecondFactor(r, user, code, "")
+		if err != nil {
+			return nil, "", false, err
+		}
+		if !ok {
+			metrics.LoginsFailed.Inc()
+			return nil, "The code is invalid.", true, h.recordFailedLogin(r, user.Username)
+		}
+	}
+	if user.FailedLogins > 0 || user.LockedUntil != nil {
+		if err := h.DB.ResetFailedLogins(r.Context(), user.Username); err != nil {
+			return nil, "", false, err
+		}
+	}
+	return user, "", false, nil
+}
+
+// redirectWithParams redirects to target with params added to its query.
+func redirectWithParams(w http.ResponseWriter, r *http.Request, target string, params url.Values) {
+	u, err := url.Parse(target)
+	if err != nil {
+		problem.Internal(w, r, err)
+		return
+	}
+	q := u.Query()
+	for k, v := range params {
+		if v[0] != "" {
+			q[k] = v
+		}
+	}
+	u.RawQuery = q.Encode()
+	http.Redirect(w, r, u.String(), http.StatusFound)
+}
+
+// authorizationCodeGrant redeems an authorization code for an access token
+// and an ID token after checking the PKCE code verifier.
+func (h *AuthHandler) authorizationCodeGrant(w http.ResponseWriter, r *http.Request, client *models.Client) {
+	code, redirectURI, verifier := r.PostForm.Get("code"), r.PostForm.Get("redirect_uri"), r.PostForm.Get("code_verifier")
+	if code == "" || redirectURI == "" || len(verifier) < 43 || len(verifier) > 128 {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", "code, redirect_uri and a code_verifier of 43 to 128 characters are required.")
+		return
+	}
+	ac, err := h.DB.ConsumeAuthorizationCode(r.Context(), hashToken(code))
+	if err != nil {
+		problem.Internal(w, r, err)
+		return
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	challenge := base64.RawURLEncoding.EncodeToString(sum[:])
+	if ac == nil || ac.ClientID != client.ClientID || ac.RedirectURI != redirectURI ||
+		subtle.ConstantTimeCompare([]byte(challenge), []byte(ac.CodeChallenge)) != 1 {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "The authorization code is invalid, expired or was issued to another client.")
+		return
+	}
+	user, err := h.DB.GetUserByUsername(r.Context(), ac.Username)
+	if errors.Is(err, sql.ErrNoRows) {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "The user no longer exists.")
+		return
+	}
+	if err != nil {
+		problem.Internal(w, r, err)
+		return
+	}
+
+	// The access token only grants access to /userinfo: it names the user by
+	// ID rather than username and has an audience, which the services and
+	// the gateway reject everywhere else
+	now := time.Now()
+	accessToken, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"iss":   h.OIDC.Issuer,
+		"aud":   h.userInfoAudience(),
+		"sub":   strconv.Itoa(user.ID),
+		"azp":   client.ClientID,
+		"scope": ac.Scope,
+		"iat":   now.Unix(),
+		"exp":   now.Add(oidcTokenTTL).Unix(),
+	}).SignedString(h.JWTSecret)
+	if err != nil {
+		problem.Internal(w, r, err)
+		return
+	}
+	claims := userClaims(user, strings.Fields(ac.Scope))
+	claims["iss"] = h.OIDC.Issuer
+	claims["aud"] = client.ClientID
+	claims["iat"] = now.Unix()
+	claims["exp"] = now.Add(oidcTokenTTL).Unix()
+	claims["auth_time"] = ac.AuthTime.Unix()
+	if ac.Nonce != "" {
+		claims["nonce"] = ac.Nonce
+	}
+	idToken := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	idToken.Header["kid"] = h.OIDC.Key.ID
+	idTokenString, err := idToken.SignedString(h.OIDC.Key.Private)
+	if err != nil {
+		problem.Internal(w, r, err)
+		return
+	}
+	slog.InfoContext(r.Context(), "Issued OpenID Connect tokens", "client_id", client.ClientID, "username", user.Username)
+	writeTokenResponse(w, map[string]interface{}{
+		"access_token": accessToken,
+		"token_type":   "Bearer",
+		"expires_in":   int(oidcTokenTTL.Seconds()),
+		"id_token":     idTokenString,
+		"scope":        ac.Scope,
+	})
+}
+
+// UserInfoHandler handles GET and POST /userinfo, returning the claims about
+// the user that the access token's scopes allow. It checks the bearer token
+// itself: OpenID Connect access tokens must carry the userinfo audience, and
+// tokens from /login carry no scope and see every claim.
+func (h *AuthHandler) UserInfoHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		problem.MethodNotAllowed(w, r)
+		return
+	}
+	invalid := func() {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		problem.Write(w, r, http.StatusUnauthorized, problem.CodeUnauthorized, "Invalid token.")
+	}
+	var claims jwt.MapClaims
+	_, err := jwt.ParseWithClaims(extractBearer(r), &claims, func(*jwt.Token) (interface{}, error) {
+		return h.JWTSecret, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
+	if err != nil {
+		invalid()
+		return
+	}
+
+	var user *models.User
+	scopes := []string{"openid", "profile", "email"}
+	if _, ok := claims["aud"]; ok {
+		audience, _ := claims.GetAudience()
+		sub, _ := claims.GetSubject()
+		id, err := strconv.Atoi(sub)
+		if !slices.Contains(audience, h.userInfoAudience()) || err != nil {
+			invalid()
+			return
+		}
+		scope, _ := claims["scope"].(string)
+		scopes = strings.Fields(scope)
+		user, err = h.DB.GetUserByID(r.Context(), id)
+	} else if username, _ := claims["username"].(string); username != "" {
+		user, err = h.DB.GetUserByUsername(r.Context(), username)
+	} else {
+		// Service tokens have no user
+		invalid()
+		return
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		problem.Write(w, r, http.StatusNotFound, problem.CodeUserNotFound, "The account no longer exists.")
+		return
+	}
+	if err != nil {
+		problem.Internal(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(userClaims(user, scopes))
+}
+
+// userInfoAudience is the audience of access tokens issued to OpenID Connect clients.
+func (h *AuthHandler) userInfoAudience() string {
+	return h.OIDC.Issuer + "/userinfo"
+}
+
+// userClaims returns the standard claims about user allowed by scopes.
+func userClaims(user *models.User, scopes []string) jwt.MapClaims {
+	claims := jwt.MapClaims{"sub": strconv.Itoa(user.ID)}
+	if slices.Contains(scopes, "profile") {
+		claims["preferred_username"] = user.Username
+		claims["name"] = user.DisplayName
+	}
+	if slices.Contains(scopes, "email") {
+		claims["email"] = user.Email
+		claims["email_verified"] = user.EmailVerified
+	}
+	return claims
+}
+
+func extractBearer(r *http.Request) string {
+	scheme, token, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !strings.EqualFold(scheme, "bearer") {
+		return ""
+	}
+	return token
+}
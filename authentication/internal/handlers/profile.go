@@ -0,0 +1,196 @@
+package handlers
+
+import (
+	"authentication/internal/mail"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"shared/audit"
+	"shared/problem"
+	"shared/validate"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// emailTokenTTL is how long an email verification code stays valid.
+const emailTokenTTL = 24 * time.Hour
+
+// GetProfileHandler handles GET /me.
+func (h *AuthHandler) GetProfileHandler(w http.ResponseWriter, r *http.Request, username string) {
+	user, err := h.DB.GetUserByUsername(r.Context(), username)
+	if errors.Is(err, sql.ErrNoRows) {
+		problem.Write(w, r, http.StatusNotFound, problem.CodeUserNotFound, "The account no longer exists.")
+		return
+	}
+	if err != nil {
+		problem.Internal(w, r, err)
+		return
+	}
+	json.NewEncoder(w).Encode(user)
+}
+
+// UpdateProfileHandler handles PATCH /me. Only the fields present in the body
+// change. A new email address is not used until it is confirmed with the code
+// mailed to it, see ConfirmEmailChangeHandler.
+func (h *AuthHandler) UpdateProfileHandler(w http.ResponseWriter, r *http.Request, username string) {
+	var req struct {
+		DisplayName *string `json:"display_name"`
+		Email       *string `json:"email"`
+	}
+	if !validate.DecodeJSON(w, r, &req) {
+		return
+	}
+	user, err := h.DB.GetUserByUsername(r.Context(), username)
+	if errors.Is(err, sql.ErrNoRows) {
+		problem.Write(w, r, http.StatusNotFound, problem.CodeUserNotFound, "The account no longer exists.")
+		return
+	}
+	if err != nil {
+		problem.Internal(w, r, err)
+		return
+	}
+
+	update := struct {
+		DisplayName string `json:"display_name" validate:"max=100"`
+		Email       string `json:"email" validate:"required,email,max=255"`
+	}{DisplayName: user.DisplayName, Email: user.Email}
+	if req.DisplayName != nil {
+		update.DisplayName = strings.TrimSpace(*req.DisplayName)
+	}
+	if req.Email != nil {
+		update.Email = *req.Email
+	}
+	if errs := validate.Struct(update); len(errs) > 0 {
+		problem.Validation(w, r, errs)
+		return
+	}
+
+	if update.DisplayName != user.DisplayName {
+		if err := h.DB.UpdateDisplayName(r.Context(), username, update.DisplayName); err != nil {
+			problem.Internal(w, r, err)
+			return
+		}
+		user.DisplayName = update.DisplayName
+	}
+	if update.Email != user.Email {
+		taken, err := h.DB.EmailInUse(r.Context(), update.Email, user.Username)
+		if err != nil {
+			problem.Internal(w, r, err)
+			return
+		}
+		if taken {
+			problem.Write(w, r, http.StatusConflict, problem.CodeEmailExists, "Another account uses this email address.")
+			return
+		}
+		if err := h.requestEmailChange(r, user.Username, update.Email); err != nil {
+			problem.Internal(w, r, err)
+			return
+		}
+		user.PendingEmail = update.Email
+	}
+	json.NewEncoder(w).Encode(user)
+}
+
+// requestEmailChange stores email as pending and mails it a verification code.
+func (h *AuthHandler) requestEmailChange(r *http.Request, username, email string) error {
+	token, hash, err := newToken()
+	if err != nil {
+		return err
+	}
+	if err := h.DB.SetPendingEmail(r.Context(), username, email, hash, time.Now().Add(emailTokenTTL)); err != nil {
+		return err
+	}
+	return h.Mailer.Send(r.Context(), mail.Message{
+		To:      email,
+		Subject: "Confirm your new email address",
+		Body: fmt.Sprintf("Hello %s,\n\nUse this code to confirm your new email address:\n\n%s\n\nIt expires in %d hours. If you did not ask for this change, ignore this email.\n",
+			username, token, int(emailTokenTTL.Hours())),
+	})
+}
+
+// ConfirmEmailChangeHandler handles POST /me/email/verify, replacing the
+// email with the pending one when the code mailed to it is presented.
+func (h *AuthHandler) ConfirmEmailChangeHandler(w http.ResponseWriter, r *http.Request, username string) {
+	var req struct {
+		Token string `json:"token" validate:"required,max=128"`
+	}
+	if !validate.DecodeJSON(w, r, &req) {
+		return
+	}
+	ok, err := h.DB.ConfirmPendingEmail(r.Context(), username, hashToken(req.Token))
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+		problem.Write(w, r, http.StatusConflict, problem.CodeEmailExists, "Another account uses this email address.")
+		return
+	}
+	if err != nil {
+		problem.Internal(w, r, err)
+		return
+	}
+	if !ok {
+		problem.Write(w, r, http.StatusBadRequest, problem.CodeInvalidToken, "The verification code is invalid or has expired.")
+		return
+	}
+	h.GetProfileHandler(w, r, username)
+}
+
+// DeleteAccountHandler handles DELETE /me. The password must be sent again
+// so a stolen token alone cannot delete the account.
+func (h *AuthHandler) DeleteAccountHandler(w http.ResponseWriter, r *http.Request, username string) {
+	var req struct {
+		Password string `json:"password" validate:"required,max=128"`
+	}
+	if !validate.DecodeJSON(w, r, &req) {
+		return
+	}
+	user, err := h.DB.GetUserByUsername(r.Context(), username)
+	if errors.Is(err, sql.ErrNoRows) {
+		problem.Write(w, r, http.StatusNotFound, problem.CodeUserNotFound, "The account no longer exists.")
+		return
+	}
+	if err != nil {
+		problem.Internal(w, r, err)
+		return
+	}
+	ok, err := h.checkPassword(r, user, req.Password)
+	if err != nil {
+		problem.Internal(w, r, err)
+		return
+	}
+	if !ok {
+		h.record(r, username, "user.delete", username, audit.OutcomeFailure)
+		problem.Write(w, r, http.StatusForbidden, problem.CodeInvalidCredentials, "The password is incorrect.")
+		return
+	}
+	if _, err := h.DB.DeleteUser(r.Context(), username); err != nil {
+		problem.Internal(w, r, err)
+		return
+	}
+	h.record(r, username, "user.delete", username, audit.OutcomeSuccess)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// newToken returns a random URL-safe token and the hash to store in its place.
+func newToken() (token, hash string, err error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	token = base64.RawURLEncoding.EncodeToString(b)
+	return token, hashToken(token), nil
+}
+
+// hashToken returns the hex SHA-256 of token. Only hashes are stored so a
+// database leak does not reveal usable tokens.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,143 @@
+package handlers
+
+import (
+	"authentication/internal/mail"
+	"authentication/internal/password"
+	"authentication/internal/ratelimit"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"shared/audit"
+	"shared/problem"
+	"shared/validate"
+	"time"
+)
+
+// resetTokenTTL is how long a password reset code stays valid.
+const resetTokenTTL = time.Hour
+
+// RequestPasswordResetHandler handles POST /reset-password/request, mailing a
+// reset code to the verified email address of the account. It answers the
+// same way whether or not the account exists, so it cannot be used to
+// discover accounts.
+func (h *AuthHandler) RequestPasswordResetHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		problem.MethodNotAllowed(w, r)
+		return
+	}
+	var req struct {
+		Username string `json:"username" validate:"required,max=64"`
+	}
+	if !validate.DecodeJSON(w, r, &req) {
+		return
+	}
+	if !allow(w, r, h.Limits.RegisterPerIP, ratelimit.ClientIP(r, h.Limits.TrustProxy), "reset_password", "ip") ||
+		!allow(w, r, h.Limits.LoginPerUser, req.Username, "reset_password", "username") {
+		return
+	}
+	user, err := h.DB.GetUserByUsername(r.Context(), req.Username)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		problem.Internal(w, r, err)
+		return
+	}
+	// An unverified address may not belong to the account owner
+	if err == nil && user.EmailVerified {
+		token, hash, err := newToken()
+		if err != nil {
+			problem.Internal(w, r, err)
+			return
+		}
+		if err := h.DB.SetResetToken(r.Context(), user.Username, hash, time.Now().Add(resetTokenTTL)); err != nil {
+			problem.Internal(w, r, err)
+			return
+		}
+		err = h.Mailer.Send(r.Context(), mail.Message{
+			To:      user.Email,
+			Subject: "Reset your password",
+			Body: fmt.Sprintf("Hello %s,\n\nUse this code to reset your password:\n\n%s\n\nIt expires in %d minutes. If you did not ask to reset your password, ignore this email.\n",
+				user.Username, token, int(resetTokenTTL.Minutes())),
+		})
+		if err != nil {
+			problem.Internal(w, r, err)
+			return
+		}
+		h.record(r, "", "user.password.reset_request", user.Username, audit.OutcomeSuccess)
+	}
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{"message": "If the account exists and has a verified email address, a reset code has been sent."})
+}
+
+// ResetPasswordHandler handles POST /reset-password, setting a new password
+// with a code from RequestPasswordResetHandler. Locked accounts are refused
+// and accounts with MFA also need a current code or recovery code.
+func (h *AuthHandler) ResetPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		problem.MethodNotAllowed(w, r)
+		return
+	}
+	var req struct {
+		Token        string `json:"token" validate:"required,max=128"`
+		NewPassword  string `json:"new_password" validate:"required,min=8,max=128"`
+		Code         string `json:"code" validate:"max=6"`
+		RecoveryCode string `json:"recovery_code" validate:"max=32"`
+	}
+	if !validate.DecodeJSON(w, r, &req) {
+		return
+	}
+	if !allow(w, r, h.Limits.LoginPerIP, ratelimit.ClientIP(r, h.Limits.TrustProxy), "reset_password", "ip") {
+		return
+	}
+	tokenHash := hashToken(req.Token)
+	user, err := h.DB.GetUserByResetToken(r.Context(), tokenHash)
+	if errors.Is(err, sql.ErrNoRows) {
+		problem.Write(w, r, http.StatusBadRequest, problem.CodeInvalidToken, "The reset code is invalid or has expired.")
+		return
+	}
+	if err != nil {
+		problem.Internal(w, r, err)
+		return
+	}
+	if locked(w, r, user) {
+		h.record(r, "", "user.password.reset", user.Username, audit.OutcomeDenied)
+		return
+	}
+	if user.MFAEnabled {
+		if (req.Code == "") == (req.RecoveryCode == "") {
+			problem.Validation(w, r, []problem.FieldError{{Field: "code", Code: "required", Message: "exactly one of code and recovery_code is required"}})
+			return
+		}
+		ok, err := h.checkSecondFactor(r, user, req.Code, req.RecoveryCode)
+		if err != nil {
+			problem.Internal(w, r, err)
+			return
+		}
+		if !ok {
+			h.record(r, "", "user.password.reset", user.Username, audit.OutcomeFailure)
+			if err := h.recordFailedLogin(r, user.Username); err != nil {
+				problem.Internal(w, r, err)
+				return
+			}
+			problem.Write(w, r, http.StatusUnauthorized, problem.CodeInvalidMFACode, "The code is invalid.")
+			return
+		}
+	}
+	hash, err := password.Hash(req.NewPassword)
+	if err != nil {
+		problem.Internal(w, r, err)
+		return
+	}
+	ok, err := h.DB.ResetPassword(r.Context(), tokenHash, hash)
+	if err != nil {
+		problem.Internal(w, r, err)
+		return
+	}
+	// Another request used the code first
+	if !ok {
+		problem.Write(w, r, http.StatusBadRequest, problem.CodeInvalidToken, "The reset code is invalid or has expired.")
+		return
+	}
+	h.record(r, "", "user.password.reset", user.Username, audit.OutcomeSuccess)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Password reset successfully"})
+}
@@ -0,0 +1,91 @@
+package handlers
+
+import (
+	"authentication/internal/mail"
+	"authentication/internal/ratelimit"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"shared/problem"
+	"shared/validate"
+	"time"
+)
+
+// sendVerification mails a new code that verifies email as the address of username.
+func (h *AuthHandler) sendVerification(r *http.Request, username, email string) error {
+	token, hash, err := newToken()
+	if err != nil {
+		return err
+	}
+	if err := h.DB.SetEmailToken(r.Context(), username, hash, time.Now().Add(emailTokenTTL)); err != nil {
+		return err
+	}
+	return h.Mailer.Send(r.Context(), mail.Message{
+		To:      email,
+		Subject: "Verify your email address",
+		Body: fmt.Sprintf("Hello %s,\n\nUse this code to verify your email address:\n\n%s\n\nIt expires in %d hours. If you did not create an account, ignore this email.\n",
+			username, token, int(emailTokenTTL.Hours())),
+	})
+}
+
+// VerifyEmailHandler handles POST /verify-email, marking the email of the
+// account the code was sent to as verified.
+func (h *AuthHandler) VerifyEmailHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		problem.MethodNotAllowed(w, r)
+		return
+	}
+	var req struct {
+		Token string `json:"token" validate:"required,max=128"`
+	}
+	if !validate.DecodeJSON(w, r, &req) {
+		return
+	}
+	username, err := h.DB.VerifyEmail(r.Context(), hashToken(req.Token))
+	if err != nil {
+		problem.Internal(w, r, err)
+		return
+	}
+	if username == "" {
+		problem.Write(w, r, http.StatusBadRequest, problem.CodeInvalidToken, "The verification code is invalid or has expired.")
+		return
+	}
+	slog.InfoContext(r.Context(), "Email verified", "username", username)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Email verified successfully"})
+}
+
+// ResendVerificationHandler handles POST /verify-email/resend. It answers the
+// same way whether or not the user exists or is already verified, so it
+// cannot be used to discover accounts.
+func (h *AuthHandler) ResendVerificationHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		problem.MethodNotAllowed(w, r)
+		return
+	}
+	var req struct {
+		Username string `json:"username" validate:"required,max=64"`
+	}
+	if !validate.DecodeJSON(w, r, &req) {
+		return
+	}
+	if !allow(w, r, h.Limits.RegisterPerIP, ratelimit.ClientIP(r, h.Limits.TrustProxy), "resend_verification", "ip") ||
+		!allow(w, r, h.Limits.LoginPerUser, req.Username, "resend_verification", "username") {
+		return
+	}
+	user, err := h.DB.GetUserByUsername(r.Context(), req.Username)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		problem.Internal(w, r, err)
+		return
+	}
+	if err == nil && !user.EmailVerified {
+		if err := h.sendVerification(r, user.Username, user.Email); err != nil {
+			problem.Internal(w, r, err)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{"message": "If the account exists and is not verified, a new code has been sent."})
+}
@@ -0,0 +1,30 @@
+package mail
+
+import (
+	"context"
+	"os"
+	"time"
+)
+
+// FileMailer writes every message as an .eml file into Dir instead of
+// delivering it, for development and manual testing.
+type FileMailer struct {
+	Dir  string
+	From string
+}
+
+func (m FileMailer) Send(ctx context.Context, msg Message) error {
+	if err := os.MkdirAll(m.Dir, 0o700); err != nil {
+		return err
+	}
+	now := time.Now()
+	f, err := os.CreateTemp(m.Dir, now.UTC().Format("20060102T150405")+"-*.eml")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(format(m.From, msg, now)); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
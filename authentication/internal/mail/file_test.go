@@ -0,0 +1,57 @@
+package mail
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFileMailerSend(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "outbox")
+	m := FileMailer{Dir: dir, From: "shop@example.com"}
+	messages := []Message{
+		{To: "alice@example.com", Subject: "Verify your email", Body: "Your code is 123456.\nIt expires in 15 minutes."},
+		{To: "bob@example.com", Subject: "Reset your password", Body: "Your code is 654321."},
+	}
+	for _, msg := range messages {
+		if err := m.Send(context.Background(), msg); err != nil {
+			t.Fatalf("Send: %v", err)
+		}
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.eml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != len(messages) {
+		t.Fatalf("found %d .eml files, want %d", len(files), len(messages))
+	}
+	var all string
+	for _, name := range files {
+		info, err := os.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Messages carry verification codes, so only the owner may read them
+		if perm := info.Mode().Perm(); perm&0o077 != 0 {
+			t.Errorf("%s has mode %v", name, perm)
+		}
+		data, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		all += string(data)
+	}
+	for _, want := range []string{
+		"From: shop@example.com\r\n",
+		"To: alice@example.com\r\nSubject: Verify your email\r\n",
+		"\r\n\r\nYour code is 123456.\r\nIt expires in 15 minutes.",
+		"To: bob@example.com\r\nSubject: Reset your password\r\n",
+	} {
+		if !strings.Contains(all, want) {
+			t.Errorf("messages do not contain %q:\n%s", want, all)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+// Package mail sends account emails such as address verification codes.
+package mail
+
+import (
+	"authentication/internal/config"
+	"context"
+	"fmt"
+	"log/slog"
+)
+
+// Message is a plain text email.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers messages.
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// LogMailer writes messages to the log instead of delivering them. It is
+// meant for local development only, since the log then contains the codes.
+type LogMailer struct{}
+
+func (LogMailer) Send(ctx context.Context, msg Message) error {
+	slog.InfoContext(ctx, "Email not delivered, logging it instead", "to", msg.To, "subject", msg.Subject, "body", msg.Body)
+	return nil
+}
+
+// New returns the mailer selected by cfg.Mailer.
+func New(cfg config.Mail) (Mailer, error) {
+	switch cfg.Mailer {
+	case "log":
+		return LogMailer{}, nil
+	case "smtp":
+		return SMTPMailer{Addr: cfg.SMTPAddr, Username: cfg.SMTPUsername, Password: cfg.SMTPPassword, From: cfg.From}, nil
+	case "file":
+		return FileMailer{Dir: cfg.DropDir, From: cfg.From}, nil
+	}
+	return nil, fmt.Errorf("unknown mailer %q", cfg.Mailer)
+}
@@ -0,0 +1,160 @@
+package mail
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+// smtpSession is what a fakeSMTP server received in one session.
+type smtpSession struct {
+	auth string
+	from string
+	to   []string
+	data string
+}
+
+// fakeSMTP runs a minimal SMTP server for one session on a local port.
+// reply may override the response to a command, keyed by its verb.
+func fakeSMTP(t *testing.T, reply map[string]string) (addr string, session <-chan smtpSession) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	done := make(chan smtpSession, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		tp := textproto.NewConn(conn)
+		var s smtpSession
+		defer func() { done <- s }()
+		tp.PrintfLine("220 localhost ESMTP fake")
+		for {
+			line, err := tp.ReadLine()
+			if err != nil {
+				return
+			}
+			verb, arg, _ := strings.Cut(line, " ")
+			verb = strings.ToUpper(verb)
+			if r, ok := reply[verb]; ok {
+				tp.PrintfLine("%s", r)
+				continue
+			}
+			switch verb {
+			case "EHLO":
+				tp.PrintfLine("250-localhost")
+				tp.PrintfLine("250 AUTH PLAIN")
+			case "AUTH":
+				s.auth = strings.TrimPrefix(arg, "PLAIN ")
+				tp.PrintfLine("235 2.7.0 Authentication successful")
+			case "MAIL":
+				s.from = arg
+				tp.PrintfLine("250 OK")
+			case "RCPT":
+				s.to = append(s.to, arg)
+				tp.PrintfLine("250 OK")
+			case "DATA":
+				tp.PrintfLine("354 End data with <CR><LF>.<CR><LF>")
+				data, err := tp.ReadDotBytes()
+				if err != nil {
+					return
+				}
+				s.data = string(data)
+				tp.PrintfLine("250 OK")
+			case "QUIT":
+				tp.PrintfLine("221 Bye")
+				return
+			default:
+				tp.PrintfLine("502 Command not implemented")
+			}
+		}
+	}()
+	return l.Addr().String(), done
+}
+
+func TestSMTPMailerSend(t *testing.T) {
+	addr, session := fakeSMTP(t, nil)
+	m := SMTPMailer{Addr: addr, Username: "mailer", Password: "secret", From: "shop@example.com"}
+	msg := Message{To: "alice@example.com", Subject: "Verify your email", Body: "Your code is 123456.\nIt expires in 15 minutes."}
+	if err := m.Send(context.Background(), msg); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	s := <-session
+	auth, err := base64.StdEncoding.DecodeString(s.auth)
+	if err != nil || string(auth) != "\x00mailer\x00secret" {
+		t.Errorf("AUTH PLAIN = %q (%v), want the configured credentials", auth, err)
+	}
+	if s.from != "FROM:<shop@example.com>" && !strings.HasPrefix(s.from, "FROM:<shop@example.com> ") {
+		t.Errorf("MAIL %s", s.from)
+	}
+	if len(s.to) != 1 || s.to[0] != "TO:<alice@example.com>" {
+		t.Errorf("RCPT %v", s.to)
+	}
+	for _, want := range []string{
+		"From: shop@example.com\n",
+		"To: alice@example.com\n",
+		"Subject: Verify your email\n",
+		"Content-Type: text/plain; charset=utf-8\n",
+		"\n\nYour code is 123456.\nIt expires in 15 minutes.",
+	} {
+		if !strings.Contains(s.data, want) {
+			t.Errorf("message does not contain %q:\n%s", want, s.data)
+		}
+	}
+}
+
+func TestSMTPMailerSendWithoutAuth(t *testing.T) {
+	addr, session := fakeSMTP(t, nil)
+	m := SMTPMailer{Addr: addr, From: "shop@example.com"}
+	if err := m.Send(context.Background(), Message{To: "alice@example.com", Subject: "Hi", Body: "Hello"}); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if s := <-session; s.auth != "" || len(s.to) != 1 {
+		t.Errorf("session = %+v, want delivery without AUTH", s)
+	}
+}
+
+func TestSMTPMailerSendRejected(t *testing.T) {
+	addr, _ := fakeSMTP(t, map[string]string{"RCPT": "550 5.1.1 No such user"})
+	m := SMTPMailer{Addr: addr, From: "shop@example.com"}
+	err := m.Send(context.Background(), Message{To: "nobody@example.com", Subject: "Hi", Body: "Hello"})
+	var tpErr *textproto.Error
+	if !errors.As(err, &tpErr) || tpErr.Code != 550 {
+		t.Errorf("Send = %v, want the 550 rejection", err)
+	}
+}
+
+func TestSMTPMailerSendCancelled(t *testing.T) {
+	// A server that accepts the connection but never greets
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			defer conn.Close()
+			time.Sleep(2 * time.Second)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	m := SMTPMailer{Addr: l.Addr().String(), From: "shop@example.com"}
+	if err := m.Send(ctx, Message{To: "alice@example.com", Subject: "Hi", Body: "Hello"}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Send = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
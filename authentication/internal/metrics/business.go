@@ -0,0 +1,32 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	// LoginsSucceeded counts logins that issued a token.
+	LoginsSucceeded = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "auth_logins_succeeded_total",
+		Help: "Successful logins.",
+	})
+
+	// LoginsFailed counts logins rejected because of unknown users or wrong passwords.
+	LoginsFailed = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "auth_logins_failed_total",
+		Help: "Failed logins.",
+	})
+
+	// RateLimited counts login and registration attempts rejected by a rate limit.
+	RateLimited = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "auth_rate_limited_total",
+		Help: "Requests rejected by a rate limit, by endpoint and limit.",
+	}, []string{"endpoint", "limit"})
+
+	// AccountsLocked counts lockouts triggered by repeated failed logins.
+	AccountsLocked = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "auth_accounts_locked_total",
+		Help: "Accounts locked after repeated failed logins.",
+	})
+)
@@ -0,0 +1,31 @@
+package models
+
+import "time"
+
+// Client is an application registered with the authentication service:
+// either a service using the client-credentials grant, or an OpenID Connect
+// relying party with redirect URIs. SecretHash is never serialized.
+type Client struct {
+	ClientID     string   `json:"client_id"`
+	Name         string   `json:"name"`
+	SecretHash   string   `json:"-"`
+	Scopes       []string `json:"scopes"`
+	RedirectURIs []string `json:"redirect_uris,omitempty"`
+	// Public clients such as single-page apps have no secret and rely on PKCE alone.
+	Public    bool      `json:"public"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// AuthorizationCode is a pending OpenID Connect authorization code. Only
+// the hash of the code itself is stored.
+type AuthorizationCode struct {
+	CodeHash      string
+	ClientID      string
+	Username      string
+	RedirectURI   string
+	Scope         string
+	Nonce         string
+	CodeChallenge string
+	AuthTime      time.Time
+	ExpiresAt     time.Time
+}
@@ -2,11 +2,25 @@ package models
 
 import "time"
 
+// User is an account. Password is never serialized.
 type User struct {
-	ID        int       `json:"id"`
-	Username  string    `json:"username"`
-	Password  string    `json:"password"`
-	Email     string    `json:"email"`
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
+	ID       int    `json:"id"`
+	Username string `json:"username"`
+	Password string `json:"-"`
+	Email    string `json:"email"`
+	// EmailVerified is set once the user proves they receive mail at Email.
+	EmailVerified bool   `json:"email_verified"`
+	DisplayName   string `json:"display_name"`
+	// PendingEmail is the new address of an email change awaiting verification.
+	PendingEmail string    `json:"pending_email,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+	// FailedLogins counts failed logins since the last successful one.
+	FailedLogins int `json:"-"`
+	// LockedUntil is set while the account is locked out.
+	LockedUntil *time.Time `json:"-"`
+	// MFAEnabled is set once a TOTP enrolment is confirmed.
+	MFAEnabled bool `json:"mfa_enabled"`
+	// TOTPSecret is the shared TOTP secret, also set during enrolment.
+	TOTPSecret string `json:"-"`
 }
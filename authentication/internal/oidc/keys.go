@@ -0,0 +1,86 @@
+// Package oidc holds the key that signs ID tokens and publishes it as a JSON
+// Web Key Set, so relying parties can verify tokens without a shared secret.
+package oidc
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+)
+
+// Key is an RSA signing key with its key ID.
+type Key struct {
+	ID      string
+	Private *rsa.PrivateKey
+}
+
+// LoadKey reads a PEM encoded RSA private key (PKCS #1 or PKCS #8) from path.
+func LoadKey(path string) (*Key, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM block found", path)
+	}
+	var private *rsa.PrivateKey
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		private, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		var parsed interface{}
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err == nil {
+			var ok bool
+			if private, ok = parsed.(*rsa.PrivateKey); !ok {
+				err = errors.New("not an RSA key")
+			}
+		}
+	default:
+		err = fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return newKey(private), nil
+}
+
+// GenerateKey creates a new 2048-bit key. Tokens signed with it cannot be
+// verified after a restart, so it is only meant for local development.
+func GenerateKey() (*Key, error) {
+	private, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	return newKey(private), nil
+}
+
+// newKey derives the key ID from the public key so it stays stable across restarts.
+func newKey(private *rsa.PrivateKey) *Key {
+	der, _ := x509.MarshalPKIXPublicKey(&private.PublicKey)
+	sum := sha256.Sum256(der)
+	return &Key{ID: base64.RawURLEncoding.EncodeToString(sum[:12]), Private: private}
+}
+
+// JWKS returns the public half of the key as a JSON Web Key Set.
+func (k *Key) JWKS() map[string]interface{} {
+	public := k.Private.PublicKey
+	return map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"use": "sig",
+			"alg": "RS256",
+			"kid": k.ID,
+			"n":   base64.RawURLEncoding.EncodeToString(public.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes()),
+		}},
+	}
+}
@@ -0,0 +1,57 @@
+// Package password hashes user passwords with bcrypt and checks them.
+//
+// bcrypt only reads the first 72 bytes of its input, so passwords are
+// pre-hashed with SHA-256 and base64 encoded first: every character of a long
+// password counts, and the encoding keeps NUL bytes out of bcrypt's input.
+package password
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Cost is the bcrypt work factor for new hashes.
+const Cost = 12
+
+// Hash returns the hash of password to store.
+func Hash(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword(prehash(password), Cost)
+	return string(hash), err
+}
+
+// Check reports whether password matches stored. Passwords stored before
+// they were hashed are plaintext; they are compared in constant time and
+// needsRehash is set so the caller replaces them with a hash. needsRehash is
+// also set for hashes weaker than Cost.
+func Check(stored, password string) (ok, needsRehash bool) {
+	cost, err := bcrypt.Cost([]byte(stored))
+	if err != nil {
+		ok = subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1
+		return ok, ok
+	}
+	err = bcrypt.CompareHashAndPassword([]byte(stored), prehash(password))
+	if err != nil {
+		return false, false
+	}
+	return true, cost < Cost
+}
+
+var dummy = sync.OnceValue(func() []byte {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("dummy password"), Cost)
+	return hash
+})
+
+// CheckNone takes as long as a Check that fails, for users that do not exist,
+// so response times do not reveal which usernames are taken.
+func CheckNone(password string) {
+	bcrypt.CompareHashAndPassword(dummy(), prehash(password))
+}
+
+func prehash(password string) []byte {
+	sum := sha256.Sum256([]byte(password))
+	return []byte(base64.StdEncoding.EncodeToString(sum[:]))
+}
@@ -0,0 +1,89 @@
+// Package ratelimit keeps an in-memory token bucket per key, such as a
+// client IP or a username.
+package ratelimit
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// idleAfter is how long a key's bucket is kept after its last use.
+const idleAfter = 2 * time.Hour
+
+type bucket struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// Limiter allows each key n events per period, with bursts of up to n.
+type Limiter struct {
+	every rate.Limit
+	burst int
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+// New creates a Limiter allowing n events per period for every key and
+// starts dropping idle keys in the background.
+func New(n int, period time.Duration) *Limiter {
+	l := &Limiter{every: rate.Every(period / time.Duration(n)), burst: n, buckets: map[string]*bucket{}}
+	go l.cleanup()
+	return l
+}
+
+func (l *Limiter) cleanup() {
+	for range time.Tick(time.Minute) {
+		l.mu.Lock()
+		for key, b := range l.buckets {
+			if time.Since(b.lastSeen) > idleAfter {
+				delete(l.buckets, key)
+			}
+		}
+		l.mu.Unlock()
+	}
+}
+
+// Allow takes a token for key. When none is left it returns false and how
+// long until the next one is available.
+func (l *Limiter) Allow(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{limiter: rate.NewLimiter(l.every, l.burst)}
+		l.buckets[key] = b
+	}
+	b.lastSeen = time.Now()
+	l.mu.Unlock()
+
+	reservation := b.limiter.Reserve()
+	if delay := reservation.Delay(); delay > 0 {
+		reservation.Cancel()
+		return false, delay
+	}
+	return true, 0
+}
+
+// ClientIP returns the IP address a request came from. With trustProxy it
+// uses the last X-Forwarded-For entry, which the gateway appends, so clients
+// cannot pick their own address by sending the header themselves.
+func ClientIP(r *http.Request, trustProxy bool) string {
+	if trustProxy {
+		if forwarded := r.Header.Values("X-Forwarded-For"); len(forwarded) > 0 {
+			hops := strings.Split(forwarded[len(forwarded)-1], ",")
+			if ip := strings.TrimSpace(hops[len(hops)-1]); ip != "" {
+				return ip
+			}
+		}
+	}
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
+}
@@ -0,0 +1,83 @@
+package totp
+
+import (
+	"testing"
+	"time"
+)
+
+// rfcSecret is the SHA-1 key of the RFC 6238 test vectors, "12345678901234567890", base32 encoded.
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+// The SHA-1 vectors of RFC 6238 appendix B, cut to the last 6 of their 8 digits.
+var rfcVectors = []struct {
+	unix int64
+	code string
+}{
+	{59, "287082"},
+	{1111111109, "081804"},
+	{1111111111, "050471"},
+	{1234567890, "005924"},
+	{2000000000, "279037"},
+	{20000000000, "353130"},
+}
+
+func TestCode(t *testing.T) {
+	for _, v := range rfcVectors {
+		got, err := Code(rfcSecret, Step(time.Unix(v.unix, 0)))
+		if err != nil {
+			t.Fatalf("Code at %d: %v", v.unix, err)
+		}
+		if got != v.code {
+			t.Errorf("Code at %d = %s, want %s", v.unix, got, v.code)
+		}
+	}
+	if got, _ := Code("gezdgnbvgy3tqojqgezdgnbvgy3tqojq", Step(time.Unix(59, 0))); got != "287082" {
+		t.Errorf("Code with a lower-case secret = %s, want 287082", got)
+	}
+	if _, err := Code("not base32!", 1); err == nil {
+		t.Error("Code accepted a secret that is not base32")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, v := range rfcVectors {
+		now := time.Unix(v.unix, 0)
+		step, ok := Validate(rfcSecret, v.code, now)
+		if !ok || step != Step(now) {
+			t.Errorf("Validate(%s) at %d = %d, %v, want %d, true", v.code, v.unix, step, ok, Step(now))
+		}
+	}
+
+	// 1111111111 is step 37037037; its neighbours are within the accepted drift
+	now := time.Unix(1111111111, 0)
+	tests := []struct {
+		name     string
+		code     string
+		wantStep int64
+		wantOK   bool
+	}{
+		{"previous step", mustCode(t, 37037036), 37037036, true},
+		{"next step", mustCode(t, 37037038), 37037038, true},
+		{"two steps ago", mustCode(t, 37037035), 0, false},
+		{"two steps ahead", mustCode(t, 37037039), 0, false},
+		{"wrong code", "000000", 0, false},
+		{"too short", "50471", 0, false},
+		{"8 digit code", "14050471", 0, false},
+		{"empty", "", 0, false},
+	}
+	for _, tt := range tests {
+		step, ok := Validate(rfcSecret, tt.code, now)
+		if step != tt.wantStep || ok != tt.wantOK {
+			t.Errorf("%s: Validate(%q) = %d, %v, want %d, %v", tt.name, tt.code, step, ok, tt.wantStep, tt.wantOK)
+		}
+	}
+}
+
+func mustCode(t *testing.T, step int64) string {
+	t.Helper()
+	code, err := Code(rfcSecret, step)
+	if err != nil {
+		t.Fatalf("Code: %v", err)
+	}
+	return code
+}
@@ -0,0 +1,337 @@
+// Package config loads the service configuration from flags, environment
+// variables and an optional .env file, in that order of precedence, and
+// validates it at startup.
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/joho/godotenv"
+)
+
+const (
+	EnvLocal = "local"
+	EnvGCP   = "gcp"
+)
+
+// Config is the complete configuration of the API gateway.
+type Config struct {
+	DeployEnv        string
+	Port             int
+	JWTSecret        string
+	ServiceDiscovery string
+	LogLevel         string
+	TracesExporter   string
+
+	// Backends maps a service name to a fixed base URL, bypassing Consul.
+	Backends map[string]string
+	// CORSAllowedOrigins lists the browser origins allowed to call the API;
+	// "*" allows any origin.
+	CORSAllowedOrigins []string
+	RateLimitRPS       float64
+	RateLimitBurst     int
+	MaxBodyBytes       int64
+	MaxImportBodyBytes int64
+	UpstreamTimeout    time.Duration
+
+	// EnvFile is the .env file that was loaded, if any.
+	EnvFile string
+	// PrintConfig asks main to print the redacted configuration and exit.
+	PrintConfig bool
+}
+
+// setting binds one configuration value to its environment variable and flag.
+type setting struct {
+	env    string
+	flag   string
+	usage  string
+	def    string
+	secret bool
+	// required settings may not be set to blank values
+	required bool
+	set      func(string) error
+	get      func() string
+}
+
+func (c *Config) settings() []setting {
+	return []setting{
+		stringSetting("DEPLOY_ENV", "deploy-env", "deployment environment: local or gcp", EnvLocal, &c.DeployEnv),
+		{env: "PORT", flag: "port", usage: "HTTP listen port (default 8000, or 8080 on gcp)",
+			set: func(v string) error {
+				port, err := strconv.Atoi(v)
+				if err != nil {
+					return fmt.Errorf("PORT must be a number, got %q", v)
+				}
+				c.Port = port
+				return nil
+			},
+			get: func() string { return strconv.Itoa(c.Port) },
+		},
+		secretSetting("JWT_SECRET", "jwt-secret", "key used to verify JWTs", "", &c.JWTSecret),
+		stringSetting("SERVICE_DISCOVERY", "service-discovery", "Consul agent address", "localhost:8500", &c.ServiceDiscovery),
+		stringSetting("LOG_LEVEL", "log-level", "log level: debug, info, warn or error", "info", &c.LogLevel),
+		stringSetting("OTEL_TRACES_EXPORTER", "traces-exporter", "trace exporter: otlp, stdout or none", "otlp", &c.TracesExporter),
+		{env: "BACKEND_URLS", flag: "backend-urls", usage: "static backends as name=url pairs separated by commas, overriding Consul",
+			set: func(v string) error {
+				backends := map[string]string{}
+				for _, pair := range strings.Split(v, ",") {
+					name, target, ok := strings.Cut(strings.TrimSpace(pair), "=")
+					if !ok || name == "" {
+						return fmt.Errorf("BACKEND_URLS entries must look like name=url, got %q", pair)
+					}
+					backends[strings.TrimSpace(name)] = strings.TrimSpace(target)
+				}
+				c.Backends = backends
+				return nil
+			},
+			get: func() string {
+				pairs := make([]string, 0, len(c.Backends))
+				for name, target := range c.Backends {
+					pairs = append(pairs, name+"="+target)
+				}
+				sort.Strings(pairs)
+				return strings.Join(pairs, ",")
+			},
+		},
+		{env: "CORS_ALLOWED_ORIGINS", flag: "cors-allowed-origins", usage: "comma-separated browser origins allowed to call the API, or *", def: "http://localhost:3000",
+			set: func(v string) error {
+				c.CORSAllowedOrigins = nil
+				for _, origin := range strings.Split(v, ",") {
+					if origin = strings.TrimSpace(origin); origin != "" {
+						c.CORSAllowedOrigins = append(c.CORSAllowedOrigins, origin)
+					}
+				}
+				return nil
+			},
+			get: func() string { return strings.Join(c.CORSAllowedOrigins, ",") },
+		},
+		{env: "RATE_LIMIT_RPS", flag: "rate-limit-rps", usage: "sustained requests per second allowed per client", def: "20",
+			set: func(v string) error {
+				rps, err := strconv.ParseFloat(v, 64)
+				if err != nil {
+					return fmt.Errorf("RATE_LIMIT_RPS must be a number, got %q", v)
+				}
+				c.RateLimitRPS = rps
+				return nil
+			},
+			get: func() string { return strconv.FormatFloat(c.RateLimitRPS, 'f', -1, 64) },
+		},
+		intSetting("RATE_LIMIT_BURST", "rate-limit-burst", "requests a client may burst above the sustained rate", "40", &c.RateLimitBurst),
+		int64Setting("MAX_BODY_BYTES", "max-body-bytes", "largest request body accepted", "1048576", &c.MaxBodyBytes),
+		int64Setting("MAX_IMPORT_BODY_BYTES", "max-import-body-bytes", "largest body accepted by the product import", "67108864", &c.MaxImportBodyBytes),
+		{env: "UPSTREAM_TIMEOUT", flag: "upstream-timeout", usage: "how long to wait for a backend response", def: "30s",
+			set: func(v string) error {
+				d, err := time.ParseDuration(v)
+				if err != nil {
+					return fmt.Errorf("UPSTREAM_TIMEOUT must be a duration such as 30s, got %q", v)
+				}
+				c.UpstreamTimeout = d
+				return nil
+			},
+			get: func() string { return c.UpstreamTimeout.String() },
+		},
+	}
+}
+
+// Load builds the configuration from args (without the program name), the
+// environment and the .env file for the deployment environment, which is
+// .env.gcp on gcp and .env.local otherwise unless --env-file names another.
+// Variables already set in the environment win over the file.
+//
+// The returned Config is non-nil whenever the flags parsed, even if
+// validation failed, so --print-config can show what was loaded.
+func Load(service string, args []string) (*Config, error) {
+	c := &Config{}
+	settings := c.settings()
+
+	fs := flag.NewFlagSet(service, flag.ContinueOnError)
+	flagValues := make(map[string]*string, len(settings))
+	for _, s := range settings {
+		flagValues[s.flag] = fs.String(s.flag, "", s.usage+" (env "+s.env+")")
+	}
+	envFile := fs.String("env-file", "", "load variables from this .env file")
+	fs.BoolVar(&c.PrintConfig, "print-config", false, "print the configuration with secrets redacted and exit")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	explicit := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+
+	c.EnvFile = *envFile
+	if c.EnvFile == "" {
+		deployEnv := os.Getenv("DEPLOY_ENV")
+		if explicit["deploy-env"] {
+			deployEnv = *flagValues["deploy-env"]
+		}
+		c.EnvFile = ".env.local"
+		if deployEnv == EnvGCP {
+			c.EnvFile = ".env.gcp"
+		}
+	}
+	if err := godotenv.Load(c.EnvFile); err != nil {
+		// Only a file named with --env-file has to exist
+		if *envFile != "" || !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("loading %s: %w", c.EnvFile, err)
+		}
+		c.EnvFile = ""
+	}
+
+	var errs []error
+	for _, s := range settings {
+		value, ok := os.LookupEnv(s.env)
+		if explicit[s.flag] {
+			value, ok = *flagValues[s.flag], true
+		}
+		if !ok || value == "" {
+			value = s.def
+		}
+		if value == "" {
+			continue
+		}
+		if err := s.set(value); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if c.Port == 0 {
+		c.Port = 8000
+		if c.DeployEnv == EnvGCP {
+			c.Port = 8080
+		}
+	}
+	errs = append(errs, c.validate()...)
+	return c, errors.Join(errs...)
+}
+
+func (c *Config) validate() []error {
+	var errs []error
+	if c.DeployEnv != EnvLocal && c.DeployEnv != EnvGCP {
+		errs = append(errs, fmt.Errorf("DEPLOY_ENV must be %s or %s, got %q", EnvLocal, EnvGCP, c.DeployEnv))
+	}
+	if c.Port < 1 || c.Port > 65535 {
+		errs = append(errs, fmt.Errorf("PORT must be between 1 and 65535, got %d", c.Port))
+	}
+	for name, target := range c.Backends {
+		if u, err := url.Parse(target); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("BACKEND_URLS entry for %s must be an http(s) URL, got %q", name, target))
+		}
+	}
+	if len(c.CORSAllowedOrigins) == 0 {
+		errs = append(errs, errors.New("CORS_ALLOWED_ORIGINS must list at least one origin"))
+	}
+	if c.RateLimitRPS <= 0 || c.RateLimitBurst < 1 {
+		errs = append(errs, errors.New("RATE_LIMIT_RPS must be positive and RATE_LIMIT_BURST at least 1"))
+	}
+	if c.MaxBodyBytes < 1 || c.MaxImportBodyBytes < 1 {
+		errs = append(errs, errors.New("MAX_BODY_BYTES and MAX_IMPORT_BODY_BYTES must be positive"))
+	}
+	if c.UpstreamTimeout <= 0 {
+		errs = append(errs, errors.New("UPSTREAM_TIMEOUT must be positive"))
+	}
+	// Locally an empty secret is tolerated with a warning; anywhere else it would accept forged tokens
+	if c.JWTSecret == "" && c.DeployEnv != EnvLocal {
+		errs = append(errs, errors.New("JWT_SECRET is required outside the local environment"))
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.LogLevel)); err != nil {
+		errs = append(errs, fmt.Errorf("LOG_LEVEL must be debug, info, warn or error, got %q", c.LogLevel))
+	}
+	switch c.TracesExporter {
+	case "otlp", "stdout", "console", "none":
+	default:
+		errs = append(errs, fmt.Errorf("OTEL_TRACES_EXPORTER must be otlp, stdout or none, got %q", c.TracesExporter))
+	}
+	for _, s := range c.settings() {
+		if s.required && strings.TrimSpace(s.get()) == "" {
+			errs = append(errs, fmt.Errorf("%s must not be empty", s.env))
+		}
+	}
+	return errs
+}
+
+// Print writes the configuration as KEY=value lines with secrets redacted.
+func (c *Config) Print(w io.Writer) {
+	for _, s := range c.settings() {
+		value := s.get()
+		if s.secret {
+			value = redact(s.env, value)
+		}
+		fmt.Fprintf(w, "%s=%s\n", s.env, value)
+	}
+}
+
+// redact hides a secret value. URLs keep everything but their password so
+// the target host stays visible.
+func redact(name, value string) string {
+	if value == "" {
+		return ""
+	}
+	if strings.HasSuffix(name, "_URL") {
+		if u, err := url.Parse(value); err == nil && u.Scheme != "" {
+			return u.Redacted()
+		}
+	}
+	return "[redacted]"
+}
+
+func stringSetting(env, flagName, usage, def string, dst *string) setting {
+	return setting{
+		env:   env,
+		flag:  flagName,
+		usage: usage,
+		def:   def,
+		set:   func(v string) error { *dst = v; return nil },
+		get:   func() string { return *dst },
+	}
+}
+
+func secretSetting(env, flagName, usage, def string, dst *string) setting {
+	s := stringSetting(env, flagName, usage, def, dst)
+	s.secret = true
+	return s
+}
+
+func intSetting(env, flagName, usage, def string, dst *int) setting {
+	return setting{
+		env:   env,
+		flag:  flagName,
+		usage: usage,
+		def:   def,
+		set: func(v string) error {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return fmt.Errorf("%s must be a number, got %q", env, v)
+			}
+			*dst = n
+			return nil
+		},
+		get: func() string { return strconv.Itoa(*dst) },
+	}
+}
+
+func int64Setting(env, flagName, usage, def string, dst *int64) setting {
+	return setting{
+		env:   env,
+		flag:  flagName,
+		usage: usage,
+		def:   def,
+		set: func(v string) error {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return fmt.Errorf("%s must be a number, got %q", env, v)
+			}
+			*dst = n
+			return nil
+		},
+		get: func() string { return strconv.FormatInt(*dst, 10) },
+	}
+}
@@ -0,0 +1,61 @@
+package config
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// load runs Load with args in an empty directory and without any of the
+// gateway's variables in the environment.
+func load(t *testing.T, args ...string) (*Config, error) {
+	t.Helper()
+	t.Chdir(t.TempDir())
+	for _, s := range (&Config{}).settings() {
+		t.Setenv(s.env, "")
+	}
+	return Load("gateway", args)
+}
+
+func TestLoadFailsFastOutsideLocal(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		wantErr string
+	}{
+		{name: "local without secret", args: nil},
+		{name: "gcp without secret", args: []string{"--deploy-env=gcp"}, wantErr: "JWT_SECRET is required"},
+		{name: "gcp with secret", args: []string{"--deploy-env=gcp", "--jwt-secret=secret"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := load(t, tt.args...)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("Load: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Load error = %v, want one mentioning %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPrintRedactsSecrets(t *testing.T) {
+	c, err := load(t, "--jwt-secret=jwt-secret-value", "--backend-urls=products=http://products:8001")
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	var out bytes.Buffer
+	c.Print(&out)
+	if strings.Contains(out.String(), "jwt-secret-value") {
+		t.Errorf("printed configuration contains the JWT secret:\n%s", out.String())
+	}
+	for _, want := range []string{"JWT_SECRET=[redacted]\n", "BACKEND_URLS=products=http://products:8001\n"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("printed configuration does not contain %q:\n%s", want, out.String())
+		}
+	}
+}
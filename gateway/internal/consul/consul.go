@@ -0,0 +1,45 @@
+package consul
+
+import (
+	"fmt"
+	"log/slog"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+// RegisterWithConsul registers the service with the Consul agent at consulAddr.
+// Outside gcp the registration includes an HTTP check against /readyz.
+func RegisterWithConsul(consulAddr string, gcp bool, serviceName string, servicePort int) {
+	config := consulapi.DefaultConfig()
+	config.Address = consulAddr
+	client, err := consulapi.NewClient(config)
+	if err != nil {
+		slog.Error("Consul client error", "error", err)
+		return
+	}
+	var registration *consulapi.AgentServiceRegistration
+	if gcp {
+		registration = &consulapi.AgentServiceRegistration{
+			Name:    serviceName,
+			Address: serviceName,
+			Port:    servicePort,
+		}
+	} else {
+		registration = &consulapi.AgentServiceRegistration{
+			Name:    serviceName,
+			Address: serviceName,
+			Port:    servicePort,
+			Check: &consulapi.AgentServiceCheck{
+				HTTP:     fmt.Sprintf("http://%s:%d/readyz", serviceName, servicePort),
+				Interval: "10s",
+				Timeout:  "3s",
+			},
+		}
+	}
+	err = client.Agent().ServiceRegister(registration)
+	if err != nil {
+		slog.Error("Consul registration failed", "service", serviceName, "error", err)
+	} else {
+		slog.Info("Registered with Consul", "service", serviceName)
+	}
+}
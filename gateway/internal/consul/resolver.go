@@ -0,0 +1,118 @@
+package consul
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+// ErrNoInstances is returned when a service has no healthy instance.
+var ErrNoInstances = errors.New("no healthy instances")
+
+// cacheTTL is how long a lookup of healthy instances is reused.
+const cacheTTL = 5 * time.Second
+
+type instances struct {
+	urls    []*url.URL
+	fetched time.Time
+}
+
+// Resolver finds healthy instances of a service in Consul and spreads calls
+// across them round-robin. Services listed in the static map are never
+// looked up and always resolve to their fixed URL.
+type Resolver struct {
+	client *consulapi.Client
+	static map[string]*url.URL
+	next   atomic.Uint64
+
+	mu    sync.Mutex
+	cache map[string]instances
+}
+
+// NewResolver creates a Resolver for the Consul agent at consulAddr. static
+// maps service names to base URLs that bypass Consul.
+func NewResolver(consulAddr string, static map[string]string) (*Resolver, error) {
+	config := consulapi.DefaultConfig()
+	config.Address = consulAddr
+	client, err := consulapi.NewClient(config)
+	if err != nil {
+		return nil, err
+	}
+	r := &Resolver{client: client, static: map[string]*url.URL{}, cache: map[string]instances{}}
+	for name, target := range static {
+		u, err := url.Parse(target)
+		if err != nil {
+			return nil, fmt.Errorf("backend %s: %w", name, err)
+		}
+		r.static[name] = u
+	}
+	return r, nil
+}
+
+// Resolve returns the base URL of one healthy instance of service.
+func (r *Resolver) Resolve(ctx context.Context, service string) (*url.URL, error) {
+	if u, ok := r.static[service]; ok {
+		return u, nil
+	}
+	urls, err := r.lookup(ctx, service)
+	if err != nil {
+		return nil, err
+	}
+	return urls[r.next.Add(1)%uint64(len(urls))], nil
+}
+
+func (r *Resolver) lookup(ctx context.Context, service string) ([]*url.URL, error) {
+	r.mu.Lock()
+	cached, ok := r.cache[service]
+	r.mu.Unlock()
+	if ok && time.Since(cached.fetched) < cacheTTL {
+		return cached.urls, nil
+	}
+
+	entries, _, err := r.client.Health().Service(service, "", true, (&consulapi.QueryOptions{}).WithContext(ctx))
+	if err != nil {
+		// A stale answer beats failing every request while Consul is briefly unreachable
+		if ok {
+			return cached.urls, nil
+		}
+		return nil, fmt.Errorf("resolving %s: %w", service, err)
+	}
+	urls := make([]*url.URL, 0, len(entries))
+	for _, e := range entries {
+		address := e.Service.Address
+		if address == "" {
+			address = e.Node.Address
+		}
+		urls = append(urls, &url.URL{Scheme: "http", Host: fmt.Sprintf("%s:%d", address, e.Service.Port)})
+	}
+	if len(urls) == 0 {
+		return nil, fmt.Errorf("resolving %s: %w", service, ErrNoInstances)
+	}
+
+	r.mu.Lock()
+	r.cache[service] = instances{urls: urls, fetched: time.Now()}
+	r.mu.Unlock()
+	return urls, nil
+}
+
+// Ping reports whether the Consul agent answers.
+func (r *Resolver) Ping(ctx context.Context) error {
+	_, err := r.client.Status().LeaderWithQueryOptions((&consulapi.QueryOptions{}).WithContext(ctx))
+	return err
+}
+
+// Static reports whether every one of services has a fixed URL, so Consul is not needed.
+func (r *Resolver) Static(services ...string) bool {
+	for _, s := range services {
+		if _, ok := r.static[s]; !ok {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,34 @@
+package metrics
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	upstreamRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gateway_upstream_requests_total",
+		Help: "Requests proxied to backend services, by service and status code (0 when no response was received).",
+	}, []string{"service", "status"})
+
+	upstreamDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "gateway_upstream_duration_seconds",
+		Help:    "Latency of proxied requests, by service.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"service"})
+
+	// RateLimited counts requests rejected by the per-client rate limit.
+	RateLimited = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "gateway_rate_limited_total",
+		Help: "Requests rejected by the rate limiter.",
+	})
+)
+
+// ObserveUpstream records one proxied request to service that started at start.
+func ObserveUpstream(service string, status int, start time.Time) {
+	upstreamRequests.WithLabelValues(service, strconv.Itoa(status)).Inc()
+	upstreamDuration.WithLabelValues(service).Observe(time.Since(start).Seconds())
+}
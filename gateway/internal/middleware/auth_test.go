@@ -0,0 +1,77 @@
+package middleware
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const testSecret = "test-secret"
+
+func sign(t *testing.T, method jwt.SigningMethod, key interface{}, claims jwt.MapClaims) string {
+	t.Helper()
+	s, err := jwt.NewWithClaims(method, claims).SignedString(key)
+	if err != nil {
+		t.Fatalf("signing %s token: %v", method.Alg(), err)
+	}
+	return s
+}
+
+func TestAuthenticate(t *testing.T) {
+	SetJWTSecret(testSecret)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	exp := time.Now().Add(time.Hour).Unix()
+	user := jwt.MapClaims{"username": "alice", "exp": exp}
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		token  string
+		want   int
+	}{
+		{name: "public endpoint without token", path: "/api/auth/login", want: http.StatusOK},
+		{name: "public discovery document", path: "/api/auth/.well-known/openid-configuration", want: http.StatusOK},
+		{name: "path outside /api", path: "/health", want: http.StatusOK},
+		{name: "CORS preflight", method: http.MethodOptions, path: "/api/orders", want: http.StatusOK},
+		{name: "protected endpoint without token", path: "/api/orders", want: http.StatusUnauthorized},
+		{name: "path below a public endpoint", path: "/api/auth/login/admin", want: http.StatusUnauthorized},
+		{name: "user token", path: "/api/orders", token: sign(t, jwt.SigningMethodHS256, []byte(testSecret), user), want: http.StatusOK},
+		{name: "service client token", path: "/api/products", token: sign(t, jwt.SigningMethodHS256, []byte(testSecret), jwt.MapClaims{"client_id": "orders", "exp": exp}), want: http.StatusOK},
+		{name: "wrong secret", path: "/api/orders", token: sign(t, jwt.SigningMethodHS256, []byte("other-secret"), user), want: http.StatusUnauthorized},
+		{name: "expired", path: "/api/orders", token: sign(t, jwt.SigningMethodHS256, []byte(testSecret), jwt.MapClaims{"username": "alice", "exp": time.Now().Add(-time.Minute).Unix()}), want: http.StatusUnauthorized},
+		{name: "HS384 with the shared secret", path: "/api/orders", token: sign(t, jwt.SigningMethodHS384, []byte(testSecret), user), want: http.StatusUnauthorized},
+		{name: "HS512 with the shared secret", path: "/api/orders", token: sign(t, jwt.SigningMethodHS512, []byte(testSecret), user), want: http.StatusUnauthorized},
+		{name: "RS256", path: "/api/orders", token: sign(t, jwt.SigningMethodRS256, rsaKey, user), want: http.StatusUnauthorized},
+		{name: "unsigned", path: "/api/orders", token: sign(t, jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, user), want: http.StatusUnauthorized},
+		{name: "no username or client", path: "/api/orders", token: sign(t, jwt.SigningMethodHS256, []byte(testSecret), jwt.MapClaims{"exp": exp}), want: http.StatusUnauthorized},
+		{name: "OpenID Connect token on userinfo", path: userInfoPath, token: sign(t, jwt.SigningMethodHS256, []byte(testSecret), jwt.MapClaims{"sub": "1", "aud": "app", "exp": exp}), want: http.StatusOK},
+		{name: "OpenID Connect token elsewhere", path: "/api/orders", token: sign(t, jwt.SigningMethodHS256, []byte(testSecret), jwt.MapClaims{"username": "alice", "aud": "app", "exp": exp}), want: http.StatusUnauthorized},
+	}
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) })
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			method := tt.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			r := httptest.NewRequest(method, tt.path, nil)
+			if tt.token != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			w := httptest.NewRecorder()
+			Authenticate(next).ServeHTTP(w, r)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+		})
+	}
+}
@@ -0,0 +1,31 @@
+package middleware
+
+import (
+	"net/http"
+	"shared/problem"
+)
+
+// importPath accepts bulk uploads and gets its own, larger body limit.
+const importPath = "/api/products/import"
+
+// LimitBody caps request bodies at max bytes, or importMax for the product
+// import. Requests declaring a larger Content-Length are rejected before
+// anything is forwarded; others are cut off once they exceed the limit.
+func LimitBody(max, importMax int64) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			limit := max
+			if r.URL.Path == importPath {
+				limit = importMax
+			}
+			if r.ContentLength > limit {
+				problem.Write(w, r, http.StatusRequestEntityTooLarge, problem.CodePayloadTooLarge, "The request body is too large.")
+				return
+			}
+			if r.Body != nil && r.Body != http.NoBody {
+				r.Body = http.MaxBytesReader(w, r.Body, limit)
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
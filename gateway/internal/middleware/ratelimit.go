@@ -0,0 +1,81 @@
+package middleware
+
+import (
+	"gateway/internal/metrics"
+	"math"
+	"net"
+	"net/http"
+	"shared/problem"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// limiterIdle is how long a client's bucket is kept after its last request.
+const limiterIdle = 10 * time.Minute
+
+type client struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// RateLimiter gives every client IP a token bucket refilled at rps up to burst.
+type RateLimiter struct {
+	rps   rate.Limit
+	burst int
+
+	mu      sync.Mutex
+	clients map[string]*client
+}
+
+// NewRateLimiter creates a RateLimiter and starts dropping idle clients in the background.
+func NewRateLimiter(rps float64, burst int) *RateLimiter {
+	rl := &RateLimiter{rps: rate.Limit(rps), burst: burst, clients: map[string]*client{}}
+	go rl.cleanup()
+	return rl
+}
+
+func (rl *RateLimiter) cleanup() {
+	for range time.Tick(time.Minute) {
+		rl.mu.Lock()
+		for ip, c := range rl.clients {
+			if time.Since(c.lastSeen) > limiterIdle {
+				delete(rl.clients, ip)
+			}
+		}
+		rl.mu.Unlock()
+	}
+}
+
+func (rl *RateLimiter) limiter(ip string) *rate.Limiter {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	c, ok := rl.clients[ip]
+	if !ok {
+		c = &client{limiter: rate.NewLimiter(rl.rps, rl.burst)}
+		rl.clients[ip] = c
+	}
+	c.lastSeen = time.Now()
+	return c.limiter
+}
+
+// Middleware rejects requests over the client's limit with 429 and a Retry-After header.
+func (rl *RateLimiter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			ip = r.RemoteAddr
+		}
+		reservation := rl.limiter(ip).Reserve()
+		if delay := reservation.Delay(); delay > 0 {
+			reservation.Cancel()
+			metrics.RateLimited.Inc()
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+			problem.Write(w, r, http.StatusTooManyRequests, problem.CodeRateLimited, "Too many requests, slow down.")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
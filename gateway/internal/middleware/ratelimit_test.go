@@ -0,0 +1,42 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRateLimiterKeysOnPeerAddress(t *testing.T) {
+	// One request per client, refilled far slower than the test runs
+	rl := NewRateLimiter(0.001, 1)
+	handler := rl.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) }))
+
+	tests := []struct {
+		name          string
+		remoteAddr    string
+		forwardedFor  string
+		want          int
+		wantRetryHint bool
+	}{
+		{name: "first request", remoteAddr: "198.51.100.1:40000", forwardedFor: "203.0.113.1", want: http.StatusOK},
+		{name: "same client, new port and forged X-Forwarded-For", remoteAddr: "198.51.100.1:40001", forwardedFor: "203.0.113.2", want: http.StatusTooManyRequests, wantRetryHint: true},
+		{name: "same client without X-Forwarded-For", remoteAddr: "198.51.100.1:40002", want: http.StatusTooManyRequests, wantRetryHint: true},
+		{name: "another client claiming the first one's address", remoteAddr: "198.51.100.2:40000", forwardedFor: "198.51.100.1", want: http.StatusOK},
+		{name: "IPv6 client", remoteAddr: "[2001:db8::1]:40000", want: http.StatusOK},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/api/products", nil)
+		r.RemoteAddr = tt.remoteAddr
+		if tt.forwardedFor != "" {
+			r.Header.Set("X-Forwarded-For", tt.forwardedFor)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != tt.want {
+			t.Errorf("%s: status = %d, want %d", tt.name, w.Code, tt.want)
+		}
+		if got := w.Header().Get("Retry-After") != ""; got != tt.wantRetryHint {
+			t.Errorf("%s: Retry-After = %q", tt.name, w.Header().Get("Retry-After"))
+		}
+	}
+}
@@ -0,0 +1,153 @@
+// Package proxy forwards /api requests to the backend service that owns them.
+package proxy
+
+import (
+	"context"
+	"errors"
+	"gateway/internal/consul"
+	"gateway/internal/metrics"
+	"log/slog"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"shared/problem"
+	"shared/requestid"
+	"strings"
+	"time"
+)
+
+// Route maps a public path prefix to a backend service. The prefix is
+// replaced by Path when forwarding, so /api/products/42 reaches the products
+// service as /products/42.
+type Route struct {
+	Prefix  string
+	Service string
+	Path    string
+}
+
+// Routes are the backends the gateway fronts.
+var Routes = []Route{
+	{Prefix: "/api/products", Service: "products", Path: "/products"},
+	{Prefix: "/api/orders", Service: "orders", Path: "/orders"},
+	{Prefix: "/api/payments", Service: "payment", Path: "/payments"},
+	{Prefix: "/api/auth", Service: "authentication", Path: ""},
+}
+
+// Services returns the distinct backend service names in Routes.
+func Services() []string {
+	var services []string
+	seen := map[string]bool{}
+	for _, route := range Routes {
+		if !seen[route.Service] {
+			seen[route.Service] = true
+			services = append(services, route.Service)
+		}
+	}
+	return services
+}
+
+type targetKey struct{}
+
+type target struct {
+	base    *url.URL
+	path    string
+	service string
+	start   time.Time
+}
+
+// Proxy is an http.Handler that resolves the backend for each request and
+// forwards it there.
+type Proxy struct {
+	resolver *consul.Resolver
+	timeout  time.Duration
+	rp       *httputil.ReverseProxy
+}
+
+// New creates a Proxy that resolves backends with resolver, sends requests
+// through transport and gives each backend timeout to respond.
+func New(resolver *consul.Resolver, transport http.RoundTripper, timeout time.Duration) *Proxy {
+	p := &Proxy{resolver: resolver, timeout: timeout}
+	p.rp = &httputil.ReverseProxy{
+		Rewrite:        p.rewrite,
+		Transport:      transport,
+		ModifyResponse: p.modifyResponse,
+		ErrorHandler:   p.errorHandler,
+	}
+	return p
+}
+
+// Match returns the route serving path, if any.
+func Match(path string) (Route, bool) {
+	for _, route := range Routes {
+		if path == route.Prefix || strings.HasPrefix(path, route.Prefix+"/") {
+			return route, true
+		}
+	}
+	return Route{}, false
+}
+
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	route, ok := Match(r.URL.Path)
+	if !ok {
+		problem.Write(w, r, http.StatusNotFound, problem.CodeNotFound, "No service handles "+r.URL.Path+".")
+		return
+	}
+	base, err := p.resolver.Resolve(r.Context(), route.Service)
+	if err != nil {
+		slog.WarnContext(r.Context(), "Backend unavailable", "service", route.Service, "error", err)
+		metrics.ObserveUpstream(route.Service, 0, time.Now())
+		problem.Write(w, r, http.StatusServiceUnavailable, problem.CodeServiceUnavailable, "The "+route.Service+" service is unavailable.")
+		return
+	}
+	path := route.Path + strings.TrimPrefix(r.URL.Path, route.Prefix)
+	if path == "" {
+		path = "/"
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), p.timeout)
+	defer cancel()
+	ctx = context.WithValue(ctx, targetKey{}, target{base: base, path: path, service: route.Service, start: time.Now()})
+	p.rp.ServeHTTP(w, r.WithContext(ctx))
+}
+
+func (p *Proxy) rewrite(pr *httputil.ProxyRequest) {
+	t := pr.In.Context().Value(targetKey{}).(target)
+	pr.SetURL(t.base)
+	pr.Out.URL.Path = strings.TrimSuffix(t.base.Path, "/") + t.path
+	pr.Out.URL.RawPath = ""
+	pr.Out.Host = ""
+	pr.SetXForwarded()
+	pr.Out.Header.Set(requestid.Header, requestid.FromContext(pr.In.Context()))
+}
+
+func (p *Proxy) modifyResponse(resp *http.Response) error {
+	t := resp.Request.Context().Value(targetKey{}).(target)
+	metrics.ObserveUpstream(t.service, resp.StatusCode, t.start)
+	// The gateway sets its own request ID and CORS headers; drop the backend's copies
+	resp.Header.Del(requestid.Header)
+	for name := range resp.Header {
+		if strings.HasPrefix(name, "Access-Control-") {
+			resp.Header.Del(name)
+		}
+	}
+	return nil
+}
+
+func (p *Proxy) errorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	t := r.Context().Value(targetKey{}).(target)
+	metrics.ObserveUpstream(t.service, 0, t.start)
+
+	var maxBytesErr *http.MaxBytesError
+	switch {
+	case errors.As(err, &maxBytesErr):
+		problem.Write(w, r, http.StatusRequestEntityTooLarge, problem.CodePayloadTooLarge, "The request body is too large.")
+	case errors.Is(err, context.DeadlineExceeded):
+		slog.WarnContext(r.Context(), "Backend timed out", "service", t.service, "error", err)
+		problem.Write(w, r, http.StatusGatewayTimeout, problem.CodeGatewayTimeout, "The "+t.service+" service did not respond in time.")
+	case errors.Is(err, context.Canceled):
+		// The client went away; nobody is left to read a response
+	default:
+		slog.ErrorContext(r.Context(), "Proxy error", "service", t.service, "error", err)
+		problem.Write(w, r, http.StatusBadGateway, problem.CodeBadGateway, "The "+t.service+" service could not be reached.")
+	}
+}
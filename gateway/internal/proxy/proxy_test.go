@@ -0,0 +1,67 @@
+package proxy
+
+import (
+	"gateway/internal/consul"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestProxyRewritesForwardedHeaders(t *testing.T) {
+	var got *http.Request
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		w.Header().Set("X-Request-Id", "backend-id")
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	defer backend.Close()
+	resolver, err := consul.NewResolver("127.0.0.1:0", map[string]string{"products": backend.URL})
+	if err != nil {
+		t.Fatalf("NewResolver: %v", err)
+	}
+	p := New(resolver, http.DefaultTransport, 5*time.Second)
+
+	r := httptest.NewRequest(http.MethodGet, "http://gateway.example/api/products/42?fields=name", nil)
+	r.RemoteAddr = "203.0.113.7:51000"
+	// A client cannot choose the address backends see
+	r.Header.Set("X-Forwarded-For", "10.0.0.1")
+	r.Header.Set("X-Forwarded-Host", "evil.example")
+	r.Header.Set("Forwarded", "for=10.0.0.1")
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, r)
+
+	if w.Code != http.StatusTeapot {
+		t.Fatalf("status = %d, want the backend's %d: %s", w.Code, http.StatusTeapot, w.Body)
+	}
+	if got.URL.Path != "/products/42" || got.URL.RawQuery != "fields=name" {
+		t.Errorf("backend got %s, want /products/42?fields=name", got.URL)
+	}
+	wantHeaders := map[string]string{
+		"X-Forwarded-For":   "203.0.113.7",
+		"X-Forwarded-Host":  "gateway.example",
+		"X-Forwarded-Proto": "http",
+		"Forwarded":         "",
+	}
+	for name, want := range wantHeaders {
+		if values := got.Header.Values(name); len(values) > 1 || got.Header.Get(name) != want {
+			t.Errorf("backend got %s %q, want %q", name, values, want)
+		}
+	}
+	if w.Header().Get("X-Request-Id") != "" || w.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("backend headers leaked into the response: %v", w.Header())
+	}
+}
+
+func TestProxyUnknownPath(t *testing.T) {
+	resolver, err := consul.NewResolver("127.0.0.1:0", nil)
+	if err != nil {
+		t.Fatalf("NewResolver: %v", err)
+	}
+	w := httptest.NewRecorder()
+	New(resolver, http.DefaultTransport, time.Second).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/productsextra", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"gateway/internal/config"
+	"gateway/internal/consul"
+	"gateway/internal/middleware"
+	"gateway/internal/proxy"
+	"log/slog"
+	"net/http"
+	"os"
+	"shared/health"
+	"shared/logging"
+	"shared/metrics"
+	"shared/requestid"
+	"shared/tracing"
+	"strconv"
+)
+
+func main() {
+	cfg, err := config.Load("gateway", os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if cfg != nil && cfg.PrintConfig {
+		cfg.Print(os.Stdout)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "gateway: invalid configuration:\n%v\n", err)
+		os.Exit(2)
+	}
+	if cfg.PrintConfig {
+		return
+	}
+
+	logging.Setup("gateway", cfg.LogLevel)
+	if cfg.EnvFile != "" {
+		slog.Info("Loaded environment file", "file", cfg.EnvFile)
+	}
+	if cfg.JWTSecret == "" {
+		slog.Warn("JWT_SECRET is empty, tokens are not protected; this is only allowed locally")
+	}
+	middleware.SetJWTSecret(cfg.JWTSecret)
+	shutdownTracing, err := tracing.Setup(context.Background(), "gateway", cfg.TracesExporter)
+	if err != nil {
+		logging.Fatal("Failed to set up tracing", "error", err)
+	}
+	defer shutdownTracing(context.Background())
+
+	resolver, err := consul.NewResolver(cfg.ServiceDiscovery, cfg.Backends)
+	if err != nil {
+		logging.Fatal("Failed to create service resolver", "error", err)
+	}
+
+	// Consul registration
+	consul.RegisterWithConsul(cfg.ServiceDiscovery, cfg.DeployEnv == config.EnvGCP, "gateway", cfg.Port)
+
+	transport := tracing.Transport(http.DefaultTransport)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("Gateway is running"))
+	})
+	mux.Handle("/metrics", metrics.Handler())
+	checker := health.NewChecker()
+	if !resolver.Static(proxy.Services()...) {
+		checker.Add("consul", resolver.Ping)
+	}
+	mux.HandleFunc("/livez", checker.Live)
+	mux.HandleFunc("/readyz", checker.Ready)
+
+	// Aggregated readiness of every backend
+	backends := health.NewChecker()
+	client := &http.Client{Transport: transport}
+	for _, service := range proxy.Services() {
+		backends.Add(service, func(ctx context.Context) error {
+			return checkBackend(ctx, client, resolver, service)
+		})
+	}
+	mux.HandleFunc("GET /api/health", backends.Ready)
+
+	api := middleware.Authenticate(middleware.LimitBody(cfg.MaxBodyBytes, cfg.MaxImportBodyBytes)(proxy.New(resolver, transport, cfg.UpstreamTimeout)))
+	mux.Handle("/api/", api)
+
+	limiter := middleware.NewRateLimiter(cfg.RateLimitRPS, cfg.RateLimitBurst)
+	handler := middleware.CORS(cfg.CORSAllowedOrigins)(limiter.Middleware(mux))
+
+	slog.Info("Gateway running", "port", cfg.Port)
+	if err := http.ListenAndServe(":"+strconv.Itoa(cfg.Port), requestid.Middleware(tracing.Middleware(logging.Middleware(metrics.Middleware(handler))))); err != nil {
+		logging.Fatal("HTTP server stopped", "error", err)
+	}
+}
+
+// checkBackend asks one instance of service for its readiness.
+func checkBackend(ctx context.Context, client *http.Client, resolver *consul.Resolver, service string) error {
+	base, err := resolver.Resolve(ctx, service)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, base.JoinPath("/readyz").String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("readyz returned %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+// Command reconcile compares the orders and payment services through their
+// APIs and reports orders left unpaid, payments without an order and
+// payments whose amount differs from the order total. With --republish it
+// resends the events that were evidently lost so the services catch up.
+//
+// It exits with status 0 when everything matches, 1 when mismatches were
+// found and 2 when the comparison could not be made.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"orders/internal/config"
+	"orders/internal/pubsub"
+	"orders/internal/reconcile"
+	"os"
+	"os/signal"
+	"text/tabwriter"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+func main() {
+	os.Exit(run(os.Args[1:]))
+}
+
+func run(args []string) int {
+	fs := flag.NewFlagSet("reconcile", flag.ContinueOnError)
+	ordersURL := fs.String("orders-url", env("ORDERS_SERVICE_URL", "http://localhost:8002"), "base URL of the orders service (env ORDERS_SERVICE_URL)")
+	paymentsURL := fs.String("payments-url", env("PAYMENT_SERVICE_URL", "http://localhost:8003"), "base URL of the payment service (env PAYMENT_SERVICE_URL)")
+	tokenURL := fs.String("oauth-token-url", env("OAUTH_TOKEN_URL", "http://localhost:8004/oauth/token"), "token endpoint of the authentication service (env OAUTH_TOKEN_URL)")
+	clientID := fs.String("oauth-client-id", env("OAUTH_CLIENT_ID", ""), "client ID with the orders and payments scopes (env OAUTH_CLIENT_ID)")
+	clientSecret := fs.String("oauth-client-secret", env("OAUTH_CLIENT_SECRET", ""), "client secret (env OAUTH_CLIENT_SECRET)")
+	token := fs.String("token", env("RECONCILE_TOKEN", ""), "bearer token to use instead of client credentials (env RECONCILE_TOKEN)")
+	unpaidAfter := fs.Duration("unpaid-after", 30*time.Minute, "report orders still unpaid after this long")
+	includeDeleted := fs.Bool("include-deleted", false, "also compare soft-deleted orders and payments; needs an admin token")
+	republish := fs.Bool("republish", false, "resend the order events of unpaid orders and the payment events that never reached their order")
+	asJSON := fs.Bool("json", false, "print the mismatches as JSON")
+	var ps config.PubSub
+	fs.StringVar(&ps.ProjectID, "pubsub-project", env("PUBSUB_PROJECT_ID", "test-project"), "Pub/Sub project ID (env PUBSUB_PROJECT_ID)")
+	fs.StringVar(&ps.OrdersTopic, "orders-topic", env("PUBSUB_ORDERS_TOPIC", "orders"), "topic order events are published to (env PUBSUB_ORDERS_TOPIC)")
+	fs.StringVar(&ps.PaymentTopic, "payment-topic", env("PUBSUB_PAYMENT_TOPIC", "payment"), "topic payment events are published to (env PUBSUB_PAYMENT_TOPIC)")
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		return 2
+	}
+	if *unpaidAfter <= 0 {
+		fmt.Fprintln(os.Stderr, "reconcile: --unpaid-after must be positive")
+		return 2
+	}
+	var tokens oauth2.TokenSource
+	switch {
+	case *token != "":
+		tokens = oauth2.StaticTokenSource(&oauth2.Token{AccessToken: *token, TokenType: "Bearer"})
+	case *clientID != "":
+		tokens = reconcile.ServiceTokens(*tokenURL, *clientID, *clientSecret)
+	default:
+		fmt.Fprintln(os.Stderr, "reconcile: set --token or --oauth-client-id to authenticate")
+		return 2
+	}
+
+	// Logs go to stderr so stdout carries only the report
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(env("LOG_LEVEL", "info"))); err != nil {
+		level = slog.LevelInfo
+	}
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})))
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	client := reconcile.NewClient(*ordersURL, *paymentsURL, tokens)
+	client.IncludeDeleted = *includeDeleted
+	orders, err := client.Orders(ctx)
+	if err != nil {
+		slog.Error("Failed to list orders", "error", err)
+		return 2
+	}
+	payments, err := client.Payments(ctx)
+	if err != nil {
+		slog.Error("Failed to list payments", "error", err)
+		return 2
+	}
+	mismatches := reconcile.Compare(orders, payments, time.Now(), *unpaidAfter)
+	slog.Info("Compared orders and payments", "orders", len(orders), "payments", len(payments), "mismatches", len(mismatches))
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if mismatches == nil {
+			mismatches = []reconcile.Mismatch{}
+		}
+		enc.Encode(mismatches)
+	} else {
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "KIND\tORDER\tTRANSACTION\tDETAIL")
+		for _, m := range mismatches {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", m.Kind, m.OrderID, m.TransactionID, m.Detail)
+		}
+		tw.Flush()
+	}
+
+	if *republish && len(mismatches) > 0 {
+		if err := republishEvents(ctx, ps, mismatches); err != nil {
+			slog.Error("Failed to republish events", "error", err)
+			return 2
+		}
+	}
+	if len(mismatches) > 0 {
+		return 1
+	}
+	return 0
+}
+
+// republishEvents resends the order event of every unpaid order, so the
+// payment service charges it, and the latest payment event of every order
+// that never saw it. Other mismatches need a person to look at them.
+func republishEvents(ctx context.Context, cfg config.PubSub, mismatches []reconcile.Mismatch) error {
+	ps, err := pubsub.NewPublisher(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		ps.OrdersTopic.Stop()
+		ps.PaymentTopic.Stop()
+		ps.Client.Close()
+	}()
+
+	var errs []error
+	for _, m := range mismatches {
+		switch m.Kind {
+		case reconcile.KindUnpaidOrder:
+			err = pubsub.PublishOrder(ctx, ps, *m.Order)
+		case reconcile.KindMissingPaymentEvent:
+			err = pubsub.PublishPaymentEvent(ctx, ps, *m.Payment)
+		default:
+			continue
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s %s: %w", m.Kind, m.OrderID, err))
+			continue
+		}
+		slog.InfoContext(ctx, "Republished event", "kind", m.Kind, "order_id", m.OrderID, "transaction_id", m.TransactionID)
+	}
+	return errors.Join(errs...)
+}
+
+func env(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
@@ -1,9 +1,12 @@
 package db
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"orders/internal/models"
+	"shared/tracing"
+	"time"
 
 	"github.com/lib/pq"
 	_ "github.com/lib/pq"
@@ -14,7 +17,7 @@ type DB struct {
 }
 
 func NewDB(dbURL string) (*DB, error) {
-	conn, err := sql.Open("postgres", dbURL)
+	conn, err := tracing.OpenDB("postgres", dbURL)
 	if err != nil {
 		return nil, err
 	}
@@ -24,26 +27,70 @@ func NewDB(dbURL string) (*DB, error) {
 	return &DB{Conn: conn}, nil
 }
 
-func (db *DB) CreateOrder(order models.Order) error {
+// Ping checks that the database is reachable.
+func (db *DB) Ping(ctx context.Context) error {
+	return db.Conn.PingContext(ctx)
+}
+
+func (db *DB) CreateOrder(ctx context.Context, order models.Order) error {
 	productsJSON, err := json.Marshal(order.Products)
 	if err != nil {
 		return err
 	}
-	_, err = db.Conn.Exec("INSERT INTO orders (id, status, amount, products) VALUES ($1, $2, $3, $4)", order.ID, order.Status, order.Amount, productsJSON)
+	_, err = db.Conn.ExecContext(ctx,
+		"INSERT INTO orders (id, status, amount, currency, products, reservation_id, created_at) VALUES ($1, $2, $3, $4, $5, $6, $7)",
+		order.ID, order.Status, order.Amount.Amount, order.Amount.Currency, productsJSON, order.ReservationID, order.CreatedAt,
+	)
 	return err
 }
 
-func (db *DB) DeleteOrders(ids []string) (int64, error) {
-	query := "DELETE FROM orders WHERE id = ANY($1)"
-	res, err := db.Conn.Exec(query, pq.Array(ids))
+// DeleteOrders soft-deletes the orders with the given IDs, recording who
+// deleted them. Orders that are already deleted are left unchanged.
+func (db *DB) DeleteOrders(ctx context.Context, ids []string, deletedBy string) (int64, error) {
+	query := "UPDATE orders SET deleted_at = now(), deleted_by = $2 WHERE id = ANY($1) AND deleted_at IS NULL"
+	res, err := db.Conn.ExecContext(ctx, query, pq.Array(ids), deletedBy)
 	if err != nil {
 		return 0, err
 	}
 	return res.RowsAffected()
 }
 
-func (db *DB) GetAllOrders() ([]models.Order, error) {
-	rows, err := db.Conn.Query("SELECT id, status, amount, products FROM orders")
+// RestoreOrders undoes the soft deletion of the orders with the given IDs.
+func (db *DB) RestoreOrders(ctx context.Context, ids []string) (int64, error) {
+	query := "UPDATE orders SET deleted_at = NULL, deleted_by = '' WHERE id = ANY($1) AND deleted_at IS NOT NULL"
+	res, err := db.Conn.ExecContext(ctx, query, pq.Array(ids))
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// PurgeDeletedOrders permanently removes orders soft-deleted before the given
+// time and returns their IDs.
+func (db *DB) PurgeDeletedOrders(ctx context.Context, before time.Time) ([]string, error) {
+	rows, err := db.Conn.QueryContext(ctx, "DELETE FROM orders WHERE deleted_at < $1 RETURNING id", before)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// GetAllOrders lists the orders, including soft-deleted ones if includeDeleted is set.
+func (db *DB) GetAllOrders(ctx context.Context, includeDeleted bool) ([]models.Order, error) {
+	query := "SELECT id, status, amount, currency, products, reservation_id, created_at, deleted_at, deleted_by FROM orders"
+	if !includeDeleted {
+		query += " WHERE deleted_at IS NULL"
+	}
+	rows, err := db.Conn.QueryContext(ctx, query)
 	if err != nil {
 		return nil, err
 	}
@@ -52,7 +99,7 @@ func (db *DB) GetAllOrders() ([]models.Order, error) {
 	for rows.Next() {
 		var o models.Order
 		var productsJSON []byte
-		if err := rows.Scan(&o.ID, &o.Status, &o.Amount, &productsJSON); err == nil {
+		if err := rows.Scan(&o.ID, &o.Status, &o.Amount.Amount, &o.Amount.Currency, &productsJSON, &o.ReservationID, &o.CreatedAt, &o.DeletedAt, &o.DeletedBy); err == nil {
 			// Unmarshal products
 			_ = json.Unmarshal(productsJSON, &o.Products)
 			dbOrders = append(dbOrders, o)
@@ -61,11 +108,16 @@ func (db *DB) GetAllOrders() ([]models.Order, error) {
 	return dbOrders, nil
 }
 
-// GetOrderByID retrieves an order by its ID
-func (db *DB) GetOrderByID(id string) (*models.Order, error) {
+// GetOrderByID retrieves an order by its ID. Soft-deleted orders are only
+// returned if includeDeleted is set.
+func (db *DB) GetOrderByID(ctx context.Context, id string, includeDeleted bool) (*models.Order, error) {
 	var o models.Order
 	var productsJSON []byte
-	err := db.Conn.QueryRow("SELECT id, status, amount, products FROM orders WHERE id = $1", id).Scan(&o.ID, &o.Status, &o.Amount, &productsJSON)
+	query := "SELECT id, status, amount, currency, products, reservation_id, created_at, deleted_at, deleted_by FROM orders WHERE id = $1"
+	if !includeDeleted {
+		query += " AND deleted_at IS NULL"
+	}
+	err := db.Conn.QueryRowContext(ctx, query, id).Scan(&o.ID, &o.Status, &o.Amount.Amount, &o.Amount.Currency, &productsJSON, &o.ReservationID, &o.CreatedAt, &o.DeletedAt, &o.DeletedBy)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, nil // Order not found
@@ -79,9 +131,38 @@ func (db *DB) GetOrderByID(id string) (*models.Order, error) {
 	return &o, nil
 }
 
-func (db *DB) UpdateOrderStatus(orderID, status string) error {
-	_, err := db.Conn.Exec("UPDATE orders SET status = $1 WHERE id = $2", status, orderID)
-	return err
+// UpdateOrderStatus sets the status of an order. It returns false and
+// leaves the order unchanged if the order does not exist, is cancelled or is
+// deleted, so a late update cannot revive an order whose stock was released.
+func (db *DB) UpdateOrderStatus(ctx context.Context, orderID, status string) (bool, error) {
+	res, err := db.Conn.ExecContext(ctx, "UPDATE orders SET status = $1 WHERE id = $2 AND status <> 'cancelled' AND deleted_at IS NULL", status, orderID)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// CancelOrder marks an order as cancelled and returns it. It returns nil if
+// the order does not exist or is already cancelled, so of several concurrent
+// cancellations exactly one gets the order back.
+func (db *DB) CancelOrder(ctx context.Context, id string) (*models.Order, error) {
+	var o models.Order
+	var productsJSON []byte
+	err := db.Conn.QueryRowContext(ctx,
+		"UPDATE orders SET status = 'cancelled' WHERE id = $1 AND status <> 'cancelled' AND deleted_at IS NULL RETURNING id, status, amount, currency, products, reservation_id, created_at, deleted_at, deleted_by",
+		id,
+	).Scan(&o.ID, &o.Status, &o.Amount.Amount, &o.Amount.Currency, &productsJSON, &o.ReservationID, &o.CreatedAt, &o.DeletedAt, &o.DeletedBy)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil // Not found or already cancelled
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(productsJSON, &o.Products); err != nil {
+		return nil, err
+	}
+	return &o, nil
 }
 
 func (db *DB) EnsureOrdersTable() error {
@@ -92,5 +173,20 @@ func (db *DB) EnsureOrdersTable() error {
 		amount INT NOT NULL,
 		products JSONB NOT NULL
 	)`)
+	if err != nil {
+		return err
+	}
+	_, err = db.Conn.Exec(`
+	ALTER TABLE orders
+		ADD COLUMN IF NOT EXISTS reservation_id TEXT NOT NULL DEFAULT '',
+		ADD COLUMN IF NOT EXISTS currency CHAR(3) NOT NULL DEFAULT 'USD',
+		ADD COLUMN IF NOT EXISTS created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMPTZ,
+		ADD COLUMN IF NOT EXISTS deleted_by TEXT NOT NULL DEFAULT ''`)
+	if err != nil {
+		return err
+	}
+	// amount holds minor units of currency
+	_, err = db.Conn.Exec(`ALTER TABLE orders ALTER COLUMN amount TYPE BIGINT`)
 	return err
 }
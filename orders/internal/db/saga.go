@@ -0,0 +1,132 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"orders/internal/models"
+	"time"
+)
+
+// ErrSagaConflict is returned when a saga was changed by someone else since it was loaded.
+var ErrSagaConflict = errors.New("saga was modified concurrently")
+
+const sagaColumns = "id, order_id, reservation_id, status, steps, deadline, error, needs_refund, attempts, created_at, updated_at, version"
+
+// EnsureSagasTable creates the table holding checkout saga state.
+func (db *DB) EnsureSagasTable() error {
+	_, err := db.Conn.Exec(`
+	CREATE TABLE IF NOT EXISTS sagas (
+		id TEXT PRIMARY KEY,
+		order_id TEXT NOT NULL,
+		reservation_id TEXT NOT NULL DEFAULT '',
+		status TEXT NOT NULL,
+		steps JSONB NOT NULL DEFAULT '[]',
+		deadline TIMESTAMPTZ,
+		error TEXT NOT NULL DEFAULT '',
+		needs_refund BOOLEAN NOT NULL DEFAULT false,
+		attempts INT NOT NULL DEFAULT 0,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		version INT NOT NULL DEFAULT 0
+	)`)
+	if err != nil {
+		return err
+	}
+	_, err = db.Conn.Exec(`ALTER TABLE sagas ADD COLUMN IF NOT EXISTS needs_refund BOOLEAN NOT NULL DEFAULT false`)
+	if err != nil {
+		return err
+	}
+	_, err = db.Conn.Exec(`CREATE INDEX IF NOT EXISTS sagas_order_id_idx ON sagas (order_id)`)
+	if err != nil {
+		return err
+	}
+	_, err = db.Conn.Exec(`CREATE INDEX IF NOT EXISTS sagas_pending_idx ON sagas (deadline) WHERE status IN ('running', 'compensating')`)
+	return err
+}
+
+// CreateSaga stores a new saga.
+func (db *DB) CreateSaga(ctx context.Context, s *models.Saga) error {
+	steps, err := json.Marshal(s.Steps)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	s.CreatedAt, s.UpdatedAt, s.Version = now, now, 0
+	_, err = db.Conn.ExecContext(ctx,
+		"INSERT INTO sagas (id, order_id, reservation_id, status, steps, deadline, error, needs_refund, attempts, created_at, updated_at, version) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, 0)",
+		s.ID, s.OrderID, s.ReservationID, s.Status, steps, s.Deadline, s.Error, s.NeedsRefund, s.Attempts, s.CreatedAt, s.UpdatedAt,
+	)
+	return err
+}
+
+// UpdateSaga saves s if nobody changed it since it was loaded, and returns
+// ErrSagaConflict otherwise.
+func (db *DB) UpdateSaga(ctx context.Context, s *models.Saga) error {
+	steps, err := json.Marshal(s.Steps)
+	if err != nil {
+		return err
+	}
+	updatedAt := time.Now()
+	res, err := db.Conn.ExecContext(ctx,
+		"UPDATE sagas SET reservation_id = $1, status = $2, steps = $3, deadline = $4, error = $5, needs_refund = $6, attempts = $7, updated_at = $8, version = version + 1 WHERE id = $9 AND version = $10",
+		s.ReservationID, s.Status, steps, s.Deadline, s.Error, s.NeedsRefund, s.Attempts, updatedAt, s.ID, s.Version,
+	)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrSagaConflict
+	}
+	s.UpdatedAt = updatedAt
+	s.Version++
+	return nil
+}
+
+// GetSagaByOrderID retrieves the latest saga of an order, or nil if it has none.
+func (db *DB) GetSagaByOrderID(ctx context.Context, orderID string) (*models.Saga, error) {
+	s, err := scanSaga(db.Conn.QueryRowContext(ctx, "SELECT "+sagaColumns+" FROM sagas WHERE order_id = $1 ORDER BY created_at DESC LIMIT 1", orderID))
+	if err == sql.ErrNoRows {
+		return nil, nil // Saga not found
+	}
+	return s, err
+}
+
+// DueSagas lists up to limit sagas that need attention at now: running sagas
+// past their deadline and sagas whose compensation has to be retried.
+func (db *DB) DueSagas(ctx context.Context, now time.Time, limit int) ([]models.Saga, error) {
+	rows, err := db.Conn.QueryContext(ctx,
+		"SELECT "+sagaColumns+" FROM sagas WHERE (status = $1 AND deadline <= $2) OR status = $3 ORDER BY updated_at LIMIT $4",
+		models.SagaRunning, now, models.SagaCompensating, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var sagas []models.Saga
+	for rows.Next() {
+		s, err := scanSaga(rows)
+		if err != nil {
+			return nil, err
+		}
+		sagas = append(sagas, *s)
+	}
+	return sagas, rows.Err()
+}
+
+func scanSaga(row interface{ Scan(...any) error }) (*models.Saga, error) {
+	var s models.Saga
+	var steps []byte
+	if err := row.Scan(&s.ID, &s.OrderID, &s.ReservationID, &s.Status, &steps, &s.Deadline, &s.Error, &s.NeedsRefund, &s.Attempts, &s.CreatedAt, &s.UpdatedAt, &s.Version); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(steps, &s.Steps); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
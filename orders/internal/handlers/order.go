@@ -1,25 +1,44 @@
 package handlers
 
 import (
+	"context"
 	"encoding/json"
-	"fmt"
-	"log"
+	"errors"
+	"log/slog"
 	"net/http"
 	"orders/internal/db"
+	"orders/internal/inventory"
+	"orders/internal/metrics"
 	"orders/internal/models"
+	"orders/internal/saga"
+	"shared/admin"
+	"shared/audit"
+	"shared/money"
+	"shared/problem"
+	"shared/validate"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/google/uuid"
-	"github.com/gorilla/mux"
 )
 
 type OrderHandler struct {
-	DB *db.DB
+	DB    *db.DB
+	Audit *audit.Log
+	Saga  *saga.Orchestrator
 }
 
+// GetAllOrders handles GET /orders. Admins can add ?include_deleted=true to
+// see soft-deleted orders too.
 func (h *OrderHandler) GetAllOrders(w http.ResponseWriter, r *http.Request) {
-	orders, err := h.DB.GetAllOrders()
+	include, ok := includeDeleted(w, r)
+	if !ok {
+		return
+	}
+	orders, err := h.DB.GetAllOrders(r.Context(), include)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		problem.Internal(w, r, err)
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
@@ -27,19 +46,18 @@ func (h *OrderHandler) GetAllOrders(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *OrderHandler) GetOrderByID(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	id := vars["id"]
+	id := r.PathValue("id")
 	if id == "" {
-		http.Error(w, "Order ID is required", http.StatusBadRequest)
+		problem.Write(w, r, http.StatusBadRequest, problem.CodeBadRequest, "Order ID is required.")
 		return
 	}
-	order, err := h.DB.GetOrderByID(id)
+	order, err := h.DB.GetOrderByID(r.Context(), id, false)
 	if err != nil {
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		problem.Internal(w, r, err)
 		return
 	}
 	if order == nil {
-		http.Error(w, "Order not found", http.StatusNotFound)
+		problem.Write(w, r, http.StatusNotFound, problem.CodeOrderNotFound, "Order not found.")
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
@@ -49,62 +67,174 @@ func (h *OrderHandler) GetOrderByID(w http.ResponseWriter, r *http.Request) {
 // CreateOrder handles POST /orders
 func (h *OrderHandler) CreateOrder(w http.ResponseWriter, r *http.Request) (*models.Order, error) {
 	if r.Method != http.MethodPost {
-		w.WriteHeader(http.StatusMethodNotAllowed)
+		problem.MethodNotAllowed(w, r)
 		return nil, nil
 	}
 	var req struct {
-		Products []models.OrderProduct `json:"products"`
+		Products []models.OrderProduct `json:"products" validate:"required,max=100,dive"`
 	}
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		return nil, err
+	if !validate.DecodeJSON(w, r, &req) {
+		return nil, errors.New("invalid order")
 	}
-	amount := 0
-	for _, p := range req.Products {
-		amount += p.Price
+	amount := money.Money{Currency: req.Products[0].Price.Currency}
+	items := make([]inventory.Item, 0, len(req.Products))
+	for i, p := range req.Products {
+		if p.Quantity == 0 {
+			req.Products[i].Quantity = 1
+			p.Quantity = 1
+		}
+		// A cart must be priced in a single currency, and its total must not overflow
+		line, err := p.Price.Mul(int64(p.Quantity))
+		if err == nil {
+			amount, err = amount.Add(line)
+		}
+		switch {
+		case errors.Is(err, money.ErrCurrencyMismatch):
+			problem.Write(w, r, http.StatusUnprocessableEntity, problem.CodeCurrencyMismatch, "All products in an order must use the same currency.")
+			return nil, err
+		case errors.Is(err, money.ErrOverflow):
+			problem.Write(w, r, http.StatusUnprocessableEntity, problem.CodeAmountOutOfRange, "The order total is too large.")
+			return nil, err
+		case err != nil:
+			problem.Internal(w, r, err)
+			return nil, err
+		}
+		items = append(items, inventory.Item{ProductID: p.ID, Quantity: p.Quantity})
 	}
 	order := models.Order{
-		ID:       generateOrderID(),
-		Status:   "created",
-		Products: req.Products,
-		Amount:   amount,
+		ID:        generateOrderID(),
+		Status:    "created",
+		Products:  req.Products,
+		Amount:    amount,
+		CreatedAt: time.Now(),
 	}
-	if err := h.DB.CreateOrder(order); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+
+	// The checkout saga holds stock before the order exists so concurrent
+	// orders cannot oversell, and rolls both back if the payment cannot be
+	// requested. It outlives the request so a client hanging up cannot leave
+	// it half done.
+	sg, err := h.Saga.Checkout(context.WithoutCancel(r.Context()), &order, items)
+	if err != nil {
+		switch {
+		case errors.Is(err, inventory.ErrInsufficientStock):
+			problem.Write(w, r, http.StatusConflict, problem.CodeInsufficientStock, "Not enough stock is available for this order.")
+		case failedStep(sg) == models.StepReserveStock:
+			slog.ErrorContext(r.Context(), "Stock reservation failed", "order_id", order.ID, "error", err)
+			problem.Write(w, r, http.StatusBadGateway, problem.CodeBadGateway, "Stock could not be reserved, try again later.")
+		case failedStep(sg) == models.StepRequestPayment:
+			slog.ErrorContext(r.Context(), "Payment request failed", "order_id", order.ID, "error", err)
+			problem.Write(w, r, http.StatusBadGateway, problem.CodeBadGateway, "Payment could not be requested, try again later.")
+		default:
+			problem.Internal(w, r, err)
+		}
 		return nil, err
 	}
+	metrics.OrdersCreated.Inc()
 
-	w.WriteHeader(http.StatusCreated)
 	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(order)
 	return &order, nil
 }
 
+// CancelOrder handles POST /orders/{id}/cancel and releases the order's stock reservation
+func (h *OrderHandler) CancelOrder(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	// The saga releases the stock and flags paid orders for refund
+	order, err := h.Saga.Cancel(r.Context(), id)
+	if err != nil {
+		problem.Internal(w, r, err)
+		return
+	}
+	if order == nil {
+		existing, err := h.DB.GetOrderByID(r.Context(), id, false)
+		if err != nil {
+			problem.Internal(w, r, err)
+			return
+		}
+		if existing == nil {
+			problem.Write(w, r, http.StatusNotFound, problem.CodeOrderNotFound, "Order not found.")
+			return
+		}
+		problem.Write(w, r, http.StatusConflict, problem.CodeOrderCancelled, "Order is already cancelled.")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(order)
+}
+
 // DeleteOrder handles DELETE /orders/delete with array of ids
 func (h *OrderHandler) DeleteOrders(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodDelete {
-		w.WriteHeader(http.StatusMethodNotAllowed)
+		problem.MethodNotAllowed(w, r)
 		return
 	}
 	var req struct {
-		IDs []string `json:"ids"`
+		IDs []string `json:"ids" validate:"required,max=1000,dive,required"`
 	}
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.IDs) == 0 {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("Invalid or missing IDs"))
+	if !validate.DecodeJSON(w, r, &req) {
 		return
 	}
-	rowsAffected, err := h.DB.DeleteOrders(req.IDs)
+	rowsAffected, err := h.DB.DeleteOrders(r.Context(), req.IDs, audit.Actor(r.Context()))
 	if err != nil {
-		log.Printf("DeleteOrders error: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(fmt.Sprintf("Failed to delete orders: %v", err)))
+		problem.Internal(w, r, err)
 		return
 	}
+	h.Audit.Record(r, audit.Event{Action: "orders.delete", Target: strings.Join(req.IDs, ","), Outcome: audit.OutcomeSuccess})
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{"deleted": rowsAffected})
 }
 
+// RestoreOrders handles POST /orders/restore with an array of ids, undoing
+// their soft deletion.
+func (h *OrderHandler) RestoreOrders(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		IDs []string `json:"ids" validate:"required,max=1000,dive,required"`
+	}
+	if !validate.DecodeJSON(w, r, &req) {
+		return
+	}
+	restored, err := h.DB.RestoreOrders(r.Context(), req.IDs)
+	if err != nil {
+		problem.Internal(w, r, err)
+		return
+	}
+	h.Audit.Record(r, audit.Event{Action: "orders.restore", Target: strings.Join(req.IDs, ","), Outcome: audit.OutcomeSuccess})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"restored": restored})
+}
+
+// failedStep returns the name of the saga step that failed, if any.
+func failedStep(s *models.Saga) string {
+	if s == nil {
+		return ""
+	}
+	for _, step := range s.Steps {
+		if step.Status == models.StepFailed {
+			return step.Name
+		}
+	}
+	return ""
+}
+
+// includeDeleted reads the include_deleted query parameter, which only admins may set.
+func includeDeleted(w http.ResponseWriter, r *http.Request) (include, ok bool) {
+	v := r.URL.Query().Get("include_deleted")
+	if v == "" {
+		return false, true
+	}
+	include, err := strconv.ParseBool(v)
+	if err != nil {
+		problem.Validation(w, r, []problem.FieldError{{Field: "include_deleted", Code: "format", Message: "include_deleted must be true or false"}})
+		return false, false
+	}
+	if include && !admin.Is(r) {
+		problem.Write(w, r, http.StatusForbidden, problem.CodeForbidden, "Only administrators can list deleted records.")
+		return false, false
+	}
+	return include, true
+}
+
 // generateOrderID returns a new UUID string
 func generateOrderID() string {
 	return uuid.NewString()
@@ -0,0 +1,33 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"shared/problem"
+)
+
+// GetOrderSaga handles GET /orders/{id}/saga and shows the progress of the
+// order's checkout saga.
+func (h *OrderHandler) GetOrderSaga(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	order, err := h.DB.GetOrderByID(r.Context(), id, false)
+	if err != nil {
+		problem.Internal(w, r, err)
+		return
+	}
+	if order == nil {
+		problem.Write(w, r, http.StatusNotFound, problem.CodeOrderNotFound, "Order not found.")
+		return
+	}
+	s, err := h.DB.GetSagaByOrderID(r.Context(), id)
+	if err != nil {
+		problem.Internal(w, r, err)
+		return
+	}
+	if s == nil {
+		problem.Write(w, r, http.StatusNotFound, problem.CodeSagaNotFound, "The order has no checkout saga.")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s)
+}
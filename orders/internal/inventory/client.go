@@ -0,0 +1,134 @@
+package inventory
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"shared/requestid"
+	"shared/tracing"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
+)
+
+// ErrInsufficientStock is returned when the products service cannot reserve the requested quantities.
+var ErrInsufficientStock = errors.New("insufficient stock")
+
+// ErrReservationClosed is returned when a reservation is unknown or has
+// already been released, expired or confirmed as the call required.
+var ErrReservationClosed = errors.New("reservation closed")
+
+// MaxReservationTTL is the longest the products service holds a reservation.
+const MaxReservationTTL = 24 * time.Hour
+
+type Item struct {
+	ProductID string `json:"product_id"`
+	Quantity  int    `json:"quantity"`
+}
+
+type Reservation struct {
+	ID        string    `json:"id"`
+	OrderID   string    `json:"order_id"`
+	Status    string    `json:"status"`
+	Items     []Item    `json:"items"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Client talks to the reservation API of the products service. It always
+// calls as the orders service itself, because stock is also released in the
+// background, long after the customer's request and token are gone.
+type Client struct {
+	BaseURL    string
+	HTTPClient *http.Client
+	Tokens     oauth2.TokenSource
+}
+
+func NewClient(baseURL string, tokens oauth2.TokenSource) *Client {
+	return &Client{
+		BaseURL:    strings.TrimRight(baseURL, "/"),
+		HTTPClient: &http.Client{Timeout: 5 * time.Second, Transport: tracing.Transport(http.DefaultTransport)},
+		Tokens:     tokens,
+	}
+}
+
+// Reserve holds stock for every item of an order for ttl, rounded up to
+// whole seconds.
+func (c *Client) Reserve(ctx context.Context, orderID string, items []Item, ttl time.Duration) (*Reservation, error) {
+	body, err := json.Marshal(map[string]interface{}{
+		"order_id":    orderID,
+		"items":       items,
+		"ttl_seconds": int64((ttl + time.Second - 1) / time.Second),
+	})
+	if err != nil {
+		return nil, err
+	}
+	var reservation Reservation
+	if err := c.do(ctx, http.MethodPost, "/reservations", body, http.StatusCreated, &reservation); err != nil {
+		return nil, err
+	}
+	return &reservation, nil
+}
+
+// Release returns the stock held by a reservation.
+func (c *Client) Release(ctx context.Context, reservationID string) error {
+	return c.do(ctx, http.MethodPost, "/reservations/"+reservationID+"/release", nil, http.StatusOK, nil)
+}
+
+func (c *Client) do(ctx context.Context, method, path string, body []byte, wantStatus int, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, method, c.BaseURL+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	token, err := c.Tokens.Token()
+	if err != nil {
+		return fmt.Errorf("getting service token: %w", err)
+	}
+	token.SetAuthHeader(req)
+	if id := requestid.FromContext(ctx); id != "" {
+		req.Header.Set(requestid.Header, id)
+	}
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != wantStatus {
+		var p struct {
+			Code   string `json:"code"`
+			Detail string `json:"detail"`
+		}
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		_ = json.Unmarshal(msg, &p)
+		switch p.Code {
+		case "insufficient_stock":
+			return fmt.Errorf("%w: %s", ErrInsufficientStock, p.Detail)
+		case "reservation_not_found", "invalid_reservation_state":
+			return fmt.Errorf("%w: %s", ErrReservationClosed, p.Detail)
+		}
+		return fmt.Errorf("products service %s %s returned %d: %s", method, path, resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// ServiceTokens returns a token source for the client-credentials grant that
+// caches tokens until shortly before they expire.
+func ServiceTokens(tokenURL, clientID, clientSecret string) oauth2.TokenSource {
+	cfg := clientcredentials.Config{
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		TokenURL:     tokenURL,
+		Scopes:       []string{"products"},
+	}
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, &http.Client{Timeout: 5 * time.Second, Transport: tracing.Transport(http.DefaultTransport)})
+	return cfg.TokenSource(ctx)
+}
@@ -0,0 +1,32 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	// OrdersCreated counts orders that were stored after their stock was reserved.
+	OrdersCreated = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "orders_created_total",
+		Help: "Orders created.",
+	})
+
+	// OrderStatusUpdates counts order status changes driven by payment events, by new status.
+	OrderStatusUpdates = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "orders_status_updates_total",
+		Help: "Order status updates from payment events, by status.",
+	}, []string{"status"})
+
+	// SagasFinished counts checkout sagas that reached a final status, by status.
+	SagasFinished = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "orders_sagas_finished_total",
+		Help: "Checkout sagas that completed, were rolled back or failed, by status.",
+	}, []string{"status"})
+
+	// RefundsNeeded counts payments captured for orders that were rolled back or cancelled.
+	RefundsNeeded = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "orders_refunds_needed_total",
+		Help: "Payments captured for rolled back or cancelled orders that need a refund.",
+	})
+)
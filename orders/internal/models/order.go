@@ -1,14 +1,25 @@
 package models
 
+import (
+	"shared/money"
+	"time"
+)
+
 type OrderProduct struct {
-	ID    string `json:"id"`
-	Name  string `json:"name"`
-	Price int    `json:"price"`
+	ID       string      `json:"id" validate:"required,max=64"`
+	Name     string      `json:"name" validate:"max=200"`
+	Price    money.Money `json:"price"`
+	Quantity int         `json:"quantity" validate:"min=0,max=10000"`
 }
 
 type Order struct {
-	ID       string         `json:"id"`
-	Status   string         `json:"status"`
-	Products []OrderProduct `json:"products"`
-	Amount   int            `json:"amount"`
+	ID            string         `json:"id"`
+	Status        string         `json:"status"`
+	Products      []OrderProduct `json:"products"`
+	Amount        money.Money    `json:"amount"`
+	ReservationID string         `json:"reservation_id,omitempty"`
+	CreatedAt     time.Time      `json:"created_at"`
+	// DeletedAt and DeletedBy are set while the order is soft-deleted.
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+	DeletedBy string     `json:"deleted_by,omitempty"`
 }
@@ -0,0 +1,15 @@
+package models
+
+import (
+	"shared/money"
+	"time"
+)
+
+// Payment is a payment as reported by the payment service.
+type Payment struct {
+	TransactionID string      `json:"transaction_id"`
+	OrderID       string      `json:"order_id"`
+	Status        string      `json:"status"`
+	Amount        money.Money `json:"amount"`
+	CreatedAt     time.Time   `json:"created_at"`
+}
@@ -0,0 +1,73 @@
+package models
+
+import "time"
+
+// Saga statuses. A checkout saga runs until the payment arrives and then
+// completes, or it compensates its finished steps in reverse order. A saga
+// whose compensation keeps failing ends up failed and needs a person.
+const (
+	SagaRunning      = "running"
+	SagaCompleted    = "completed"
+	SagaCompensating = "compensating"
+	SagaCompensated  = "compensated"
+	SagaFailed       = "failed"
+)
+
+// Checkout saga steps, in the order they run.
+const (
+	StepReserveStock   = "reserve_stock"
+	StepCreateOrder    = "create_order"
+	StepRequestPayment = "request_payment"
+	StepAwaitPayment   = "await_payment"
+)
+
+// Saga step statuses.
+const (
+	StepDone        = "done"
+	StepFailed      = "failed"
+	StepCompensated = "compensated"
+)
+
+// Reasons recorded in Saga.Error and SagaStep.Error. They are stable codes
+// that are safe to show to clients; the errors behind them are only logged.
+const (
+	ReasonTimeout           = "timeout"
+	ReasonInsufficientStock = "insufficient_stock"
+	ReasonStepFailed        = "step_failed"
+	ReasonPaymentFailed     = "payment_failed"
+	ReasonPaymentMismatch   = "payment_mismatch"
+	ReasonPaymentTimeout    = "payment_timeout"
+	ReasonCancelled         = "cancelled"
+	// ReasonCompensationFailed means undoing a step failed and will be retried.
+	ReasonCompensationFailed = "compensation_failed"
+)
+
+// Saga is the persisted state of one checkout.
+type Saga struct {
+	ID            string     `json:"id"`
+	OrderID       string     `json:"order_id"`
+	ReservationID string     `json:"reservation_id,omitempty"`
+	Status        string     `json:"status"`
+	Steps         []SagaStep `json:"steps"`
+	// Deadline is when the step the saga is waiting on times out.
+	Deadline *time.Time `json:"deadline,omitempty"`
+	// Error is the reason the saga was rolled back, one of the Reason codes.
+	Error string `json:"error,omitempty"`
+	// NeedsRefund is set when money was captured for an order that was
+	// rolled back or cancelled, so the payment has to be refunded.
+	NeedsRefund bool `json:"needs_refund,omitempty"`
+	// Attempts counts failed compensation runs.
+	Attempts  int       `json:"attempts,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	// Version guards against concurrent updates from other instances.
+	Version int `json:"-"`
+}
+
+// SagaStep records the outcome of one step of a saga.
+type SagaStep struct {
+	Name   string    `json:"name"`
+	Status string    `json:"status"`
+	Error  string    `json:"error,omitempty"`
+	At     time.Time `json:"at"`
+}
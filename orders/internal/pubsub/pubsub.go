@@ -3,15 +3,26 @@ package pubsub
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
-	"os"
+	"log/slog"
 	"strings"
+	"sync/atomic"
+	"time"
 
+	"orders/internal/config"
 	"orders/internal/db"
+	ordermetrics "orders/internal/metrics"
 	"orders/internal/models"
+	"shared/metrics"
+	"shared/money"
+	"shared/requestid"
+	"shared/tracing"
 
 	"cloud.google.com/go/pubsub"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // PubSub struct holds references to Pub/Sub client, topics, subscriptions, and DB.
@@ -21,6 +32,16 @@ type PubSub struct {
 	OrdersTopic  *pubsub.Topic
 	PaymentSub   *pubsub.Subscription
 	DB           *db.DB
+	// PaymentReceived, when set, is told the status an order got from a
+	// payment event, so the checkout saga can complete or roll back.
+	PaymentReceived func(ctx context.Context, orderID, status string) error
+	// PaymentRefused, when set, is told the status of a payment event for an
+	// order that was cancelled or deleted first, so captured money is
+	// flagged for refund.
+	PaymentRefused func(ctx context.Context, orderID, status string) error
+
+	// receiving is set while the subscription receive loop is running
+	receiving atomic.Bool
 }
 
 func NewClient(ctx context.Context, projectID string) (*pubsub.Client, error) {
@@ -38,12 +59,12 @@ func EnsureTopic(ctx context.Context, client *pubsub.Client, topicName string) (
 		topic, err = client.CreateTopic(ctx, topicName)
 		if err != nil {
 			if strings.Contains(err.Error(), "AlreadyExists") {
-				log.Printf("Topic %s already exists (race condition)", topicName)
+				slog.Info("Topic already exists (race condition)", "topic", topicName)
 				return topic, nil
 			}
 			return nil, err
 		}
-		log.Printf("Created Pub/Sub topic: %s", topicName)
+		slog.Info("Created Pub/Sub topic", "topic", topicName)
 	}
 	return topic, nil
 }
@@ -64,7 +85,7 @@ func EnsureSubscription(ctx context.Context, client *pubsub.Client, subName, top
 		sub, err = client.CreateSubscription(ctx, subName, pubsub.SubscriptionConfig{Topic: topic})
 		if err != nil {
 			if strings.Contains(err.Error(), "AlreadyExists") {
-				log.Printf("Subscription %s already exists (race condition)", subName)
+				slog.Info("Subscription already exists (race condition)", "subscription", subName)
 				return sub, nil
 			}
 			if strings.Contains(err.Error(), "NotFound") {
@@ -72,13 +93,13 @@ func EnsureSubscription(ctx context.Context, client *pubsub.Client, subName, top
 			}
 			return nil, err
 		}
-		log.Printf("Created Pub/Sub subscription: %s", subName)
+		slog.Info("Created Pub/Sub subscription", "subscription", subName)
 	}
 	return sub, nil
 }
 
-func SetupPubSub(ctx context.Context, projectID string, dbInstance *db.DB) (*PubSub, error) {
-	client, err := NewClient(ctx, projectID)
+func SetupPubSub(ctx context.Context, cfg config.PubSub, dbInstance *db.DB) (*PubSub, error) {
+	client, err := NewClient(ctx, cfg.ProjectID)
 	if err != nil {
 		return nil, err
 	}
@@ -88,94 +109,206 @@ func SetupPubSub(ctx context.Context, projectID string, dbInstance *db.DB) (*Pub
 		DB:     dbInstance,
 	}
 
-	if err := ps.EnsureTopicAndSubscription(ctx); err != nil {
+	if err := ps.EnsureTopicAndSubscription(ctx, cfg); err != nil {
 		return nil, err
 	}
 
 	return ps, nil
 }
 
-func (ps *PubSub) EnsureTopicAndSubscription(ctx context.Context) error {
-	topicName := os.Getenv("PUBSUB_PAYMENT_TOPIC")
-	if topicName == "" {
-		topicName = "payment"
-	}
-	subName := os.Getenv("PUBSUB_PAYMENT_SUBSCRIPTION")
-	if subName == "" {
-		subName = "payment-sub"
-	}
-	ordersTopicName := os.Getenv("PUBSUB_ORDERS_TOPIC")
-	if ordersTopicName == "" {
-		ordersTopicName = "orders"
-	}
-	ps.PaymentTopic = ps.Client.Topic(topicName)
-	ps.OrdersTopic = ps.Client.Topic(ordersTopicName)
-	ps.PaymentSub = ps.Client.Subscription(subName)
+func (ps *PubSub) EnsureTopicAndSubscription(ctx context.Context, cfg config.PubSub) error {
 	var err error
-	ps.PaymentTopic, err = EnsureTopic(ctx, ps.Client, topicName)
+	ps.PaymentTopic, err = EnsureTopic(ctx, ps.Client, cfg.PaymentTopic)
 	if err != nil {
 		return err
 	}
-	ps.OrdersTopic, err = EnsureTopic(ctx, ps.Client, ordersTopicName)
+	ps.OrdersTopic, err = EnsureTopic(ctx, ps.Client, cfg.OrdersTopic)
 	if err != nil {
 		return err
 	}
-	ps.PaymentSub, err = EnsureSubscription(ctx, ps.Client, subName, topicName)
+	ps.PaymentSub, err = EnsureSubscription(ctx, ps.Client, cfg.PaymentSubscription, cfg.PaymentTopic)
 	return err
 }
 
 func (ps *PubSub) ListenForPaymentEvents(ctx context.Context) {
-	err := ps.PaymentSub.Receive(ctx, func(ctx context.Context, msg *pubsub.Message) {
+	err := ps.receive(ctx, ps.PaymentSub, func(ctx context.Context, msg *pubsub.Message) bool {
 		var paymentEvent struct {
-			OrderID string `json:"order_id"`
-			Status  string `json:"status"`
-			Amount  int    `json:"amount"`
+			OrderID string      `json:"order_id"`
+			Status  string      `json:"status"`
+			Amount  money.Money `json:"amount"`
 		}
 		if err := json.Unmarshal(msg.Data, &paymentEvent); err != nil {
-			log.Printf("Invalid payment event: %v", err)
-			msg.Nack()
-			return
+			slog.ErrorContext(ctx, "Invalid payment event", "message_id", msg.ID, "error", err)
+			return false
 		}
-		log.Printf("Received payment event: %+v", paymentEvent)
-		// Update order status in DB based on payment event
-		if err := ps.DB.UpdateOrderStatus(paymentEvent.OrderID, paymentEvent.Status); err != nil {
-			log.Printf("Failed to update order status: %v", err)
-			msg.Nack()
-			return
+		slog.InfoContext(ctx, "Received payment event", "order_id", paymentEvent.OrderID, "status", paymentEvent.Status, "amount", paymentEvent.Amount.String())
+		order, err := ps.DB.GetOrderByID(ctx, paymentEvent.OrderID, true)
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to load order", "order_id", paymentEvent.OrderID, "error", err)
+			return false
+		}
+		if order == nil {
+			slog.WarnContext(ctx, "Ignoring payment event for unknown order", "order_id", paymentEvent.OrderID)
+			return true
+		}
+		// A payment only settles the order if it covers exactly the order total in the order currency
+		if paymentEvent.Status == "paid" && !paymentEvent.Amount.Equal(order.Amount) {
+			slog.WarnContext(ctx, "Payment does not match order total", "order_id", order.ID, "amount", paymentEvent.Amount.String(), "order_amount", order.Amount.String())
+			paymentEvent.Status = "payment_mismatch"
+		}
+		// The update is conditional, so a cancellation or rollback that lands
+		// after the order was read is not overwritten
+		updated, err := ps.DB.UpdateOrderStatus(ctx, paymentEvent.OrderID, paymentEvent.Status)
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to update order status", "order_id", paymentEvent.OrderID, "status", paymentEvent.Status, "error", err)
+			return false
+		}
+		// A redelivered or late event must not revive a cancelled or deleted
+		// order, but the saga still learns of it so captured money is flagged
+		// for refund
+		if !updated {
+			slog.WarnContext(ctx, "Payment event for cancelled or deleted order", "order_id", order.ID, "status", paymentEvent.Status)
+			if ps.PaymentRefused != nil {
+				if err := ps.PaymentRefused(ctx, paymentEvent.OrderID, paymentEvent.Status); err != nil {
+					slog.ErrorContext(ctx, "Failed to record payment for cancelled order", "order_id", order.ID, "error", err)
+					return false
+				}
+			}
+			return true
+		}
+		ordermetrics.OrderStatusUpdates.WithLabelValues(paymentEvent.Status).Inc()
+		slog.InfoContext(ctx, "Updated order status", "order_id", paymentEvent.OrderID, "status", paymentEvent.Status)
+		if ps.PaymentReceived != nil {
+			if err := ps.PaymentReceived(ctx, paymentEvent.OrderID, paymentEvent.Status); err != nil {
+				slog.ErrorContext(ctx, "Failed to advance checkout saga", "order_id", paymentEvent.OrderID, "error", err)
+				return false
+			}
 		}
-		msg.Ack()
+		return true
 	})
 	if err != nil {
-		log.Printf("Error receiving messages: %v", err)
+		slog.Error("Error receiving payment events", "error", err)
+	}
+}
+
+// NewPublisher connects to the topics of cfg for publishing only, without
+// creating topics or subscriptions, for jobs that resend events.
+func NewPublisher(ctx context.Context, cfg config.PubSub) (*PubSub, error) {
+	client, err := NewClient(ctx, cfg.ProjectID)
+	if err != nil {
+		return nil, err
 	}
+	return &PubSub{
+		Client:       client,
+		OrdersTopic:  client.Topic(cfg.OrdersTopic),
+		PaymentTopic: client.Topic(cfg.PaymentTopic),
+	}, nil
 }
 
-// add a method to publish order events to Pub/Sub
-func PublishOrderEvent(ctx context.Context, ps *PubSub, order models.Order) {
+// PublishOrder publishes an order event on the orders topic, which asks the
+// payment service to charge the order.
+func PublishOrder(ctx context.Context, ps *PubSub, order models.Order) error {
 	orderEvent := struct {
-		ID     string `json:"id"`
-		Status string `json:"status"`
-		Amount int    `json:"amount"`
+		ID     string      `json:"id"`
+		Status string      `json:"status"`
+		Amount money.Money `json:"amount"`
 	}{
 		ID:     order.ID,
 		Status: order.Status,
 		Amount: order.Amount,
 	}
-
 	data, err := json.Marshal(orderEvent)
 	if err != nil {
-		log.Printf("Failed to marshal order event: %v", err)
-		return
+		return err
+	}
+	return publish(ctx, ps.OrdersTopic, &pubsub.Message{Data: data, Attributes: requestid.Attributes(ctx)})
+}
+
+// PublishPaymentEvent resends a payment event on the payment topic in the
+// form the payment service publishes it, so the order status catches up.
+func PublishPaymentEvent(ctx context.Context, ps *PubSub, payment models.Payment) error {
+	data, err := json.Marshal(payment)
+	if err != nil {
+		return err
+	}
+	return publish(ctx, ps.PaymentTopic, &pubsub.Message{Data: data, Attributes: requestid.Attributes(ctx)})
+}
+
+// CheckReceiving reports an error unless the subscription receive loop is running.
+func (ps *PubSub) CheckReceiving(ctx context.Context) error {
+	if !ps.receiving.Load() {
+		return errors.New("subscription receive loop is not running")
 	}
+	return nil
+}
 
-	msg := &pubsub.Message{
-		Data: data,
+// CheckTopics reports an error unless every topic and subscription the service uses exists.
+func (ps *PubSub) CheckTopics(ctx context.Context) error {
+	for _, topic := range []*pubsub.Topic{ps.PaymentTopic, ps.OrdersTopic} {
+		exists, err := topic.Exists(ctx)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return fmt.Errorf("topic %s does not exist", topic.ID())
+		}
+	}
+	exists, err := ps.PaymentSub.Exists(ctx)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("subscription %s does not exist", ps.PaymentSub.ID())
 	}
+	return nil
+}
+
+// receive handles the messages of sub until ctx is done. handle runs in a
+// consumer span continuing the publisher's trace, with the publisher's
+// correlation ID in its context, and reports whether the message should be
+// acked; receive settles the message and records Pub/Sub metrics.
+func (ps *PubSub) receive(ctx context.Context, sub *pubsub.Subscription, handle func(context.Context, *pubsub.Message) bool) error {
+	ps.receiving.Store(true)
+	defer ps.receiving.Store(false)
+	return sub.Receive(ctx, func(ctx context.Context, msg *pubsub.Message) {
+		start := time.Now()
+		metrics.ObserveReceived(sub.ID())
+		ctx = tracing.Extract(requestid.FromAttributes(ctx, msg.Attributes), msg.Attributes)
+		ctx, span := tracing.Tracer().Start(ctx, sub.ID()+" receive",
+			trace.WithSpanKind(trace.SpanKindConsumer),
+			trace.WithAttributes(tracing.MessagingAttributes(sub.ID())...),
+			trace.WithAttributes(semconv.MessagingMessageID(msg.ID)),
+		)
+		defer span.End()
+		acked := handle(ctx, msg)
+		if acked {
+			msg.Ack()
+		} else {
+			msg.Nack()
+			span.SetStatus(codes.Error, "message nacked")
+		}
+		metrics.ObserveHandled(sub.ID(), start, acked)
+	})
+}
 
-	result := ps.OrdersTopic.Publish(ctx, msg)
-	if _, err := result.Get(ctx); err != nil {
-		log.Printf("Failed to publish order event: %v", err)
-	} else {
-		log.Printf("Published order event for order ID: %s", order.ID)
+// publish sends msg to topic in a producer span, waits until the server
+// accepts it and records the result. The trace context is added to the
+// message attributes so consumers continue the trace.
+func publish(ctx context.Context, topic *pubsub.Topic, msg *pubsub.Message) error {
+	ctx, span := tracing.Tracer().Start(ctx, topic.ID()+" publish",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(tracing.MessagingAttributes(topic.ID())...),
+	)
+	defer span.End()
+	if msg.Attributes == nil {
+		msg.Attributes = map[string]string{}
 	}
+	tracing.Inject(ctx, msg.Attributes)
+	_, err := topic.Publish(ctx, msg).Get(ctx)
+	metrics.ObservePublish(topic.ID(), err)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return err
 }
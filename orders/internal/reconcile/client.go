@@ -0,0 +1,90 @@
+package reconcile
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"orders/internal/models"
+	"shared/tracing"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
+)
+
+// Client reads orders and payments through the APIs of their services.
+type Client struct {
+	OrdersURL   string
+	PaymentsURL string
+	HTTPClient  *http.Client
+	// IncludeDeleted also lists soft-deleted orders and payments, which needs
+	// an admin token.
+	IncludeDeleted bool
+}
+
+// NewClient returns a client that authenticates its calls with tokens.
+func NewClient(ordersURL, paymentsURL string, tokens oauth2.TokenSource) *Client {
+	return &Client{
+		OrdersURL:   strings.TrimRight(ordersURL, "/"),
+		PaymentsURL: strings.TrimRight(paymentsURL, "/"),
+		HTTPClient: &http.Client{
+			Timeout:   30 * time.Second,
+			Transport: &oauth2.Transport{Source: tokens, Base: tracing.Transport(http.DefaultTransport)},
+		},
+	}
+}
+
+// Orders lists every order of the orders service.
+func (c *Client) Orders(ctx context.Context) ([]models.Order, error) {
+	var orders []models.Order
+	err := c.get(ctx, c.OrdersURL+"/orders", &orders)
+	return orders, err
+}
+
+// Payments lists every payment of the payment service.
+func (c *Client) Payments(ctx context.Context) ([]models.Payment, error) {
+	var payments []models.Payment
+	err := c.get(ctx, c.PaymentsURL+"/payments", &payments)
+	return payments, err
+}
+
+func (c *Client) get(ctx context.Context, rawURL string, out interface{}) error {
+	if c.IncludeDeleted {
+		rawURL += "?" + url.Values{"include_deleted": {"true"}}.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("GET %s returned %d: %s", rawURL, resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("decoding %s: %w", rawURL, err)
+	}
+	return nil
+}
+
+// ServiceTokens returns a token source for the client-credentials grant with
+// the scopes needed to read both services.
+func ServiceTokens(tokenURL, clientID, clientSecret string) oauth2.TokenSource {
+	cfg := clientcredentials.Config{
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		TokenURL:     tokenURL,
+		Scopes:       []string{"orders", "payments"},
+	}
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, &http.Client{Timeout: 5 * time.Second, Transport: tracing.Transport(http.DefaultTransport)})
+	return cfg.TokenSource(ctx)
+}
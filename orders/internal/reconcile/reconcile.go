@@ -0,0 +1,142 @@
+// Package reconcile compares the orders known to the orders service with the
+// payments known to the payment service and reports where they disagree.
+package reconcile
+
+import (
+	"fmt"
+	"orders/internal/models"
+	"sort"
+	"time"
+)
+
+// Kinds of mismatch reported by Compare.
+const (
+	// KindUnpaidOrder is an order still waiting for payment after the grace
+	// period with no finished payment; its order event was probably lost or
+	// its charge died.
+	KindUnpaidOrder = "unpaid_order"
+	// KindMissingPaymentEvent is an order still waiting for payment although
+	// the payment service has a payment for it; the payment event was lost.
+	KindMissingPaymentEvent = "missing_payment_event"
+	// KindPaymentWithoutOrder is a payment for an order the orders service
+	// does not know.
+	KindPaymentWithoutOrder = "payment_without_order"
+	// KindAmountMismatch is a successful payment whose amount differs from
+	// the order total.
+	KindAmountMismatch = "amount_mismatch"
+	// KindNeedsRefund is a successful payment for a cancelled order, for
+	// example one that arrived after the checkout timed out. The money has
+	// to be refunded.
+	KindNeedsRefund = "needs_refund"
+)
+
+// Mismatch is one disagreement between the two services.
+type Mismatch struct {
+	Kind          string `json:"kind"`
+	OrderID       string `json:"order_id,omitempty"`
+	TransactionID string `json:"transaction_id,omitempty"`
+	Detail        string `json:"detail"`
+
+	// Order and Payment are what the mismatch was found on, for republishing.
+	Order   *models.Order   `json:"-"`
+	Payment *models.Payment `json:"-"`
+}
+
+// Compare reports the mismatches between orders and payments as of now.
+// Orders younger than unpaidAfter are still expected to be waiting for their
+// payment and are not reported as unpaid.
+func Compare(orders []models.Order, payments []models.Payment, now time.Time, unpaidAfter time.Duration) []Mismatch {
+	byOrder := make(map[string][]models.Payment, len(payments))
+	for _, p := range payments {
+		byOrder[p.OrderID] = append(byOrder[p.OrderID], p)
+	}
+	known := make(map[string]bool, len(orders))
+
+	var mismatches []Mismatch
+	for i := range orders {
+		order := &orders[i]
+		known[order.ID] = true
+		orderPayments := byOrder[order.ID]
+		for j := range orderPayments {
+			p := &orderPayments[j]
+			if p.Status == "paid" && order.Status == "cancelled" {
+				mismatches = append(mismatches, Mismatch{
+					Kind:          KindNeedsRefund,
+					OrderID:       order.ID,
+					TransactionID: p.TransactionID,
+					Detail:        fmt.Sprintf("paid %s for a cancelled order", p.Amount),
+					Order:         order,
+					Payment:       p,
+				})
+			}
+			if p.Status == "paid" && !p.Amount.Equal(order.Amount) {
+				mismatches = append(mismatches, Mismatch{
+					Kind:          KindAmountMismatch,
+					OrderID:       order.ID,
+					TransactionID: p.TransactionID,
+					Detail:        fmt.Sprintf("paid %s for an order of %s", p.Amount, order.Amount),
+					Order:         order,
+					Payment:       p,
+				})
+			}
+		}
+		if order.Status != "created" {
+			continue
+		}
+		// A pending payment is still being charged and has no event yet
+		if latest := latestPayment(orderPayments); latest != nil && latest.Status != "pending" {
+			mismatches = append(mismatches, Mismatch{
+				Kind:          KindMissingPaymentEvent,
+				OrderID:       order.ID,
+				TransactionID: latest.TransactionID,
+				Detail:        fmt.Sprintf("payment is %s but the order is still %s", latest.Status, order.Status),
+				Order:         order,
+				Payment:       latest,
+			})
+			continue
+		}
+		if age := now.Sub(order.CreatedAt); age >= unpaidAfter {
+			mismatches = append(mismatches, Mismatch{
+				Kind:    KindUnpaidOrder,
+				OrderID: order.ID,
+				Detail:  fmt.Sprintf("no payment after %s", age.Truncate(time.Second)),
+				Order:   order,
+			})
+		}
+	}
+	for i := range payments {
+		p := &payments[i]
+		if !known[p.OrderID] {
+			mismatches = append(mismatches, Mismatch{
+				Kind:          KindPaymentWithoutOrder,
+				OrderID:       p.OrderID,
+				TransactionID: p.TransactionID,
+				Detail:        fmt.Sprintf("%s payment of %s", p.Status, p.Amount),
+				Payment:       p,
+			})
+		}
+	}
+
+	sort.SliceStable(mismatches, func(i, j int) bool {
+		a, b := mismatches[i], mismatches[j]
+		if a.Kind != b.Kind {
+			return a.Kind < b.Kind
+		}
+		if a.OrderID != b.OrderID {
+			return a.OrderID < b.OrderID
+		}
+		return a.TransactionID < b.TransactionID
+	})
+	return mismatches
+}
+
+// latestPayment returns the most recent of payments, or nil if there are none.
+func latestPayment(payments []models.Payment) *models.Payment {
+	var latest *models.Payment
+	for i := range payments {
+		if latest == nil || payments[i].CreatedAt.After(latest.CreatedAt) {
+			latest = &payments[i]
+		}
+	}
+	return latest
+}
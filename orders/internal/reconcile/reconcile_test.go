@@ -0,0 +1,103 @@
+package reconcile
+
+import (
+	"orders/internal/models"
+	"reflect"
+	"shared/money"
+	"testing"
+	"time"
+)
+
+func TestCompare(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	usd := func(amount int64) money.Money { return money.Money{Amount: amount, Currency: "USD"} }
+	order := func(id, status string, amount int64, age time.Duration) models.Order {
+		return models.Order{ID: id, Status: status, Amount: usd(amount), CreatedAt: now.Add(-age)}
+	}
+	payment := func(txID, orderID, status string, amount int64, age time.Duration) models.Payment {
+		return models.Payment{TransactionID: txID, OrderID: orderID, Status: status, Amount: usd(amount), CreatedAt: now.Add(-age)}
+	}
+	type found struct{ Kind, OrderID, TransactionID string }
+
+	tests := []struct {
+		name     string
+		orders   []models.Order
+		payments []models.Payment
+		want     []found
+	}{
+		{
+			name:     "consistent",
+			orders:   []models.Order{order("o1", "paid", 500, time.Hour), order("o2", "failed", 500, time.Hour)},
+			payments: []models.Payment{payment("t1", "o1", "paid", 500, time.Hour), payment("t2", "o2", "failed", 500, time.Hour)},
+		},
+		{
+			name:   "new order without payment is not unpaid yet",
+			orders: []models.Order{order("o1", "created", 500, time.Minute)},
+		},
+		{
+			name:   "old order without payment",
+			orders: []models.Order{order("o1", "created", 500, time.Hour)},
+			want:   []found{{KindUnpaidOrder, "o1", ""}},
+		},
+		{
+			name:     "old order with pending payment",
+			orders:   []models.Order{order("o1", "created", 500, time.Hour)},
+			payments: []models.Payment{payment("t1", "o1", "pending", 500, time.Hour)},
+			want:     []found{{KindUnpaidOrder, "o1", ""}},
+		},
+		{
+			name:     "lost payment event reports the latest payment",
+			orders:   []models.Order{order("o1", "created", 500, time.Minute)},
+			payments: []models.Payment{payment("t1", "o1", "failed", 500, 2*time.Minute), payment("t2", "o1", "paid", 500, time.Minute)},
+			want:     []found{{KindMissingPaymentEvent, "o1", "t2"}},
+		},
+		{
+			name:     "payment without order",
+			payments: []models.Payment{payment("t1", "o9", "paid", 500, time.Hour)},
+			want:     []found{{KindPaymentWithoutOrder, "o9", "t1"}},
+		},
+		{
+			name:     "paid amount differs",
+			orders:   []models.Order{order("o1", "payment_mismatch", 500, time.Hour)},
+			payments: []models.Payment{payment("t1", "o1", "paid", 400, time.Hour)},
+			want:     []found{{KindAmountMismatch, "o1", "t1"}},
+		},
+		{
+			name:     "failed payment amount is not compared",
+			orders:   []models.Order{order("o1", "failed", 500, time.Hour)},
+			payments: []models.Payment{payment("t1", "o1", "failed", 400, time.Hour)},
+		},
+		{
+			name:     "paid cancelled order needs refund",
+			orders:   []models.Order{order("o1", "cancelled", 500, time.Hour)},
+			payments: []models.Payment{payment("t1", "o1", "paid", 500, time.Hour)},
+			want:     []found{{KindNeedsRefund, "o1", "t1"}},
+		},
+		{
+			name: "sorted by kind and order",
+			orders: []models.Order{
+				order("o2", "created", 500, time.Hour),
+				order("o1", "created", 500, time.Hour),
+				order("o3", "paid", 500, time.Hour),
+			},
+			payments: []models.Payment{payment("t3", "o3", "paid", 100, time.Hour), payment("t4", "o4", "paid", 100, time.Hour)},
+			want: []found{
+				{KindAmountMismatch, "o3", "t3"},
+				{KindPaymentWithoutOrder, "o4", "t4"},
+				{KindUnpaidOrder, "o1", ""},
+				{KindUnpaidOrder, "o2", ""},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []found
+			for _, m := range Compare(tt.orders, tt.payments, now, 30*time.Minute) {
+				got = append(got, found{m.Kind, m.OrderID, m.TransactionID})
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Compare() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,339 @@
+// Package saga orchestrates checkout as a saga: reserve stock, store the
+// order, request the payment and wait for its result. Every step is recorded
+// in the sagas table. When a step fails or the payment does not arrive in
+// time, the finished steps are undone in reverse order, so a checkout either
+// completes or is rolled back as a whole.
+package saga
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"orders/internal/db"
+	"orders/internal/inventory"
+	"orders/internal/metrics"
+	"orders/internal/models"
+	"shared/tracing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// maxCompensationAttempts is how often a failing compensation is retried
+// before the saga is given up as failed.
+const maxCompensationAttempts = 5
+
+// reservationMargin is how much longer than the checkout may take the stock
+// stays reserved, so the periodic expiry can roll the saga back before the
+// reservation lapses on its own.
+const reservationMargin = 5 * time.Minute
+
+// ReservationTTL is how long checkout reserves stock: while the two steps
+// after the reservation run and then the payment is awaited, plus a margin.
+func ReservationTTL(stepTimeout, paymentTimeout time.Duration) time.Duration {
+	return 2*stepTimeout + paymentTimeout + reservationMargin
+}
+
+// Orchestrator runs checkout sagas.
+type Orchestrator struct {
+	DB        *db.DB
+	Inventory *inventory.Client
+	// Publish sends the order event that asks the payment service to charge the order.
+	Publish func(context.Context, models.Order) error
+	// StepTimeout bounds each synchronous step.
+	StepTimeout time.Duration
+	// PaymentTimeout is how long to wait for the payment result.
+	PaymentTimeout time.Duration
+}
+
+// Checkout runs the synchronous part of the saga for a new order: it
+// reserves the stock for items, stores the order and requests the payment.
+// If a step fails, the steps before it are compensated and the step's error
+// is returned.
+func (o *Orchestrator) Checkout(ctx context.Context, order *models.Order, items []inventory.Item) (*models.Saga, error) {
+	s := &models.Saga{ID: uuid.NewString(), OrderID: order.ID, Status: models.SagaRunning, Steps: []models.SagaStep{}}
+	if err := o.DB.CreateSaga(ctx, s); err != nil {
+		return nil, err
+	}
+
+	err := o.step(ctx, s, models.StepReserveStock, func(ctx context.Context) error {
+		return o.reserve(ctx, s, order, items)
+	})
+	if err == nil {
+		err = o.step(ctx, s, models.StepCreateOrder, func(ctx context.Context) error {
+			return o.DB.CreateOrder(ctx, *order)
+		})
+	}
+	if err == nil {
+		err = o.step(ctx, s, models.StepRequestPayment, func(ctx context.Context) error {
+			return o.Publish(ctx, *order)
+		})
+	}
+	if err != nil {
+		o.compensate(context.WithoutCancel(ctx), s, reason(err))
+		return s, err
+	}
+
+	deadline := time.Now().Add(o.PaymentTimeout)
+	s.Deadline = &deadline
+	if err := o.DB.UpdateSaga(ctx, s); err != nil {
+		slog.ErrorContext(ctx, "Failed to save saga", "saga_id", s.ID, "order_id", s.OrderID, "error", err)
+	}
+	return s, nil
+}
+
+// reserve holds the stock for items until the payment of order can no
+// longer arrive.
+func (o *Orchestrator) reserve(ctx context.Context, s *models.Saga, order *models.Order, items []inventory.Item) error {
+	reservation, err := o.Inventory.Reserve(ctx, order.ID, items, ReservationTTL(o.StepTimeout, o.PaymentTimeout))
+	if err != nil {
+		return err
+	}
+	order.ReservationID = reservation.ID
+	s.ReservationID = reservation.ID
+	return nil
+}
+
+// PaymentReceived finishes the saga of an order with the payment status the
+// order was given. A paid order completes the saga; any other status
+// compensates it. A payment that captured money after the saga was already
+// rolled back marks the saga as needing a refund. Other events for sagas
+// that are not running are ignored.
+func (o *Orchestrator) PaymentReceived(ctx context.Context, orderID, status string) error {
+	s, err := o.DB.GetSagaByOrderID(ctx, orderID)
+	if err != nil || s == nil {
+		return err
+	}
+	captured := status == "paid" || status == "payment_mismatch"
+	switch {
+	case s.Status == models.SagaRunning && status == "paid":
+		record(s, models.StepAwaitPayment, "")
+		s.Status = models.SagaCompleted
+		s.Deadline = nil
+		// On a conflict the event is retried against the saga as it is now,
+		// which may have been rolled back by the timeout in the meantime
+		if err := o.DB.UpdateSaga(ctx, s); err != nil {
+			return err
+		}
+		metrics.SagasFinished.WithLabelValues(s.Status).Inc()
+		slog.InfoContext(ctx, "Checkout saga completed", "saga_id", s.ID, "order_id", s.OrderID)
+		return nil
+	case s.Status == models.SagaRunning:
+		r := models.ReasonPaymentFailed
+		if status == "payment_mismatch" {
+			r = models.ReasonPaymentMismatch
+		}
+		s.NeedsRefund = captured
+		// A lost race is retried, so a captured payment is flagged by the path below
+		if err := o.compensate(ctx, s, r); err != nil {
+			return err
+		}
+		if captured {
+			metrics.RefundsNeeded.Inc()
+			slog.WarnContext(ctx, "Payment captured for rolled back checkout needs a refund", "saga_id", s.ID, "order_id", s.OrderID, "status", status)
+		}
+		return nil
+	case captured && s.Status != models.SagaCompleted:
+		// The payment arrived after the saga timed out or was cancelled
+		return o.flagRefund(ctx, s, status)
+	}
+	return nil
+}
+
+// PaymentRefused records a payment for an order that was cancelled or
+// deleted before the payment could settle it. Money it captured is flagged
+// for refund; the saga itself is left to the cancellation or timeout that
+// rolls it back.
+func (o *Orchestrator) PaymentRefused(ctx context.Context, orderID, status string) error {
+	s, err := o.DB.GetSagaByOrderID(ctx, orderID)
+	if err != nil || s == nil {
+		return err
+	}
+	if status != "paid" && status != "payment_mismatch" {
+		return nil
+	}
+	return o.flagRefund(ctx, s, status)
+}
+
+// Cancel cancels an order on the customer's request and returns it, or nil
+// if the order does not exist or is already cancelled. The status check is
+// part of the update, so of several concurrent cancellations and rollbacks
+// only one releases the stock. A checkout that is still running is rolled
+// back; a paid one is marked as needing a refund.
+func (o *Orchestrator) Cancel(ctx context.Context, orderID string) (*models.Order, error) {
+	order, err := o.DB.CancelOrder(ctx, orderID)
+	if err != nil || order == nil {
+		return nil, err
+	}
+	ctx = context.WithoutCancel(ctx)
+	s, err := o.DB.GetSagaByOrderID(ctx, orderID)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to load saga of cancelled order", "order_id", orderID, "error", err)
+	}
+	if s != nil && (s.Status == models.SagaRunning || s.Status == models.SagaCompensating) {
+		o.compensate(ctx, s, models.ReasonCancelled)
+		return order, nil
+	}
+	if order.ReservationID != "" {
+		err := o.Inventory.Release(ctx, order.ReservationID)
+		if err != nil && !errors.Is(err, inventory.ErrReservationClosed) {
+			slog.ErrorContext(ctx, "Failed to release reservation for cancelled order", "order_id", order.ID, "reservation_id", order.ReservationID, "error", err)
+		}
+	}
+	if s != nil && s.Status == models.SagaCompleted {
+		if err := o.flagRefund(ctx, s, "paid"); err != nil {
+			slog.ErrorContext(ctx, "Failed to mark cancelled order for refund", "saga_id", s.ID, "order_id", orderID, "error", err)
+		}
+	}
+	return order, nil
+}
+
+// flagRefund marks s as needing a refund for a payment with status that
+// captured money. A conflicting update is returned so the event is retried.
+func (o *Orchestrator) flagRefund(ctx context.Context, s *models.Saga, status string) error {
+	if s.NeedsRefund {
+		return nil
+	}
+	s.NeedsRefund = true
+	if err := o.DB.UpdateSaga(ctx, s); err != nil {
+		return err
+	}
+	metrics.RefundsNeeded.Inc()
+	slog.WarnContext(ctx, "Payment captured for rolled back checkout needs a refund", "saga_id", s.ID, "order_id", s.OrderID, "saga_status", s.Status, "status", status)
+	return nil
+}
+
+// ExpireSagas compensates running sagas whose payment timed out and retries
+// compensations that failed before.
+func (o *Orchestrator) ExpireSagas(ctx context.Context) error {
+	sagas, err := o.DB.DueSagas(ctx, time.Now(), 100)
+	if err != nil {
+		return err
+	}
+	for i := range sagas {
+		s := &sagas[i]
+		var r string
+		if s.Status == models.SagaRunning {
+			r = models.ReasonPaymentTimeout
+		}
+		o.compensate(ctx, s, r)
+	}
+	return nil
+}
+
+// step runs fn as the named step within the step timeout and records its outcome.
+func (o *Orchestrator) step(ctx context.Context, s *models.Saga, name string, fn func(context.Context) error) error {
+	ctx, span := tracing.Tracer().Start(ctx, "saga "+name)
+	defer span.End()
+	stepCtx, cancel := context.WithTimeout(ctx, o.StepTimeout)
+	err := fn(stepCtx)
+	cancel()
+	if err != nil {
+		slog.ErrorContext(ctx, "Checkout saga step failed", "saga_id", s.ID, "order_id", s.OrderID, "step", name, "error", err)
+	}
+	record(s, name, reason(err))
+	if saveErr := o.DB.UpdateSaga(ctx, s); saveErr != nil && err == nil {
+		return saveErr
+	}
+	return err
+}
+
+// compensate undoes the finished steps of s in reverse order. why is the
+// reason code of the failure that triggered it, or empty when a failed
+// compensation is retried. The outcome is saved; failures are logged rather
+// than returned; only saving the saga reports an error.
+func (o *Orchestrator) compensate(ctx context.Context, s *models.Saga, why string) error {
+	ctx, span := tracing.Tracer().Start(ctx, "saga compensate")
+	defer span.End()
+	if why != "" {
+		if s.Status == models.SagaRunning && pending(s) == models.StepAwaitPayment {
+			record(s, models.StepAwaitPayment, why)
+		}
+		s.Error = why
+	}
+	s.Status = models.SagaCompensating
+	s.Deadline = nil
+
+	var errs []error
+	for i := len(s.Steps) - 1; i >= 0; i-- {
+		step := &s.Steps[i]
+		if step.Status != models.StepDone {
+			continue
+		}
+		var err error
+		switch step.Name {
+		case models.StepReserveStock:
+			err = o.Inventory.Release(ctx, s.ReservationID)
+			if errors.Is(err, inventory.ErrReservationClosed) {
+				err = nil // Already released or expired
+			}
+		case models.StepCreateOrder:
+			_, err = o.DB.CancelOrder(ctx, s.OrderID)
+		default:
+			// Requesting the payment has nothing to undo
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("compensating %s: %w", step.Name, err))
+			continue
+		}
+		step.Status = models.StepCompensated
+		step.Error = ""
+		step.At = time.Now()
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		s.Attempts++
+		s.Error = models.ReasonCompensationFailed
+		if s.Attempts >= maxCompensationAttempts {
+			s.Status = models.SagaFailed
+		}
+		slog.ErrorContext(ctx, "Checkout saga compensation failed", "saga_id", s.ID, "order_id", s.OrderID, "attempts", s.Attempts, "error", err)
+	} else {
+		s.Status = models.SagaCompensated
+		slog.InfoContext(ctx, "Checkout saga rolled back", "saga_id", s.ID, "order_id", s.OrderID, "reason", s.Error)
+	}
+	if err := o.DB.UpdateSaga(ctx, s); err != nil {
+		if !errors.Is(err, db.ErrSagaConflict) {
+			slog.ErrorContext(ctx, "Failed to save saga", "saga_id", s.ID, "order_id", s.OrderID, "error", err)
+		}
+		return err
+	}
+	if s.Status != models.SagaCompensating {
+		metrics.SagasFinished.WithLabelValues(s.Status).Inc()
+	}
+	return nil
+}
+
+// pending returns the step s is waiting on: the payment once it was requested.
+func pending(s *models.Saga) string {
+	if n := len(s.Steps); n > 0 && s.Steps[n-1].Name == models.StepRequestPayment && s.Steps[n-1].Status == models.StepDone {
+		return models.StepAwaitPayment
+	}
+	return ""
+}
+
+// record appends the outcome of a step to s. why is empty for a step that
+// succeeded and the reason code otherwise.
+func record(s *models.Saga, name string, why string) {
+	step := models.SagaStep{Name: name, Status: models.StepDone, At: time.Now()}
+	if why != "" {
+		step.Status = models.StepFailed
+		step.Error = why
+	}
+	s.Steps = append(s.Steps, step)
+}
+
+// reason maps a step error to the reason code stored in the saga.
+func reason(err error) string {
+	switch {
+	case err == nil:
+		return ""
+	case errors.Is(err, context.DeadlineExceeded):
+		return models.ReasonTimeout
+	case errors.Is(err, inventory.ErrInsufficientStock):
+		return models.ReasonInsufficientStock
+	default:
+		return models.ReasonStepFailed
+	}
+}
@@ -0,0 +1,75 @@
+package saga
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"orders/internal/inventory"
+	"orders/internal/models"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+func TestReserveHoldsStockUntilPaymentTimeout(t *testing.T) {
+	// The products service holds stock for 15 minutes unless asked otherwise
+	const productsDefaultTTL = 15 * time.Minute
+	tests := []struct {
+		name           string
+		stepTimeout    time.Duration
+		paymentTimeout time.Duration
+	}{
+		{"default timeouts", 10 * time.Second, 10 * time.Minute},
+		{"payment timeout above the products default", 10 * time.Second, time.Hour},
+		{"fractional seconds", 1500 * time.Millisecond, 20 * time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got struct {
+				OrderID    string           `json:"order_id"`
+				Items      []inventory.Item `json:"items"`
+				TTLSeconds int64            `json:"ttl_seconds"`
+			}
+			products := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != http.MethodPost || r.URL.Path != "/reservations" {
+					t.Errorf("request %s %s", r.Method, r.URL.Path)
+				}
+				if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+					t.Errorf("decoding reservation request: %v", err)
+				}
+				w.WriteHeader(http.StatusCreated)
+				json.NewEncoder(w).Encode(inventory.Reservation{ID: "r1", OrderID: got.OrderID, Status: "pending"})
+			}))
+			defer products.Close()
+
+			o := &Orchestrator{
+				Inventory:      inventory.NewClient(products.URL, oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "t"})),
+				StepTimeout:    tt.stepTimeout,
+				PaymentTimeout: tt.paymentTimeout,
+			}
+			order := &models.Order{ID: "o1"}
+			s := &models.Saga{OrderID: "o1"}
+			if err := o.reserve(t.Context(), s, order, []inventory.Item{{ProductID: "p1", Quantity: 2}}); err != nil {
+				t.Fatalf("reserve: %v", err)
+			}
+			if order.ReservationID != "r1" || s.ReservationID != "r1" {
+				t.Errorf("reservation IDs = %q, %q, want r1", order.ReservationID, s.ReservationID)
+			}
+			if got.OrderID != "o1" || len(got.Items) != 1 {
+				t.Errorf("request = %+v", got)
+			}
+			// The payment deadline starts after the two steps that follow the reservation
+			held := time.Duration(got.TTLSeconds) * time.Second
+			if min := 2*tt.stepTimeout + tt.paymentTimeout; held <= min {
+				t.Errorf("ttl_seconds = %d, want more than %s", got.TTLSeconds, min)
+			}
+			if held <= productsDefaultTTL && tt.paymentTimeout >= productsDefaultTTL {
+				t.Errorf("ttl_seconds = %d falls back to the products default", got.TTLSeconds)
+			}
+			if held > inventory.MaxReservationTTL {
+				t.Errorf("ttl_seconds = %d exceeds the products maximum", got.TTLSeconds)
+			}
+		})
+	}
+}
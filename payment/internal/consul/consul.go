@@ -2,28 +2,25 @@ package consul
 
 import (
 	"fmt"
-	"log"
-	"os"
+	"log/slog"
 
 	consulapi "github.com/hashicorp/consul/api"
 )
 
-func RegisterWithConsul(serviceName string, servicePort int) {
-	consulAddr := os.Getenv("SERVICE_DISCOVERY")
-	if consulAddr == "" {
-		consulAddr = "localhost:8500"
-	}
+// RegisterWithConsul registers the service with the Consul agent at consulAddr.
+// Outside gcp the registration includes an HTTP check against /readyz.
+func RegisterWithConsul(consulAddr string, gcp bool, serviceName string, servicePort int) {
 	config := consulapi.DefaultConfig()
 	config.Address = consulAddr
 
 	client, err := consulapi.NewClient(config)
 	if err != nil {
-		log.Printf("Consul client error: %v", err)
+		slog.Error("Consul client error", "error", err)
 		return
 	}
 
 	var registration *consulapi.AgentServiceRegistration
-	if os.Getenv("DEPLOY_ENV") == "gcp" {
+	if gcp {
 		registration = &consulapi.AgentServiceRegistration{
 			Name:    serviceName,
 			Address: serviceName,
@@ -35,16 +32,16 @@ func RegisterWithConsul(serviceName string, servicePort int) {
 			Address: serviceName,
 			Port:    servicePort,
 			Check: &consulapi.AgentServiceCheck{
-				HTTP:     fmt.Sprintf("http://%s:%d/health", serviceName, servicePort),
+				HTTP:     fmt.Sprintf("http://%s:%d/readyz", serviceName, servicePort),
 				Interval: "10s",
-				Timeout:  "1s",
+				Timeout:  "3s",
 			},
 		}
 	}
 	err = client.Agent().ServiceRegister(registration)
 	if err != nil {
-		log.Printf("Consul registration failed: %v", err)
+		slog.Error("Consul registration failed", "service", serviceName, "error", err)
 	} else {
-		log.Printf("Registered with Consul: %s", serviceName)
+		slog.Info("Registered with Consul", "service", serviceName)
 	}
 }
@@ -1,18 +1,37 @@
 package db
 
 import (
+	"context"
 	"database/sql"
 	"payment/internal/models"
+	"shared/tracing"
+	"time"
 
+	"github.com/lib/pq"
 	_ "github.com/lib/pq"
 )
 
+// paymentColumns is the column list read by scanPayment.
+const paymentColumns = "transaction_id, order_id, status, amount, currency, created_at, deleted_at, deleted_by"
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanPayment(row rowScanner) (*models.Payment, error) {
+	var p models.Payment
+	if err := row.Scan(&p.TransactionID, &p.OrderID, &p.Status, &p.Amount.Amount, &p.Amount.Currency, &p.CreatedAt, &p.DeletedAt, &p.DeletedBy); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
 type DB struct {
 	Conn *sql.DB
 }
 
 func NewDB(dbURL string) (*DB, error) {
-	conn, err := sql.Open("postgres", dbURL)
+	conn, err := tracing.OpenDB("postgres", dbURL)
 	if err != nil {
 		return nil, err
 	}
@@ -22,6 +41,11 @@ func NewDB(dbURL string) (*DB, error) {
 	return &DB{Conn: conn}, nil
 }
 
+// Ping checks that the database is reachable.
+func (db *DB) Ping(ctx context.Context) error {
+	return db.Conn.PingContext(ctx)
+}
+
 // Add method to ensure Payments table exists
 func (db *DB) EnsurePaymentsTable() error {
 	_, err := db.Conn.Exec(`CREATE TABLE IF NOT EXISTS payments (
@@ -31,38 +55,151 @@ func (db *DB) EnsurePaymentsTable() error {
 		amount INT,
 		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 	)`)
+	if err != nil {
+		return err
+	}
+	// amount holds minor units of currency
+	_, err = db.Conn.Exec(`
+	ALTER TABLE payments
+		ALTER COLUMN amount TYPE BIGINT,
+		ADD COLUMN IF NOT EXISTS currency CHAR(3) NOT NULL DEFAULT 'USD',
+		ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMPTZ,
+		ADD COLUMN IF NOT EXISTS deleted_by TEXT NOT NULL DEFAULT ''`)
+	if err != nil {
+		return err
+	}
+	_, err = db.Conn.Exec(`CREATE INDEX IF NOT EXISTS payments_order_id_idx ON payments (order_id)`)
 	return err
 }
 
-func (db *DB) GetPayments() ([]models.Payment, error) {
-	rows, err := db.Conn.Query("SELECT transaction_id, order_id, status, amount, created_at FROM payments ORDER BY created_at DESC")
+// GetPayments lists the payments, newest first, optionally only those of one
+// order. Soft-deleted payments are only included if includeDeleted is set.
+func (db *DB) GetPayments(ctx context.Context, orderID string, includeDeleted bool) ([]models.Payment, error) {
+	query := "SELECT " + paymentColumns + " FROM payments WHERE TRUE"
+	var args []interface{}
+	if orderID != "" {
+		args = append(args, orderID)
+		query += " AND order_id = $1"
+	}
+	if !includeDeleted {
+		query += " AND deleted_at IS NULL"
+	}
+	rows, err := db.Conn.QueryContext(ctx, query+" ORDER BY created_at DESC", args...)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
-	var payments []models.Payment
+	payments := []models.Payment{}
 	for rows.Next() {
-		var p models.Payment
-		if err := rows.Scan(&p.TransactionID, &p.OrderID, &p.Status, &p.Amount, &p.CreatedAt); err == nil {
-			payments = append(payments, p)
+		p, err := scanPayment(rows)
+		if err != nil {
+			return nil, err
 		}
+		payments = append(payments, *p)
+	}
+	return payments, rows.Err()
+}
+
+// GetPaymentByID retrieves a payment by its transaction ID, or nil if there is
+// none. Soft-deleted payments are only returned if includeDeleted is set.
+func (db *DB) GetPaymentByID(ctx context.Context, transactionID string, includeDeleted bool) (*models.Payment, error) {
+	query := "SELECT " + paymentColumns + " FROM payments WHERE transaction_id = $1"
+	if !includeDeleted {
+		query += " AND deleted_at IS NULL"
+	}
+	p, err := scanPayment(db.Conn.QueryRowContext(ctx, query, transactionID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return p, err
+}
+
+// DeletePayments soft-deletes the payments with the given transaction IDs,
+// recording who deleted them. Payments that are already deleted are left unchanged.
+func (db *DB) DeletePayments(ctx context.Context, ids []string, deletedBy string) (int64, error) {
+	query := "UPDATE payments SET deleted_at = now(), deleted_by = $2 WHERE transaction_id = ANY($1) AND deleted_at IS NULL"
+	res, err := db.Conn.ExecContext(ctx, query, pq.Array(ids), deletedBy)
+	if err != nil {
+		return 0, err
 	}
-	return payments, nil
+	return res.RowsAffected()
 }
 
-func (db *DB) DeletePayments(ids []string) (int64, error) {
-	query := "DELETE FROM payments WHERE transaction_id = ANY($1)"
-	res, err := db.Conn.Exec(query, ids)
+// RestorePayments undoes the soft deletion of the payments with the given transaction IDs.
+func (db *DB) RestorePayments(ctx context.Context, ids []string) (int64, error) {
+	query := "UPDATE payments SET deleted_at = NULL, deleted_by = '' WHERE transaction_id = ANY($1) AND deleted_at IS NOT NULL"
+	res, err := db.Conn.ExecContext(ctx, query, pq.Array(ids))
 	if err != nil {
 		return 0, err
 	}
 	return res.RowsAffected()
 }
 
-func (db *DB) InsertPayment(p models.Payment) error {
-	_, err := db.Conn.Exec(
-		"INSERT INTO payments (transaction_id, order_id, status, amount, created_at) VALUES ($1, $2, $3, $4, $5)",
-		p.TransactionID, p.OrderID, p.Status, p.Amount, p.CreatedAt,
+// PurgeDeletedPayments permanently removes payments soft-deleted before the
+// given time and returns their transaction IDs.
+func (db *DB) PurgeDeletedPayments(ctx context.Context, before time.Time) ([]string, error) {
+	rows, err := db.Conn.QueryContext(ctx, "DELETE FROM payments WHERE deleted_at < $1 RETURNING transaction_id", before)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// ClaimPayment makes p, a pending payment, the one payment of its order,
+// so an order is charged at most once however often its event is delivered.
+// If the order already has a payment, that payment is returned instead and
+// claimed is false, unless it is still pending after staleAfter: then the
+// charge that held it is presumed dead and the caller takes it over with the
+// same transaction ID.
+func (db *DB) ClaimPayment(ctx context.Context, p models.Payment, staleAfter time.Duration) (_ models.Payment, claimed bool, err error) {
+	tx, err := db.Conn.BeginTx(ctx, nil)
+	if err != nil {
+		return p, false, err
+	}
+	defer tx.Rollback()
+	// Serializes claims for the order, including while it has no payment yet
+	if _, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock(hashtext($1))", p.OrderID); err != nil {
+		return p, false, err
+	}
+	existing, err := scanPayment(tx.QueryRowContext(ctx,
+		"SELECT "+paymentColumns+" FROM payments WHERE order_id = $1 ORDER BY created_at DESC LIMIT 1",
+		p.OrderID,
+	))
+	switch {
+	case err == sql.ErrNoRows:
+		_, err = tx.ExecContext(ctx,
+			"INSERT INTO payments (transaction_id, order_id, status, amount, currency, created_at) VALUES ($1, $2, $3, $4, $5, $6)",
+			p.TransactionID, p.OrderID, p.Status, p.Amount.Amount, p.Amount.Currency, p.CreatedAt,
+		)
+	case err != nil:
+		return p, false, err
+	case existing.Status == models.StatusPending && existing.CreatedAt.Before(p.CreatedAt.Add(-staleAfter)):
+		p = *existing
+		p.CreatedAt = time.Now()
+		_, err = tx.ExecContext(ctx, "UPDATE payments SET created_at = $1 WHERE transaction_id = $2", p.CreatedAt, p.TransactionID)
+	default:
+		return *existing, false, nil
+	}
+	if err != nil {
+		return p, false, err
+	}
+	return p, true, tx.Commit()
+}
+
+// FinishPayment sets the final status of a pending payment.
+func (db *DB) FinishPayment(ctx context.Context, transactionID, status string) error {
+	_, err := db.Conn.ExecContext(ctx,
+		"UPDATE payments SET status = $1 WHERE transaction_id = $2 AND status = $3",
+		status, transactionID, models.StatusPending,
 	)
 	return err
 }
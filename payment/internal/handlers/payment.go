@@ -4,37 +4,110 @@ import (
 	"encoding/json"
 	"net/http"
 	"payment/internal/db"
+	"shared/admin"
+	"shared/audit"
+	"shared/problem"
+	"shared/validate"
+	"strconv"
+	"strings"
 )
 
 type PaymentHandler struct {
-	DB *db.DB
+	DB    *db.DB
+	Audit *audit.Log
 }
 
+// GetPayments handles GET /payments?order_id=, listing every payment or the
+// payment history of one order. Admins can add ?include_deleted=true to see
+// soft-deleted payments too.
 func (h *PaymentHandler) GetPayments(w http.ResponseWriter, r *http.Request) {
-	payments, err := h.DB.GetPayments()
+	include, ok := includeDeleted(w, r)
+	if !ok {
+		return
+	}
+	orderID := r.URL.Query().Get("order_id")
+	if len(orderID) > 64 {
+		problem.Validation(w, r, []problem.FieldError{{Field: "order_id", Code: "max", Message: "order_id must be at most 64 characters"}})
+		return
+	}
+	payments, err := h.DB.GetPayments(r.Context(), orderID, include)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		problem.Internal(w, r, err)
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(payments)
 }
 
+// GetPaymentByID handles GET /payments/{transaction_id}.
+func (h *PaymentHandler) GetPaymentByID(w http.ResponseWriter, r *http.Request) {
+	include, ok := includeDeleted(w, r)
+	if !ok {
+		return
+	}
+	payment, err := h.DB.GetPaymentByID(r.Context(), r.PathValue("transaction_id"), include)
+	if err != nil {
+		problem.Internal(w, r, err)
+		return
+	}
+	if payment == nil {
+		problem.Write(w, r, http.StatusNotFound, problem.CodePaymentNotFound, "Payment not found.")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(payment)
+}
+
 func (h *PaymentHandler) DeletePayments(w http.ResponseWriter, r *http.Request) {
 	var req struct {
-		IDs []string `json:"ids"`
+		IDs []string `json:"ids" validate:"required,max=1000,dive,required"`
 	}
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.IDs) == 0 {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("Invalid or missing IDs"))
+	if !validate.DecodeJSON(w, r, &req) {
 		return
 	}
-	deleted, err := h.DB.DeletePayments(req.IDs)
+	deleted, err := h.DB.DeletePayments(r.Context(), req.IDs, audit.Actor(r.Context()))
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("Failed to delete payments"))
+		problem.Internal(w, r, err)
 		return
 	}
+	h.Audit.Record(r, audit.Event{Action: "payments.delete", Target: strings.Join(req.IDs, ","), Outcome: audit.OutcomeSuccess})
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{"deleted": deleted})
 }
+
+// RestorePayments handles POST /payments/restore with an array of transaction
+// ids, undoing their soft deletion.
+func (h *PaymentHandler) RestorePayments(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		IDs []string `json:"ids" validate:"required,max=1000,dive,required"`
+	}
+	if !validate.DecodeJSON(w, r, &req) {
+		return
+	}
+	restored, err := h.DB.RestorePayments(r.Context(), req.IDs)
+	if err != nil {
+		problem.Internal(w, r, err)
+		return
+	}
+	h.Audit.Record(r, audit.Event{Action: "payments.restore", Target: strings.Join(req.IDs, ","), Outcome: audit.OutcomeSuccess})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"restored": restored})
+}
+
+// includeDeleted reads the include_deleted query parameter, which only admins may set.
+func includeDeleted(w http.ResponseWriter, r *http.Request) (include, ok bool) {
+	v := r.URL.Query().Get("include_deleted")
+	if v == "" {
+		return false, true
+	}
+	include, err := strconv.ParseBool(v)
+	if err != nil {
+		problem.Validation(w, r, []problem.FieldError{{Field: "include_deleted", Code: "format", Message: "include_deleted must be true or false"}})
+		return false, false
+	}
+	if include && !admin.Is(r) {
+		problem.Write(w, r, http.StatusForbidden, problem.CodeForbidden, "Only administrators can list deleted records.")
+		return false, false
+	}
+	return include, true
+}
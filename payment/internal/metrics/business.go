@@ -0,0 +1,12 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// PaymentsProcessed counts processed payments by status (paid or failed).
+var PaymentsProcessed = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "payments_processed_total",
+	Help: "Payments processed, by status.",
+}, []string{"status"})
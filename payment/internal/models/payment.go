@@ -1,11 +1,24 @@
 package models
 
-import "time"
+import (
+	"shared/money"
+	"time"
+)
+
+// Payment statuses. A payment is pending while the provider charges it.
+const (
+	StatusPending = "pending"
+	StatusPaid    = "paid"
+	StatusFailed  = "failed"
+)
 
 type Payment struct {
-	TransactionID string    `json:"transaction_id"`
-	OrderID       string    `json:"order_id"`
-	Status        string    `json:"status"`
-	Amount        int       `json:"amount"`
-	CreatedAt     time.Time `json:"created_at"`
+	TransactionID string      `json:"transaction_id"`
+	OrderID       string      `json:"order_id"`
+	Status        string      `json:"status"`
+	Amount        money.Money `json:"amount"`
+	CreatedAt     time.Time   `json:"created_at"`
+	// DeletedAt and DeletedBy are set while the payment is soft-deleted.
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+	DeletedBy string     `json:"deleted_by,omitempty"`
 }
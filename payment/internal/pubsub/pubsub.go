@@ -3,31 +3,50 @@ package pubsub
 import (
 	"context"
 	"encoding/json"
-	"log"
+	"errors"
+	"fmt"
+	"log/slog"
 	"os"
+	"sync/atomic"
 	"time"
 
+	"payment/internal/config"
 	"payment/internal/db"
+	paymentmetrics "payment/internal/metrics"
 	"payment/internal/models"
+	"shared/metrics"
+	"shared/money"
+	"shared/requestid"
+	"shared/tracing"
 
 	"cloud.google.com/go/pubsub"
 	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// chargeTimeout is how long a payment may stay pending before its charge is
+// presumed dead and the next delivery of the order event takes it over.
+const chargeTimeout = time.Minute
+
 type PubSub struct {
 	Client        *pubsub.Client
 	PaymentsTopic *pubsub.Topic
 	OrderTopic    *pubsub.Topic
 	OrderSub      *pubsub.Subscription
 	DB            *db.DB
+
+	// receiving is set while the subscription receive loop is running
+	receiving atomic.Bool
 }
 
 func NewClient(ctx context.Context, projectID string) (*pubsub.Client, error) {
 	return pubsub.NewClient(ctx, projectID)
 }
 
-func SetupPubSub(ctx context.Context, projectID string, dbInstance *db.DB) (*PubSub, error) {
-	client, err := NewClient(ctx, projectID)
+func SetupPubSub(ctx context.Context, cfg config.PubSub, dbInstance *db.DB) (*PubSub, error) {
+	client, err := NewClient(ctx, cfg.ProjectID)
 	if err != nil {
 		return nil, err
 	}
@@ -37,7 +56,7 @@ func SetupPubSub(ctx context.Context, projectID string, dbInstance *db.DB) (*Pub
 		DB:     dbInstance,
 	}
 
-	if err := ps.EnsureTopicAndSubscription(ctx); err != nil {
+	if err := ps.EnsureTopicAndSubscription(ctx, cfg); err != nil {
 		return nil, err
 	}
 
@@ -55,7 +74,7 @@ func EnsureTopic(ctx context.Context, client *pubsub.Client, topicName string) (
 		if err != nil {
 			return nil, err
 		}
-		log.Printf("Created Pub/Sub topic: %s", topicName)
+		slog.Info("Created Pub/Sub topic", "topic", topicName)
 	}
 	return topic, nil
 }
@@ -73,80 +92,174 @@ func EnsureSubscription(ctx context.Context, client *pubsub.Client, subName, top
 		if err != nil {
 			return nil, err
 		}
-		log.Printf("Created Pub/Sub subscription: %s", subName)
+		slog.Info("Created Pub/Sub subscription", "subscription", subName)
 	}
 	return sub, nil
 }
 
-func (ps *PubSub) EnsureTopicAndSubscription(ctx context.Context) error {
-	topicName := os.Getenv("PUBSUB_ORDER_TOPIC")
-	if topicName == "" {
-		topicName = "orders"
-	}
-	subName := os.Getenv("PUBSUB_ORDER_SUBSCRIPTION")
-	if subName == "" {
-		subName = "orders-sub"
-	}
-	paymentsTopicName := os.Getenv("PUBSUB_PAYMENT_TOPIC")
-	if paymentsTopicName == "" {
-		paymentsTopicName = "payment"
-	}
-	ps.PaymentsTopic = ps.Client.Topic(paymentsTopicName)
-	ps.OrderTopic = ps.Client.Topic(topicName)
-	ps.OrderSub = ps.Client.Subscription(subName)
+func (ps *PubSub) EnsureTopicAndSubscription(ctx context.Context, cfg config.PubSub) error {
 	var err error
-	ps.PaymentsTopic, err = EnsureTopic(ctx, ps.Client, paymentsTopicName)
+	ps.PaymentsTopic, err = EnsureTopic(ctx, ps.Client, cfg.PaymentTopic)
 	if err != nil {
 		return err
 	}
-	ps.OrderTopic, err = EnsureTopic(ctx, ps.Client, topicName)
+	ps.OrderTopic, err = EnsureTopic(ctx, ps.Client, cfg.OrderTopic)
 	if err != nil {
 		return err
 	}
-	ps.OrderSub, err = EnsureSubscription(ctx, ps.Client, subName, topicName)
+	ps.OrderSub, err = EnsureSubscription(ctx, ps.Client, cfg.OrderSubscription, cfg.OrderTopic)
 	return err
 }
 
 func (ps *PubSub) ListenForOrderEvents(ctx context.Context) {
-	err := ps.OrderSub.Receive(ctx, func(ctx context.Context, msg *pubsub.Message) {
+	err := ps.receive(ctx, ps.OrderSub, func(ctx context.Context, msg *pubsub.Message) bool {
 		var orderEvent struct {
-			OrderID string `json:"id"`
-			Amount  int    `json:"amount"`
+			OrderID string      `json:"id"`
+			Amount  money.Money `json:"amount"`
 		}
 		if err := json.Unmarshal(msg.Data, &orderEvent); err != nil {
-			log.Printf("Invalid order event: %v", err)
-			msg.Nack()
-			return
+			slog.ErrorContext(ctx, "Invalid order event", "message_id", msg.ID, "error", err)
+			return false
 		}
-		log.Printf("Received order event: %+v", orderEvent)
-		time.Sleep(2 * time.Second)
-		payment := models.Payment{
+		slog.InfoContext(ctx, "Received order event", "order_id", orderEvent.OrderID, "amount", orderEvent.Amount.String())
+		// Redelivered and republished order events find the payment already claimed
+		payment, claimed, err := ps.DB.ClaimPayment(ctx, models.Payment{
 			TransactionID: uuid.NewString(),
 			OrderID:       orderEvent.OrderID,
-			Status:        "paid",
+			Status:        models.StatusPending,
 			Amount:        orderEvent.Amount,
 			CreatedAt:     time.Now(),
+		}, chargeTimeout)
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to claim payment", "order_id", orderEvent.OrderID, "error", err)
+			return false
 		}
-		if err := ps.DB.InsertPayment(payment); err != nil {
-			log.Printf("Failed to insert payment: %v", err)
-		} else {
-			log.Printf("Payment processed and stored: %+v", payment)
+		if !claimed {
+			if payment.Status == models.StatusPending {
+				slog.InfoContext(ctx, "Payment is still being charged", "order_id", payment.OrderID, "transaction_id", payment.TransactionID)
+				return false
+			}
+			// The first payment event may have been lost, so send it again
+			slog.InfoContext(ctx, "Order already charged", "order_id", payment.OrderID, "transaction_id", payment.TransactionID, "status", payment.Status)
+			ps.publishPayment(ctx, payment)
+			return true
 		}
-		paymentEvent, err := json.Marshal(payment)
+		// Simulated call to the payment provider, which takes the transaction
+		// ID as idempotency key so a charge taken over after a crash is not doubled
+		_, span := tracing.Tracer().Start(ctx, "charge payment")
+		time.Sleep(2 * time.Second)
+		span.End()
+		payment.Status = models.StatusPaid
+		// Only charge amounts in a supported currency; anything else fails the payment
+		if err := payment.Amount.Validate(); err != nil || payment.Amount.Amount <= 0 {
+			slog.WarnContext(ctx, "Rejecting payment", "order_id", payment.OrderID, "amount", payment.Amount.String(), "error", err)
+			payment.Status = models.StatusFailed
+		}
+		if err := ps.DB.FinishPayment(ctx, payment.TransactionID, payment.Status); err != nil {
+			slog.ErrorContext(ctx, "Failed to store payment", "order_id", payment.OrderID, "transaction_id", payment.TransactionID, "error", err)
+			return false
+		}
+		paymentmetrics.PaymentsProcessed.WithLabelValues(payment.Status).Inc()
+		slog.InfoContext(ctx, "Payment processed and stored", "order_id", payment.OrderID, "transaction_id", payment.TransactionID, "status", payment.Status)
+		ps.publishPayment(ctx, payment)
+		return true
+	})
+	if err != nil {
+		slog.Error("Error receiving order events", "error", err)
+		os.Exit(1)
+	}
+}
+
+// publishPayment sends the payment event for payment. Failures are logged;
+// the reconciler finds orders whose payment event was lost.
+func (ps *PubSub) publishPayment(ctx context.Context, payment models.Payment) {
+	paymentEvent, err := json.Marshal(payment)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to marshal payment event", "order_id", payment.OrderID, "error", err)
+		return
+	}
+	if err := publish(ctx, ps.PaymentsTopic, &pubsub.Message{Data: paymentEvent, Attributes: requestid.Attributes(ctx)}); err != nil {
+		slog.ErrorContext(ctx, "Failed to publish payment event", "order_id", payment.OrderID, "error", err)
+		return
+	}
+	slog.InfoContext(ctx, "Published payment event", "order_id", payment.OrderID, "status", payment.Status)
+}
+
+// CheckReceiving reports an error unless the subscription receive loop is running.
+func (ps *PubSub) CheckReceiving(ctx context.Context) error {
+	if !ps.receiving.Load() {
+		return errors.New("subscription receive loop is not running")
+	}
+	return nil
+}
+
+// CheckTopics reports an error unless every topic and subscription the service uses exists.
+func (ps *PubSub) CheckTopics(ctx context.Context) error {
+	for _, topic := range []*pubsub.Topic{ps.PaymentsTopic, ps.OrderTopic} {
+		exists, err := topic.Exists(ctx)
 		if err != nil {
-			log.Printf("Failed to marshal payment event: %v", err)
+			return err
+		}
+		if !exists {
+			return fmt.Errorf("topic %s does not exist", topic.ID())
+		}
+	}
+	exists, err := ps.OrderSub.Exists(ctx)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("subscription %s does not exist", ps.OrderSub.ID())
+	}
+	return nil
+}
+
+// receive handles the messages of sub until ctx is done. handle runs in a
+// consumer span continuing the publisher's trace, with the publisher's
+// correlation ID in its context, and reports whether the message should be
+// acked; receive settles the message and records Pub/Sub metrics.
+func (ps *PubSub) receive(ctx context.Context, sub *pubsub.Subscription, handle func(context.Context, *pubsub.Message) bool) error {
+	ps.receiving.Store(true)
+	defer ps.receiving.Store(false)
+	return sub.Receive(ctx, func(ctx context.Context, msg *pubsub.Message) {
+		start := time.Now()
+		metrics.ObserveReceived(sub.ID())
+		ctx = tracing.Extract(requestid.FromAttributes(ctx, msg.Attributes), msg.Attributes)
+		ctx, span := tracing.Tracer().Start(ctx, sub.ID()+" receive",
+			trace.WithSpanKind(trace.SpanKindConsumer),
+			trace.WithAttributes(tracing.MessagingAttributes(sub.ID())...),
+			trace.WithAttributes(semconv.MessagingMessageID(msg.ID)),
+		)
+		defer span.End()
+		acked := handle(ctx, msg)
+		if acked {
+			msg.Ack()
 		} else {
-			result := ps.PaymentsTopic.Publish(ctx, &pubsub.Message{Data: paymentEvent})
-			_, pubErr := result.Get(ctx)
-			if pubErr != nil {
-				log.Printf("Failed to publish payment event: %v", pubErr)
-			} else {
-				log.Printf("Published payment event for order %s", payment.OrderID)
-			}
+			msg.Nack()
+			span.SetStatus(codes.Error, "message nacked")
 		}
-		msg.Ack()
+		metrics.ObserveHandled(sub.ID(), start, acked)
 	})
+}
+
+// publish sends msg to topic in a producer span, waits until the server
+// accepts it and records the result. The trace context is added to the
+// message attributes so consumers continue the trace.
+func publish(ctx context.Context, topic *pubsub.Topic, msg *pubsub.Message) error {
+	ctx, span := tracing.Tracer().Start(ctx, topic.ID()+" publish",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(tracing.MessagingAttributes(topic.ID())...),
+	)
+	defer span.End()
+	if msg.Attributes == nil {
+		msg.Attributes = map[string]string{}
+	}
+	tracing.Inject(ctx, msg.Attributes)
+	_, err := topic.Publish(ctx, msg).Get(ctx)
+	metrics.ObservePublish(topic.ID(), err)
 	if err != nil {
-		log.Fatalf("Error receiving messages: %v", err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
 	}
+	return err
 }
@@ -0,0 +1,135 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"products/internal/models"
+
+	"github.com/google/uuid"
+)
+
+// ImportOutcome is the result of writing one imported product.
+type ImportOutcome struct {
+	Product  models.Product
+	Previous *models.Product // nil when the product was created
+}
+
+// Importer writes the batches of one import. A real import commits every
+// batch in its own transaction. A dry run writes all batches into a single
+// transaction that Close rolls back, so later rows see what earlier rows
+// would have done, just like in a real import.
+type Importer struct {
+	db     *DB
+	dryRun *sql.Tx
+}
+
+// NewImporter starts an import. The caller must Close it.
+func (db *DB) NewImporter(ctx context.Context, dryRun bool) (*Importer, error) {
+	im := &Importer{db: db}
+	if dryRun {
+		tx, err := db.Conn.BeginTx(ctx, nil)
+		if err != nil {
+			return nil, err
+		}
+		im.dryRun = tx
+	}
+	return im, nil
+}
+
+// UpsertBySKU inserts or updates every product keyed by its SKU as one
+// batch, which is written entirely or not at all. Importing the SKU of a
+// soft-deleted product restores it.
+func (im *Importer) UpsertBySKU(ctx context.Context, products []models.Product) ([]ImportOutcome, error) {
+	if im.dryRun == nil {
+		tx, err := im.db.Conn.BeginTx(ctx, nil)
+		if err != nil {
+			return nil, err
+		}
+		defer tx.Rollback()
+		outcomes, err := upsertBySKU(ctx, tx, products)
+		if err != nil {
+			return nil, err
+		}
+		if err := tx.Commit(); err != nil {
+			return nil, err
+		}
+		return outcomes, nil
+	}
+
+	// A savepoint undoes a failed batch without losing the batches before it
+	if _, err := im.dryRun.ExecContext(ctx, "SAVEPOINT import_batch"); err != nil {
+		return nil, err
+	}
+	outcomes, err := upsertBySKU(ctx, im.dryRun, products)
+	if err != nil {
+		if _, rbErr := im.dryRun.ExecContext(ctx, "ROLLBACK TO SAVEPOINT import_batch"); rbErr != nil {
+			return nil, errors.Join(err, rbErr)
+		}
+		return nil, err
+	}
+	if _, err := im.dryRun.ExecContext(ctx, "RELEASE SAVEPOINT import_batch"); err != nil {
+		return nil, err
+	}
+	return outcomes, nil
+}
+
+// Close ends the import, rolling back everything a dry run wrote.
+func (im *Importer) Close() error {
+	if im.dryRun == nil {
+		return nil
+	}
+	return im.dryRun.Rollback()
+}
+
+func upsertBySKU(ctx context.Context, tx *sql.Tx, products []models.Product) ([]ImportOutcome, error) {
+	outcomes := make([]ImportOutcome, 0, len(products))
+	for _, p := range products {
+		existing, err := scanProduct(tx.QueryRowContext(ctx, "SELECT "+productColumns+" FROM products WHERE sku = $1 FOR UPDATE", p.SKU))
+		switch {
+		case err == sql.ErrNoRows:
+			p.ID = uuid.NewString()
+			err = tx.QueryRowContext(ctx,
+				"INSERT INTO products (id, sku, name, description, category, price, currency) VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING version",
+				p.ID, p.SKU, p.Name, p.Description, p.Category, p.Price.Amount, p.Price.Currency,
+			).Scan(&p.Version)
+			if err != nil {
+				return nil, err
+			}
+			outcomes = append(outcomes, ImportOutcome{Product: p})
+		case err != nil:
+			return nil, err
+		default:
+			p.ID = existing.ID
+			err = tx.QueryRowContext(ctx,
+				"UPDATE products SET name = $1, description = $2, category = $3, price = $4, currency = $5, version = version + 1, deleted_at = NULL, deleted_by = '' WHERE id = $6 RETURNING version",
+				p.Name, p.Description, p.Category, p.Price.Amount, p.Price.Currency, p.ID,
+			).Scan(&p.Version)
+			if err != nil {
+				return nil, err
+			}
+			outcomes = append(outcomes, ImportOutcome{Product: p, Previous: existing})
+		}
+	}
+	return outcomes, nil
+}
+
+// EachProduct streams the catalogue ordered by SKU and ID, calling fn for
+// every product that is not soft-deleted.
+func (db *DB) EachProduct(ctx context.Context, fn func(models.Product) error) error {
+	rows, err := db.Conn.QueryContext(ctx, "SELECT "+productColumns+" FROM products WHERE deleted_at IS NULL ORDER BY sku, id")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		p, err := scanProduct(rows)
+		if err != nil {
+			return err
+		}
+		if err := fn(*p); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
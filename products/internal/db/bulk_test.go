@@ -0,0 +1,184 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"products/internal/models"
+	"reflect"
+	"shared/money"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// recorder is a database/sql driver that logs the statements it receives.
+// Product lookups find nothing, inserts return version 1, and an insert of
+// the SKU in fail returns an error.
+type recorder struct {
+	fail string
+
+	mu  sync.Mutex
+	log []string
+}
+
+func (rec *recorder) Connect(context.Context) (driver.Conn, error) { return &recorderConn{rec}, nil }
+func (rec *recorder) Driver() driver.Driver                        { return nil }
+
+func (rec *recorder) add(stmt string) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.log = append(rec.log, stmt)
+}
+
+type recorderConn struct{ rec *recorder }
+
+func (c *recorderConn) Prepare(string) (driver.Stmt, error) { return nil, errors.New("not supported") }
+func (c *recorderConn) Close() error                        { return nil }
+func (c *recorderConn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+func (c *recorderConn) BeginTx(context.Context, driver.TxOptions) (driver.Tx, error) {
+	c.rec.add("BEGIN")
+	return c, nil
+}
+
+func (c *recorderConn) Commit() error   { c.rec.add("COMMIT"); return nil }
+func (c *recorderConn) Rollback() error { c.rec.add("ROLLBACK"); return nil }
+
+func (c *recorderConn) ExecContext(_ context.Context, query string, _ []driver.NamedValue) (driver.Result, error) {
+	c.rec.add(query)
+	return driver.RowsAffected(1), nil
+}
+
+func (c *recorderConn) QueryContext(_ context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	verb, _, _ := strings.Cut(query, " ")
+	switch verb {
+	case "SELECT":
+		c.rec.add("SELECT " + args[0].Value.(string))
+		return &recorderRows{}, nil
+	case "INSERT":
+		// The SKU follows the ID
+		c.rec.add("INSERT " + args[1].Value.(string))
+		if args[1].Value == c.rec.fail {
+			return nil, errors.New("insert failed")
+		}
+		return &recorderRows{values: []driver.Value{int64(1)}}, nil
+	}
+	return nil, errors.New("unexpected query " + query)
+}
+
+type recorderRows struct{ values []driver.Value }
+
+func (r *recorderRows) Columns() []string {
+	if r.values == nil {
+		return []string{"id"}
+	}
+	return []string{"version"}
+}
+
+func (r *recorderRows) Close() error { return nil }
+
+func (r *recorderRows) Next(dest []driver.Value) error {
+	if r.values == nil {
+		return io.EOF
+	}
+	copy(dest, r.values)
+	r.values = nil
+	return nil
+}
+
+func products(skus ...string) []models.Product {
+	ps := make([]models.Product, len(skus))
+	for i, sku := range skus {
+		ps[i] = models.Product{SKU: sku, Name: sku, Price: money.Money{Amount: 100, Currency: "USD"}}
+	}
+	return ps
+}
+
+func TestImporter(t *testing.T) {
+	tests := []struct {
+		name    string
+		dryRun  bool
+		batches [][]models.Product
+		wantErr []bool
+		want    []string
+	}{
+		{
+			name:    "import commits every batch",
+			batches: [][]models.Product{products("a", "b"), products("c")},
+			wantErr: []bool{false, false},
+			want: []string{
+				"BEGIN", "SELECT a", "INSERT a", "SELECT b", "INSERT b", "COMMIT",
+				"BEGIN", "SELECT c", "INSERT c", "COMMIT",
+			},
+		},
+		{
+			name:    "failed batch is rolled back",
+			batches: [][]models.Product{products("a", "fail"), products("c")},
+			wantErr: []bool{true, false},
+			want: []string{
+				"BEGIN", "SELECT a", "INSERT a", "SELECT fail", "INSERT fail", "ROLLBACK",
+				"BEGIN", "SELECT c", "INSERT c", "COMMIT",
+			},
+		},
+		{
+			name:    "dry run shares one transaction and rolls it back",
+			dryRun:  true,
+			batches: [][]models.Product{products("a", "b"), products("c")},
+			wantErr: []bool{false, false},
+			want: []string{
+				"BEGIN",
+				"SAVEPOINT import_batch", "SELECT a", "INSERT a", "SELECT b", "INSERT b", "RELEASE SAVEPOINT import_batch",
+				"SAVEPOINT import_batch", "SELECT c", "INSERT c", "RELEASE SAVEPOINT import_batch",
+				"ROLLBACK",
+			},
+		},
+		{
+			name:    "dry run undoes a failed batch to its savepoint",
+			dryRun:  true,
+			batches: [][]models.Product{products("a"), products("fail"), products("c")},
+			wantErr: []bool{false, true, false},
+			want: []string{
+				"BEGIN",
+				"SAVEPOINT import_batch", "SELECT a", "INSERT a", "RELEASE SAVEPOINT import_batch",
+				"SAVEPOINT import_batch", "SELECT fail", "INSERT fail", "ROLLBACK TO SAVEPOINT import_batch",
+				"SAVEPOINT import_batch", "SELECT c", "INSERT c", "RELEASE SAVEPOINT import_batch",
+				"ROLLBACK",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := &recorder{fail: "fail"}
+			conn := sql.OpenDB(rec)
+			defer conn.Close()
+			// A dry run holds its transaction's connection, so one is enough
+			conn.SetMaxOpenConns(1)
+			db := &DB{Conn: conn}
+
+			im, err := db.NewImporter(t.Context(), tt.dryRun)
+			if err != nil {
+				t.Fatalf("NewImporter: %v", err)
+			}
+			for i, batch := range tt.batches {
+				outcomes, err := im.UpsertBySKU(t.Context(), batch)
+				if (err != nil) != tt.wantErr[i] {
+					t.Fatalf("batch %d: UpsertBySKU error = %v, want error %v", i, err, tt.wantErr[i])
+				}
+				if err == nil && (len(outcomes) != len(batch) || outcomes[0].Previous != nil || outcomes[0].Product.ID == "") {
+					t.Errorf("batch %d: outcomes = %+v", i, outcomes)
+				}
+			}
+			if err := im.Close(); err != nil {
+				t.Fatalf("Close: %v", err)
+			}
+			if !reflect.DeepEqual(rec.log, tt.want) {
+				t.Errorf("statements:\n%s\nwant:\n%s", strings.Join(rec.log, "\n"), strings.Join(tt.want, "\n"))
+			}
+		})
+	}
+}
@@ -1,19 +1,45 @@
 package db
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"products/internal/models"
+	"shared/tracing"
+	"time"
 
 	"github.com/lib/pq"
 	_ "github.com/lib/pq"
 )
 
+var (
+	// ErrProductNotFound is returned when an update targets a product that does not exist.
+	ErrProductNotFound = errors.New("product not found")
+	// ErrVersionConflict is returned when an update was based on a stale product version.
+	ErrVersionConflict = errors.New("product version conflict")
+)
+
+// productColumns is the column list read by scanProduct.
+const productColumns = "id, sku, name, description, category, price, currency, version, deleted_at, deleted_by"
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanProduct(row rowScanner) (*models.Product, error) {
+	var p models.Product
+	if err := row.Scan(&p.ID, &p.SKU, &p.Name, &p.Description, &p.Category, &p.Price.Amount, &p.Price.Currency, &p.Version, &p.DeletedAt, &p.DeletedBy); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
 type DB struct {
 	Conn *sql.DB
 }
 
 func NewDB(dbURL string) (*DB, error) {
-	conn, err := sql.Open("postgres", dbURL)
+	conn, err := tracing.OpenDB("postgres", dbURL)
 	if err != nil {
 		return nil, err
 	}
@@ -23,46 +49,110 @@ func NewDB(dbURL string) (*DB, error) {
 	return &DB{Conn: conn}, nil
 }
 
-func (db *DB) CreateProduct(product models.Product) error {
-	_, err := db.Conn.Exec("INSERT INTO products (id, name, price) VALUES ($1, $2, $3)", product.ID, product.Name, product.Price)
+// Ping checks that the database is reachable.
+func (db *DB) Ping(ctx context.Context) error {
+	return db.Conn.PingContext(ctx)
+}
+
+func (db *DB) CreateProduct(ctx context.Context, product *models.Product) error {
+	return db.Conn.QueryRowContext(ctx,
+		"INSERT INTO products (id, sku, name, description, category, price, currency) VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING version",
+		product.ID, product.SKU, product.Name, product.Description, product.Category, product.Price.Amount, product.Price.Currency,
+	).Scan(&product.Version)
+}
+
+// SKUConstraint is the unique index violated by a duplicate SKU.
+const SKUConstraint = "products_sku_idx"
+
+// UpdateProduct replaces the mutable fields of a product if its stored version
+// still equals expectedVersion, bumping the version on success.
+func (db *DB) UpdateProduct(ctx context.Context, product *models.Product, expectedVersion int) error {
+	err := db.Conn.QueryRowContext(ctx,
+		"UPDATE products SET sku = $1, name = $2, description = $3, category = $4, price = $5, currency = $6, version = version + 1 WHERE id = $7 AND version = $8 AND deleted_at IS NULL RETURNING version",
+		product.SKU, product.Name, product.Description, product.Category, product.Price.Amount, product.Price.Currency, product.ID, expectedVersion,
+	).Scan(&product.Version)
+	if err == sql.ErrNoRows {
+		existing, getErr := db.GetProductByID(ctx, product.ID)
+		if getErr != nil {
+			return getErr
+		}
+		if existing == nil {
+			return ErrProductNotFound
+		}
+		return ErrVersionConflict
+	}
 	return err
 }
 
-func (db *DB) DeleteProducts(ids []string) (int64, error) {
-	query := "DELETE FROM products WHERE id = ANY($1)"
-	res, err := db.Conn.Exec(query, pq.Array(ids))
+// DeleteProducts soft-deletes the products with the given IDs, recording who
+// deleted them. Products that are already deleted are left unchanged.
+func (db *DB) DeleteProducts(ctx context.Context, ids []string, deletedBy string) (int64, error) {
+	query := "UPDATE products SET deleted_at = now(), deleted_by = $2 WHERE id = ANY($1) AND deleted_at IS NULL"
+	res, err := db.Conn.ExecContext(ctx, query, pq.Array(ids), deletedBy)
 	if err != nil {
 		return 0, err
 	}
 	return res.RowsAffected()
 }
 
-func (db *DB) GetAllProducts() ([]models.Product, error) {
-	rows, err := db.Conn.Query("SELECT id, name, price FROM products")
+// RestoreProducts undoes the soft deletion of the products with the given IDs.
+func (db *DB) RestoreProducts(ctx context.Context, ids []string) (int64, error) {
+	query := "UPDATE products SET deleted_at = NULL, deleted_by = '' WHERE id = ANY($1) AND deleted_at IS NOT NULL"
+	res, err := db.Conn.ExecContext(ctx, query, pq.Array(ids))
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// PurgeDeletedProducts permanently removes products soft-deleted before the
+// given time and returns their IDs.
+func (db *DB) PurgeDeletedProducts(ctx context.Context, before time.Time) ([]string, error) {
+	rows, err := db.Conn.QueryContext(ctx, "DELETE FROM products WHERE deleted_at < $1 RETURNING id", before)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// GetAllProducts lists the products, including soft-deleted ones if includeDeleted is set.
+func (db *DB) GetAllProducts(ctx context.Context, includeDeleted bool) ([]models.Product, error) {
+	query := "SELECT " + productColumns + " FROM products"
+	if !includeDeleted {
+		query += " WHERE deleted_at IS NULL"
+	}
+	rows, err := db.Conn.QueryContext(ctx, query)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 	var products []models.Product
 	for rows.Next() {
-		var p models.Product
-		if err := rows.Scan(&p.ID, &p.Name, &p.Price); err == nil {
-			products = append(products, p)
+		if p, err := scanProduct(rows); err == nil {
+			products = append(products, *p)
 		}
 	}
 	return products, nil
 }
 
-func (db *DB) GetProductByID(id string) (*models.Product, error) {
-	row := db.Conn.QueryRow("SELECT id, name, price FROM products WHERE id = $1", id)
-	var p models.Product
-	if err := row.Scan(&p.ID, &p.Name, &p.Price); err != nil {
+func (db *DB) GetProductByID(ctx context.Context, id string) (*models.Product, error) {
+	p, err := scanProduct(db.Conn.QueryRowContext(ctx, "SELECT "+productColumns+" FROM products WHERE id = $1 AND deleted_at IS NULL", id))
+	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, nil // Product not found
 		}
 		return nil, err
 	}
-	return &p, nil
+	return p, nil
 }
 
 func (db *DB) EnsureProductsTable() error {
@@ -72,5 +162,30 @@ func (db *DB) EnsureProductsTable() error {
 		name TEXT NOT NULL,
 		price INT NOT NULL
 	)`)
-	return err
+	if err != nil {
+		return err
+	}
+	_, err = db.Conn.Exec(`
+	ALTER TABLE products
+		ADD COLUMN IF NOT EXISTS version INT NOT NULL DEFAULT 1,
+		ADD COLUMN IF NOT EXISTS description TEXT NOT NULL DEFAULT '',
+		ADD COLUMN IF NOT EXISTS category TEXT NOT NULL DEFAULT '',
+		ADD COLUMN IF NOT EXISTS sku TEXT NOT NULL DEFAULT '',
+		ADD COLUMN IF NOT EXISTS currency CHAR(3) NOT NULL DEFAULT 'USD',
+		ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMPTZ,
+		ADD COLUMN IF NOT EXISTS deleted_by TEXT NOT NULL DEFAULT ''`)
+	if err != nil {
+		return err
+	}
+	// price holds minor units of currency
+	_, err = db.Conn.Exec(`ALTER TABLE products ALTER COLUMN price TYPE BIGINT`)
+	if err != nil {
+		return err
+	}
+	// SKUs are optional, but when present they identify a product for bulk imports
+	_, err = db.Conn.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS ` + SKUConstraint + ` ON products (sku) WHERE sku <> ''`)
+	if err != nil {
+		return err
+	}
+	return db.ensureSearchIndex()
 }
@@ -0,0 +1,276 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"products/internal/models"
+	"sort"
+	"time"
+)
+
+var (
+	// ErrInsufficientStock is returned when a reservation cannot be satisfied.
+	ErrInsufficientStock = errors.New("insufficient stock")
+	// ErrReservationNotFound is returned when a reservation ID is unknown.
+	ErrReservationNotFound = errors.New("reservation not found")
+	// ErrReservationState is returned when a reservation cannot make the requested transition.
+	ErrReservationState = errors.New("invalid reservation state")
+	// ErrStockBelowReserved is returned when on-hand stock would drop below the reserved quantity.
+	ErrStockBelowReserved = errors.New("stock cannot be lower than reserved quantity")
+)
+
+func (db *DB) EnsureInventoryTables() error {
+	_, err := db.Conn.Exec(`
+	CREATE TABLE IF NOT EXISTS inventory (
+		product_id TEXT PRIMARY KEY REFERENCES products(id) ON DELETE CASCADE,
+		on_hand INT NOT NULL DEFAULT 0 CHECK (on_hand >= 0),
+		reserved INT NOT NULL DEFAULT 0 CHECK (reserved >= 0 AND reserved <= on_hand)
+	)`)
+	if err != nil {
+		return err
+	}
+	_, err = db.Conn.Exec(`
+	CREATE TABLE IF NOT EXISTS reservations (
+		id TEXT PRIMARY KEY,
+		order_id TEXT NOT NULL,
+		status TEXT NOT NULL,
+		items JSONB NOT NULL,
+		expires_at TIMESTAMP NOT NULL,
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+	)`)
+	if err != nil {
+		return err
+	}
+	_, err = db.Conn.Exec(`CREATE INDEX IF NOT EXISTS reservations_order_id_idx ON reservations (order_id)`)
+	return err
+}
+
+// GetStock returns the stock level of a product, or nil if the product does not exist.
+func (db *DB) GetStock(ctx context.Context, productID string) (*models.Stock, error) {
+	row := db.Conn.QueryRowContext(ctx, `
+	SELECT p.id, COALESCE(i.on_hand, 0), COALESCE(i.reserved, 0)
+	FROM products p LEFT JOIN inventory i ON i.product_id = p.id
+	WHERE p.id = $1 AND p.deleted_at IS NULL`, productID)
+	var s models.Stock
+	if err := row.Scan(&s.ProductID, &s.OnHand, &s.Reserved); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil // Product not found
+		}
+		return nil, err
+	}
+	s.Available = s.OnHand - s.Reserved
+	return &s, nil
+}
+
+// SetStock sets the on-hand quantity of a product. The quantity may not be
+// lower than what is currently reserved.
+func (db *DB) SetStock(ctx context.Context, productID string, onHand int) (*models.Stock, error) {
+	var s models.Stock
+	err := db.Conn.QueryRowContext(ctx, `
+	INSERT INTO inventory (product_id, on_hand) VALUES ($1, $2)
+	ON CONFLICT (product_id) DO UPDATE SET on_hand = EXCLUDED.on_hand
+	WHERE inventory.reserved <= EXCLUDED.on_hand
+	RETURNING product_id, on_hand, reserved`, productID, onHand).Scan(&s.ProductID, &s.OnHand, &s.Reserved)
+	if err == sql.ErrNoRows {
+		return nil, ErrStockBelowReserved
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.Available = s.OnHand - s.Reserved
+	return &s, nil
+}
+
+// ReserveStock atomically reserves every item of the reservation. Either all
+// items are reserved or none are; ErrInsufficientStock is returned if any
+// product does not have enough available stock.
+func (db *DB) ReserveStock(ctx context.Context, r *models.Reservation) error {
+	quantities := map[string]int{}
+	for _, item := range r.Items {
+		quantities[item.ProductID] += item.Quantity
+	}
+	// Lock inventory rows in a stable order so concurrent reservations cannot deadlock
+	productIDs := make([]string, 0, len(quantities))
+	for id := range quantities {
+		productIDs = append(productIDs, id)
+	}
+	sort.Strings(productIDs)
+
+	itemsJSON, err := json.Marshal(r.Items)
+	if err != nil {
+		return err
+	}
+	tx, err := db.Conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, id := range productIDs {
+		res, err := tx.ExecContext(ctx,
+			"UPDATE inventory SET reserved = reserved + $1 WHERE product_id = $2 AND on_hand - reserved >= $1 AND product_id IN (SELECT id FROM products WHERE deleted_at IS NULL)",
+			quantities[id], id,
+		)
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return fmt.Errorf("%w for product %s", ErrInsufficientStock, id)
+		}
+	}
+	err = tx.QueryRowContext(ctx,
+		"INSERT INTO reservations (id, order_id, status, items, expires_at) VALUES ($1, $2, $3, $4, $5) RETURNING created_at",
+		r.ID, r.OrderID, r.Status, itemsJSON, r.ExpiresAt,
+	).Scan(&r.CreatedAt)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetReservation retrieves a reservation by its ID
+func (db *DB) GetReservation(ctx context.Context, id string) (*models.Reservation, error) {
+	r, err := scanReservation(db.Conn.QueryRowContext(ctx, "SELECT id, order_id, status, items, expires_at, created_at FROM reservations WHERE id = $1", id))
+	if err == sql.ErrNoRows {
+		return nil, nil // Reservation not found
+	}
+	return r, err
+}
+
+// ConfirmReservation turns a pending reservation into a permanent stock deduction.
+func (db *DB) ConfirmReservation(ctx context.Context, id string) (*models.Reservation, error) {
+	return db.transitionReservation(ctx, id, models.ReservationConfirmed)
+}
+
+// ReleaseReservation returns the stock held by a reservation. Releasing a
+// confirmed reservation puts the deducted stock back on hand.
+func (db *DB) ReleaseReservation(ctx context.Context, id string) (*models.Reservation, error) {
+	return db.transitionReservation(ctx, id, models.ReservationReleased)
+}
+
+// ConfirmReservationsForOrder confirms every pending reservation of an order.
+func (db *DB) ConfirmReservationsForOrder(ctx context.Context, orderID string) error {
+	return db.transitionOrderReservations(ctx, orderID, models.ReservationConfirmed, models.ReservationPending)
+}
+
+// ReleaseReservationsForOrder releases every pending or confirmed reservation of an order.
+func (db *DB) ReleaseReservationsForOrder(ctx context.Context, orderID string) error {
+	return db.transitionOrderReservations(ctx, orderID, models.ReservationReleased, models.ReservationPending, models.ReservationConfirmed)
+}
+
+// ReleaseExpiredReservations releases pending reservations whose expiry has passed
+// and returns how many were expired.
+func (db *DB) ReleaseExpiredReservations(ctx context.Context) (int, error) {
+	rows, err := db.Conn.QueryContext(ctx, "SELECT id FROM reservations WHERE status = $1 AND expires_at <= $2", models.ReservationPending, time.Now())
+	if err != nil {
+		return 0, err
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	rows.Close()
+	expired := 0
+	for _, id := range ids {
+		if _, err := db.transitionReservation(ctx, id, models.ReservationExpired); err != nil {
+			// Confirmed or released concurrently
+			if errors.Is(err, ErrReservationState) {
+				continue
+			}
+			return expired, err
+		}
+		expired++
+	}
+	return expired, nil
+}
+
+func (db *DB) transitionOrderReservations(ctx context.Context, orderID, to string, from ...string) error {
+	rows, err := db.Conn.QueryContext(ctx, "SELECT id, status FROM reservations WHERE order_id = $1", orderID)
+	if err != nil {
+		return err
+	}
+	var ids []string
+	for rows.Next() {
+		var id, status string
+		if err := rows.Scan(&id, &status); err != nil {
+			continue
+		}
+		for _, s := range from {
+			if status == s {
+				ids = append(ids, id)
+			}
+		}
+	}
+	rows.Close()
+	for _, id := range ids {
+		if _, err := db.transitionReservation(ctx, id, to); err != nil && !errors.Is(err, ErrReservationState) {
+			return err
+		}
+	}
+	return nil
+}
+
+// transitionReservation moves a reservation to a new status and applies the
+// matching inventory adjustment within a single transaction.
+func (db *DB) transitionReservation(ctx context.Context, id, to string) (*models.Reservation, error) {
+	tx, err := db.Conn.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	r, err := scanReservation(tx.QueryRowContext(ctx, "SELECT id, order_id, status, items, expires_at, created_at FROM reservations WHERE id = $1 FOR UPDATE", id))
+	if err == sql.ErrNoRows {
+		return nil, ErrReservationNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var adjust string
+	switch {
+	case r.Status == models.ReservationPending && to == models.ReservationConfirmed:
+		adjust = "UPDATE inventory SET on_hand = on_hand - $1, reserved = reserved - $1 WHERE product_id = $2"
+	case r.Status == models.ReservationPending && (to == models.ReservationReleased || to == models.ReservationExpired):
+		adjust = "UPDATE inventory SET reserved = reserved - $1 WHERE product_id = $2"
+	case r.Status == models.ReservationConfirmed && to == models.ReservationReleased:
+		adjust = "UPDATE inventory SET on_hand = on_hand + $1 WHERE product_id = $2"
+	default:
+		return nil, fmt.Errorf("%w: cannot move reservation from %s to %s", ErrReservationState, r.Status, to)
+	}
+	for _, item := range r.Items {
+		if _, err := tx.ExecContext(ctx, adjust, item.Quantity, item.ProductID); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE reservations SET status = $1 WHERE id = $2", to, id); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	r.Status = to
+	return r, nil
+}
+
+func scanReservation(row *sql.Row) (*models.Reservation, error) {
+	var r models.Reservation
+	var itemsJSON []byte
+	if err := row.Scan(&r.ID, &r.OrderID, &r.Status, &itemsJSON, &r.ExpiresAt, &r.CreatedAt); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(itemsJSON, &r.Items); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
@@ -0,0 +1,198 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"products/internal/models"
+	"strings"
+	"unicode"
+)
+
+// ProductSearch describes a full-text query against the catalogue.
+type ProductSearch struct {
+	Query    string
+	Category string
+	Currency string
+	MinPrice *int64
+	MaxPrice *int64
+	Limit    int
+	Offset   int
+}
+
+type priceBucket struct {
+	label string
+	min   int64
+	max   *int64
+}
+
+func intPtr(v int64) *int64 { return &v }
+
+// priceBuckets are the ranges, in minor units, reported in the price facet.
+var priceBuckets = []priceBucket{
+	{label: "0-999", min: 0, max: intPtr(999)},
+	{label: "1000-4999", min: 1000, max: intPtr(4999)},
+	{label: "5000-9999", min: 5000, max: intPtr(9999)},
+	{label: "10000+", min: 10000},
+}
+
+// ensureSearchIndex adds the weighted tsvector column used by SearchProducts and its GIN index.
+func (db *DB) ensureSearchIndex() error {
+	_, err := db.Conn.Exec(`
+	ALTER TABLE products ADD COLUMN IF NOT EXISTS search_vector tsvector
+	GENERATED ALWAYS AS (
+		setweight(to_tsvector('english', name), 'A') ||
+		setweight(to_tsvector('english', description), 'B')
+	) STORED`)
+	if err != nil {
+		return err
+	}
+	_, err = db.Conn.Exec(`CREATE INDEX IF NOT EXISTS products_search_idx ON products USING GIN (search_vector)`)
+	return err
+}
+
+// PrefixTSQuery turns free text into a tsquery that requires every term and
+// matches each term as a prefix, e.g. "red sho" becomes "red:* & sho:*".
+// It returns an empty string if the text contains no searchable terms.
+func PrefixTSQuery(text string) string {
+	terms := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	for i, term := range terms {
+		terms[i] = term + ":*"
+	}
+	return strings.Join(terms, " & ")
+}
+
+// searchFilter builds the WHERE clause shared by the result and facet queries.
+// Facet queries leave out their own dimension so every facet value stays
+// selectable; the price facet keeps the currency filter, as it is grouped by
+// currency anyway.
+func searchFilter(s ProductSearch, withCategory, withPrice bool) (string, []interface{}) {
+	args := []interface{}{PrefixTSQuery(s.Query)}
+	conds := []string{"search_vector @@ to_tsquery('english', $1)", "deleted_at IS NULL"}
+	if withCategory && s.Category != "" {
+		args = append(args, s.Category)
+		conds = append(conds, fmt.Sprintf("category = $%d", len(args)))
+	}
+	if s.Currency != "" {
+		args = append(args, s.Currency)
+		conds = append(conds, fmt.Sprintf("currency = $%d", len(args)))
+	}
+	if withPrice && s.MinPrice != nil {
+		args = append(args, *s.MinPrice)
+		conds = append(conds, fmt.Sprintf("price >= $%d", len(args)))
+	}
+	if withPrice && s.MaxPrice != nil {
+		args = append(args, *s.MaxPrice)
+		conds = append(conds, fmt.Sprintf("price <= $%d", len(args)))
+	}
+	return strings.Join(conds, " AND "), args
+}
+
+// SearchProducts runs a ranked full-text search with category and price
+// facets. Price bounds only make sense together with a currency; the price
+// facet counts every currency separately.
+func (db *DB) SearchProducts(ctx context.Context, s ProductSearch) (*models.ProductSearchResult, error) {
+	result := &models.ProductSearchResult{Query: s.Query}
+
+	where, args := searchFilter(s, true, true)
+	if err := db.Conn.QueryRowContext(ctx, "SELECT COUNT(*) FROM products WHERE "+where, args...).Scan(&result.Total); err != nil {
+		return nil, err
+	}
+	var err error
+	if result.Results, err = db.searchHits(ctx, s); err != nil {
+		return nil, err
+	}
+	if result.Facets.Category, err = db.categoryFacet(ctx, s); err != nil {
+		return nil, err
+	}
+	if result.Facets.Price, err = db.priceFacet(ctx, s); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// searchHits returns the requested page of matches, best first.
+func (db *DB) searchHits(ctx context.Context, s ProductSearch) ([]models.ProductSearchHit, error) {
+	where, args := searchFilter(s, true, true)
+	args = append(args, s.Limit, s.Offset)
+	rows, err := db.Conn.QueryContext(ctx, fmt.Sprintf(`
+	SELECT id, sku, name, description, category, price, currency, version, ts_rank(search_vector, to_tsquery('english', $1)) AS rank
+	FROM products WHERE %s
+	ORDER BY rank DESC, name
+	LIMIT $%d OFFSET $%d`, where, len(args)-1, len(args)), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	hits := []models.ProductSearchHit{}
+	for rows.Next() {
+		var h models.ProductSearchHit
+		if err := rows.Scan(&h.ID, &h.SKU, &h.Name, &h.Description, &h.Category, &h.Price.Amount, &h.Price.Currency, &h.Version, &h.Rank); err != nil {
+			return nil, err
+		}
+		hits = append(hits, h)
+	}
+	return hits, rows.Err()
+}
+
+// categoryFacet counts the matches in every category, ignoring the category filter.
+func (db *DB) categoryFacet(ctx context.Context, s ProductSearch) ([]models.FacetCount, error) {
+	where, args := searchFilter(s, false, true)
+	rows, err := db.Conn.QueryContext(ctx, "SELECT category, COUNT(*) FROM products WHERE "+where+" GROUP BY category ORDER BY COUNT(*) DESC, category", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	facet := []models.FacetCount{}
+	for rows.Next() {
+		var f models.FacetCount
+		if err := rows.Scan(&f.Value, &f.Count); err != nil {
+			return nil, err
+		}
+		facet = append(facet, f)
+	}
+	return facet, rows.Err()
+}
+
+// priceFacet counts the matches in every price bucket per currency, ignoring
+// the price filter, since amounts in different currencies are not comparable.
+func (db *DB) priceFacet(ctx context.Context, s ProductSearch) ([]models.PriceBucketCount, error) {
+	where, args := searchFilter(s, true, false)
+	counts := make([]string, len(priceBuckets))
+	for i, b := range priceBuckets {
+		if b.max != nil {
+			counts[i] = fmt.Sprintf("COUNT(*) FILTER (WHERE price BETWEEN %d AND %d)", b.min, *b.max)
+		} else {
+			counts[i] = fmt.Sprintf("COUNT(*) FILTER (WHERE price >= %d)", b.min)
+		}
+	}
+	rows, err := db.Conn.QueryContext(ctx, "SELECT currency, "+strings.Join(counts, ", ")+" FROM products WHERE "+where+" GROUP BY currency ORDER BY currency", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	facet := []models.PriceBucketCount{}
+	bucketCounts := make([]int, len(priceBuckets))
+	dest := make([]interface{}, len(priceBuckets)+1)
+	var currency string
+	dest[0] = &currency
+	for i := range bucketCounts {
+		dest[i+1] = &bucketCounts[i]
+	}
+	for rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		for i, b := range priceBuckets {
+			facet = append(facet, models.PriceBucketCount{
+				Currency: currency,
+				Bucket:   b.label,
+				Min:      b.min,
+				Max:      b.max,
+				Count:    bucketCounts[i],
+			})
+		}
+	}
+	return facet, rows.Err()
+}
@@ -0,0 +1,95 @@
+package db
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPrefixTSQuery(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"", ""},
+		{"   ", ""},
+		{"shoe", "shoe:*"},
+		{"Red SHO", "red:* & sho:*"},
+		{"  red   shoes ", "red:* & shoes:*"},
+		{"4k tv", "4k:* & tv:*"},
+		{"caffè", "caffè:*"},
+		// tsquery operators are separators, not syntax
+		{"a&b|!c:*(d)", "a:* & b:* & c:* & d:*"},
+		{"'; DROP TABLE products; --", "drop:* & table:* & products:*"},
+		{"!&|", ""},
+	}
+	for _, tt := range tests {
+		if got := PrefixTSQuery(tt.text); got != tt.want {
+			t.Errorf("PrefixTSQuery(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestSearchFilter(t *testing.T) {
+	price := func(v int64) *int64 { return &v }
+	const base = "search_vector @@ to_tsquery('english', $1) AND deleted_at IS NULL"
+	full := ProductSearch{Query: "red sho", Category: "shoes", Currency: "USD", MinPrice: price(1000), MaxPrice: price(5000)}
+
+	tests := []struct {
+		name         string
+		search       ProductSearch
+		withCategory bool
+		withPrice    bool
+		wantWhere    string
+		wantArgs     []interface{}
+	}{
+		{
+			name:         "query only",
+			search:       ProductSearch{Query: "red sho"},
+			withCategory: true,
+			withPrice:    true,
+			wantWhere:    base,
+			wantArgs:     []interface{}{"red:* & sho:*"},
+		},
+		{
+			name:         "results use every filter",
+			search:       full,
+			withCategory: true,
+			withPrice:    true,
+			wantWhere:    base + " AND category = $2 AND currency = $3 AND price >= $4 AND price <= $5",
+			wantArgs:     []interface{}{"red:* & sho:*", "shoes", "USD", int64(1000), int64(5000)},
+		},
+		{
+			name:      "category facet leaves out the category",
+			search:    full,
+			withPrice: true,
+			wantWhere: base + " AND currency = $2 AND price >= $3 AND price <= $4",
+			wantArgs:  []interface{}{"red:* & sho:*", "USD", int64(1000), int64(5000)},
+		},
+		{
+			name:         "price facet leaves out the price but keeps the currency",
+			search:       full,
+			withCategory: true,
+			wantWhere:    base + " AND category = $2 AND currency = $3",
+			wantArgs:     []interface{}{"red:* & sho:*", "shoes", "USD"},
+		},
+		{
+			name:         "open-ended price range",
+			search:       ProductSearch{Query: "tv", Currency: "JPY", MinPrice: price(0)},
+			withCategory: true,
+			withPrice:    true,
+			wantWhere:    base + " AND currency = $2 AND price >= $3",
+			wantArgs:     []interface{}{"tv:*", "JPY", int64(0)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			where, args := searchFilter(tt.search, tt.withCategory, tt.withPrice)
+			if where != tt.wantWhere {
+				t.Errorf("where = %q\nwant    %q", where, tt.wantWhere)
+			}
+			if !reflect.DeepEqual(args, tt.wantArgs) {
+				t.Errorf("args = %#v, want %#v", args, tt.wantArgs)
+			}
+		})
+	}
+}
@@ -0,0 +1,405 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"products/internal/models"
+	"shared/money"
+	"shared/problem"
+	"shared/validate"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	formatCSV    = "csv"
+	formatNDJSON = "ndjson"
+
+	defaultImportBatchSize = 500
+	maxImportBatchSize     = 5000
+
+	// maxImportBodyBytes caps the size of an import upload.
+	maxImportBodyBytes = 64 << 20
+)
+
+// csvColumns is the column order written by the CSV export and understood by the CSV import.
+// price is in minor units of currency.
+var csvColumns = []string{"id", "sku", "name", "description", "category", "price", "currency", "version"}
+
+// ImportRowResult reports what happened to one input row of an import.
+type ImportRowResult struct {
+	Row    int      `json:"row"`
+	SKU    string   `json:"sku,omitempty"`
+	ID     string   `json:"id,omitempty"`
+	Status string   `json:"status"` // created, updated, invalid or failed
+	Errors []string `json:"errors,omitempty"`
+}
+
+type ImportSummary struct {
+	DryRun bool `json:"dry_run"`
+	// Aborted is why the import stopped before the end of the input, if it did.
+	Aborted string            `json:"aborted,omitempty"`
+	Total   int               `json:"total"`
+	Created int               `json:"created"`
+	Updated int               `json:"updated"`
+	Invalid int               `json:"invalid"`
+	Failed  int               `json:"failed"`
+	Rows    []ImportRowResult `json:"rows"`
+}
+
+// importRow is one decoded input row, ready to be validated.
+type importRow struct {
+	num     int
+	product models.Product
+	errs    []string
+}
+
+// rowReader yields decoded rows until it returns io.EOF.
+type rowReader interface {
+	next() (*importRow, error)
+}
+
+// ImportProducts handles POST /products/import. The body is CSV or NDJSON,
+// chosen with ?format= or the Content-Type. Rows are upserted by SKU in
+// transactional batches of ?batch_size= rows; ?dry_run=true runs the whole
+// import in one transaction and rolls it back. If the body cannot be read to
+// the end, the batches written so far stay and the summary says where the
+// import stopped. It returns the committed updates to existing products,
+// also when it returns an error.
+func (h *ProductHandler) ImportProducts(w http.ResponseWriter, r *http.Request) ([]models.ProductChange, error) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = formatFromMediaType(r.Header.Get("Content-Type"))
+	}
+	dryRun, _ := strconv.ParseBool(r.URL.Query().Get("dry_run"))
+	batchSize := defaultImportBatchSize
+	if v := r.URL.Query().Get("batch_size"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxImportBatchSize {
+			problem.Write(w, r, http.StatusBadRequest, problem.CodeBadRequest, fmt.Sprintf("batch_size must be between 1 and %d.", maxImportBatchSize))
+			return nil, errors.New("invalid batch size")
+		}
+		batchSize = n
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportBodyBytes)
+
+	var reader rowReader
+	switch format {
+	case formatCSV:
+		cr, err := newCSVRowReader(r.Body)
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			validate.WriteDecodeError(w, r, err)
+			return nil, err
+		}
+		if err != nil {
+			problem.Write(w, r, http.StatusBadRequest, problem.CodeBadRequest, err.Error()+".")
+			return nil, err
+		}
+		reader = cr
+	case formatNDJSON:
+		reader = &ndjsonRowReader{r: bufio.NewReader(r.Body)}
+	default:
+		problem.Write(w, r, http.StatusUnsupportedMediaType, problem.CodeUnsupportedMediaType, "Unsupported import format, use csv or ndjson.")
+		return nil, errors.New("unsupported import format")
+	}
+
+	importer, err := h.DB.NewImporter(r.Context(), dryRun)
+	if err != nil {
+		problem.Internal(w, r, err)
+		return nil, err
+	}
+	defer importer.Close()
+
+	summary := ImportSummary{DryRun: dryRun, Rows: []ImportRowResult{}}
+	var changes []models.ProductChange
+	var batch []*importRow
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		products := make([]models.Product, len(batch))
+		for i, row := range batch {
+			products[i] = row.product
+		}
+		outcomes, err := importer.UpsertBySKU(r.Context(), products)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Product import batch failed", "first_row", batch[0].num, "error", err)
+			for _, row := range batch {
+				summary.Failed++
+				summary.Rows = append(summary.Rows, ImportRowResult{
+					Row:    row.num,
+					SKU:    row.product.SKU,
+					Status: "failed",
+					Errors: []string{"batch could not be written and was rolled back"},
+				})
+			}
+			batch = batch[:0]
+			return
+		}
+		for i, outcome := range outcomes {
+			result := ImportRowResult{Row: batch[i].num, SKU: outcome.Product.SKU, ID: outcome.Product.ID}
+			if outcome.Previous == nil {
+				result.Status = "created"
+				summary.Created++
+			} else {
+				result.Status = "updated"
+				summary.Updated++
+				if !dryRun {
+					changes = append(changes, models.ProductChange{Previous: *outcome.Previous, Updated: outcome.Product})
+				}
+			}
+			summary.Rows = append(summary.Rows, result)
+		}
+		batch = batch[:0]
+	}
+
+	for {
+		row, err := reader.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// The stream itself is unreadable. The rows of the unfinished
+			// batch are not written, so a corrupt upload never commits part
+			// of a batch; earlier batches stay committed.
+			slog.WarnContext(r.Context(), "Product import aborted", "rows_read", summary.Total, "error", err)
+			for _, row := range batch {
+				summary.Failed++
+				summary.Rows = append(summary.Rows, ImportRowResult{
+					Row:    row.num,
+					SKU:    row.product.SKU,
+					Status: "failed",
+					Errors: []string{"not written because the import was aborted"},
+				})
+			}
+			status := http.StatusBadRequest
+			summary.Aborted = fmt.Sprintf("the request body could not be read after row %d", summary.Total)
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				status = http.StatusRequestEntityTooLarge
+				summary.Aborted = fmt.Sprintf("the request body is larger than %d bytes", maxBytesErr.Limit)
+			}
+			writeImportSummary(w, status, summary)
+			return changes, err
+		}
+		summary.Total++
+		row.errs = append(row.errs, validateImportedProduct(row.product)...)
+		if len(row.errs) > 0 {
+			summary.Invalid++
+			summary.Rows = append(summary.Rows, ImportRowResult{Row: row.num, SKU: row.product.SKU, Status: "invalid", Errors: row.errs})
+			continue
+		}
+		batch = append(batch, row)
+		if len(batch) >= batchSize {
+			flush()
+		}
+	}
+	flush()
+
+	writeImportSummary(w, http.StatusOK, summary)
+	return changes, nil
+}
+
+// writeImportSummary sends summary with its rows in input order.
+func writeImportSummary(w http.ResponseWriter, status int, summary ImportSummary) {
+	sort.Slice(summary.Rows, func(i, j int) bool { return summary.Rows[i].Row < summary.Rows[j].Row })
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(summary)
+}
+
+// ExportProducts handles GET /products/export, streaming the catalogue as CSV
+// or NDJSON depending on ?format= or the Accept header (NDJSON by default).
+func (h *ProductHandler) ExportProducts(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = formatFromMediaType(r.Header.Get("Accept"))
+	}
+	if format == "" {
+		format = formatNDJSON
+	}
+
+	flusher, _ := w.(http.Flusher)
+	var write func(models.Product) error
+	switch format {
+	case formatCSV:
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", `attachment; filename="products.csv"`)
+		cw := csv.NewWriter(w)
+		if err := cw.Write(csvColumns); err != nil {
+			return
+		}
+		count := 0
+		write = func(p models.Product) error {
+			if err := cw.Write([]string{p.ID, p.SKU, p.Name, p.Description, p.Category, strconv.FormatInt(p.Price.Amount, 10), p.Price.Currency, strconv.Itoa(p.Version)}); err != nil {
+				return err
+			}
+			if count++; count%100 == 0 {
+				cw.Flush()
+				if flusher != nil {
+					flusher.Flush()
+				}
+			}
+			return cw.Error()
+		}
+		defer cw.Flush()
+	case formatNDJSON:
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Content-Disposition", `attachment; filename="products.ndjson"`)
+		enc := json.NewEncoder(w)
+		count := 0
+		write = func(p models.Product) error {
+			if err := enc.Encode(p); err != nil {
+				return err
+			}
+			if count++; count%100 == 0 && flusher != nil {
+				flusher.Flush()
+			}
+			return nil
+		}
+	default:
+		problem.Write(w, r, http.StatusNotAcceptable, problem.CodeNotAcceptable, "Unsupported export format, use csv or ndjson.")
+		return
+	}
+
+	// Headers are already sent once rows stream, so failures can only be logged
+	if err := h.DB.EachProduct(r.Context(), write); err != nil {
+		slog.ErrorContext(r.Context(), "Product export failed", "error", err)
+	}
+}
+
+func validateImportedProduct(p models.Product) []string {
+	var errs []string
+	if strings.TrimSpace(p.SKU) == "" {
+		errs = append(errs, "sku is required")
+	}
+	for _, fe := range validate.Struct(p) {
+		errs = append(errs, fe.Field+" "+fe.Message)
+	}
+	return errs
+}
+
+// formatFromMediaType maps a Content-Type or Accept value to an import/export format.
+func formatFromMediaType(value string) string {
+	for _, part := range strings.Split(value, ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		switch mediaType {
+		case "text/csv":
+			return formatCSV
+		case "application/x-ndjson", "application/ndjson", "application/jsonl":
+			return formatNDJSON
+		}
+	}
+	return ""
+}
+
+type csvRowReader struct {
+	r       *csv.Reader
+	columns map[string]int
+	line    int
+}
+
+func newCSVRowReader(body io.Reader) (*csvRowReader, error) {
+	r := csv.NewReader(body)
+	r.FieldsPerRecord = -1
+	r.TrimLeadingSpace = true
+	header, err := r.Read()
+	if err != nil {
+		return nil, fmt.Errorf("CSV header row is required: %w", err)
+	}
+	columns := map[string]int{}
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, required := range []string{"sku", "name", "price"} {
+		if _, ok := columns[required]; !ok {
+			return nil, fmt.Errorf("CSV header is missing the %q column", required)
+		}
+	}
+	return &csvRowReader{r: r, columns: columns, line: 1}, nil
+}
+
+func (c *csvRowReader) next() (*importRow, error) {
+	record, err := c.r.Read()
+	if err != nil {
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			// A malformed record only affects its own row
+			c.line++
+			return &importRow{num: c.line, errs: []string{parseErr.Err.Error()}}, nil
+		}
+		return nil, err
+	}
+	c.line++
+	field := func(name string) string {
+		if i, ok := c.columns[name]; ok && i < len(record) {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+	row := &importRow{
+		num: c.line,
+		product: models.Product{
+			SKU:         field("sku"),
+			Name:        field("name"),
+			Description: field("description"),
+			Category:    field("category"),
+			Price:       money.Money{Currency: strings.ToUpper(field("currency"))},
+		},
+	}
+	if row.product.Price.Currency == "" {
+		row.product.Price.Currency = money.DefaultCurrency
+	}
+	if price := field("price"); price != "" {
+		n, err := strconv.ParseInt(price, 10, 64)
+		if err != nil {
+			row.errs = append(row.errs, "price must be an integer number of minor units")
+		} else {
+			row.product.Price.Amount = n
+		}
+	} else {
+		row.errs = append(row.errs, "price is required")
+	}
+	return row, nil
+}
+
+type ndjsonRowReader struct {
+	r    *bufio.Reader
+	line int
+}
+
+func (n *ndjsonRowReader) next() (*importRow, error) {
+	for {
+		line, err := n.r.ReadBytes('\n')
+		if err != nil && (err != io.EOF || len(line) == 0) {
+			return nil, err
+		}
+		n.line++
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		row := &importRow{num: n.line}
+		if err := json.Unmarshal(line, &row.product); err != nil {
+			row.errs = append(row.errs, "invalid JSON: "+err.Error())
+		}
+		row.product.ID = ""
+		if row.product.Price.Currency == "" {
+			row.product.Price.Currency = money.DefaultCurrency
+		}
+		return row, nil
+	}
+}
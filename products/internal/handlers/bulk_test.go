@@ -0,0 +1,181 @@
+package handlers
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// readAll reads rows until r returns io.EOF or another error.
+func readAll(t *testing.T, r rowReader) ([]*importRow, error) {
+	t.Helper()
+	var rows []*importRow
+	for {
+		row, err := r.next()
+		if err == io.EOF {
+			return rows, nil
+		}
+		if err != nil {
+			return rows, err
+		}
+		rows = append(rows, row)
+	}
+}
+
+func TestCSVRowReader(t *testing.T) {
+	input := "SKU, Name, price, currency, category\n" +
+		"a-1,Shoe,1999,usd,shoes\n" +
+		"a-2,\"Bad \"quote\",500,USD,shoes\n" +
+		"a-3,Sock,cheap,,socks\n" +
+		"a-4,Hat,,EUR,hats\n" +
+		"a-5,Scarf,700\n"
+	cr, err := newCSVRowReader(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("newCSVRowReader: %v", err)
+	}
+	rows, err := readAll(t, cr)
+	if err != nil {
+		t.Fatalf("next: %v", err)
+	}
+	if len(rows) != 5 {
+		t.Fatalf("read %d rows, want 5", len(rows))
+	}
+
+	if p := rows[0].product; rows[0].num != 2 || len(rows[0].errs) != 0 || p.SKU != "a-1" || p.Name != "Shoe" || p.Category != "shoes" || p.Price.Amount != 1999 || p.Price.Currency != "USD" {
+		t.Errorf("row 2 = %d %+v %v", rows[0].num, p, rows[0].errs)
+	}
+	// A malformed record is reported on its own line and the next record still reads
+	if rows[1].num != 3 || len(rows[1].errs) != 1 || !strings.Contains(rows[1].errs[0], "quote") {
+		t.Errorf("malformed row = %d %v", rows[1].num, rows[1].errs)
+	}
+	if !reflect.DeepEqual(rows[2].errs, []string{"price must be an integer number of minor units"}) || rows[2].product.Price.Currency != "USD" {
+		t.Errorf("row with bad price = %+v %v", rows[2].product, rows[2].errs)
+	}
+	if !reflect.DeepEqual(rows[3].errs, []string{"price is required"}) {
+		t.Errorf("row without price = %v", rows[3].errs)
+	}
+	if rows[4].num != 6 || len(rows[4].errs) != 0 || rows[4].product.Price.Amount != 700 || rows[4].product.Category != "" {
+		t.Errorf("short row = %d %+v %v", rows[4].num, rows[4].product, rows[4].errs)
+	}
+}
+
+func TestCSVRowReaderHeader(t *testing.T) {
+	tests := []struct {
+		input   string
+		wantErr string
+	}{
+		{"", "CSV header row is required"},
+		{"sku,name\n", `missing the "price" column`},
+		{"name,price\n", `missing the "sku" column`},
+		{"sku,name,price\n", ""},
+	}
+	for _, tt := range tests {
+		_, err := newCSVRowReader(strings.NewReader(tt.input))
+		if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+			t.Errorf("newCSVRowReader(%q) = %v, want %q", tt.input, err, tt.wantErr)
+		}
+	}
+}
+
+func TestNDJSONRowReader(t *testing.T) {
+	input := `{"id":"ignored","sku":"a-1","name":"Shoe","price":{"amount":1999,"currency":"EUR"}}` + "\n" +
+		"\n" +
+		`{"sku":"a-2",` + "\n" +
+		`{"sku":"a-3","name":"Sock","price":{"amount":500}}` // no trailing newline
+	rows, err := readAll(t, &ndjsonRowReader{r: bufio.NewReader(strings.NewReader(input))})
+	if err != nil {
+		t.Fatalf("next: %v", err)
+	}
+	if len(rows) != 3 {
+		t.Fatalf("read %d rows, want 3", len(rows))
+	}
+	// IDs come from the SKU, never from the input
+	if p := rows[0].product; rows[0].num != 1 || len(rows[0].errs) != 0 || p.ID != "" || p.SKU != "a-1" || p.Price.Amount != 1999 || p.Price.Currency != "EUR" {
+		t.Errorf("line 1 = %d %+v %v", rows[0].num, p, rows[0].errs)
+	}
+	if rows[1].num != 3 || len(rows[1].errs) != 1 || !strings.HasPrefix(rows[1].errs[0], "invalid JSON: ") {
+		t.Errorf("invalid line = %d %v", rows[1].num, rows[1].errs)
+	}
+	if p := rows[2].product; rows[2].num != 4 || len(rows[2].errs) != 0 || p.SKU != "a-3" || p.Price.Currency != "USD" {
+		t.Errorf("last line = %d %+v %v", rows[2].num, p, rows[2].errs)
+	}
+}
+
+// failingReader returns its data and then err.
+type failingReader struct {
+	data string
+	err  error
+}
+
+func (f *failingReader) Read(p []byte) (int, error) {
+	if f.data == "" {
+		return 0, f.err
+	}
+	n := copy(p, f.data)
+	f.data = f.data[n:]
+	return n, nil
+}
+
+func TestNDJSONRowReaderReadError(t *testing.T) {
+	broken := errors.New("connection reset")
+	rows, err := readAll(t, &ndjsonRowReader{r: bufio.NewReader(&failingReader{data: `{"sku":"a-1"}` + "\n", err: broken})})
+	if len(rows) != 1 || !errors.Is(err, broken) {
+		t.Errorf("read %d rows and %v, want 1 row and %v", len(rows), err, broken)
+	}
+}
+
+func TestImportProductsRejectsRequestBeforeWriting(t *testing.T) {
+	tests := []struct {
+		name        string
+		query       string
+		contentType string
+		body        string
+		wantStatus  int
+	}{
+		{"batch size zero", "?batch_size=0", "text/csv", "sku,name,price\n", http.StatusBadRequest},
+		{"batch size above the maximum", "?batch_size=5001", "text/csv", "sku,name,price\n", http.StatusBadRequest},
+		{"batch size not a number", "?batch_size=ten", "text/csv", "sku,name,price\n", http.StatusBadRequest},
+		{"unknown format", "", "application/json", "[]", http.StatusUnsupportedMediaType},
+		{"CSV without header", "?format=csv", "", "", http.StatusBadRequest},
+		{"CSV header without price", "", "text/csv; charset=utf-8", "sku,name\n", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Without a database, any attempt to write would panic
+			h := &ProductHandler{}
+			r := httptest.NewRequest(http.MethodPost, "/products/import"+tt.query, strings.NewReader(tt.body))
+			if tt.contentType != "" {
+				r.Header.Set("Content-Type", tt.contentType)
+			}
+			w := httptest.NewRecorder()
+			if _, err := h.ImportProducts(w, r); err == nil {
+				t.Error("ImportProducts returned no error")
+			}
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+		})
+	}
+}
+
+func TestFormatFromMediaType(t *testing.T) {
+	tests := map[string]string{
+		"text/csv":                         formatCSV,
+		"text/csv; charset=utf-8":          formatCSV,
+		"application/x-ndjson":             formatNDJSON,
+		"application/jsonl":                formatNDJSON,
+		"application/json, text/csv;q=0.5": formatCSV,
+		"application/json":                 "",
+		"":                                 "",
+	}
+	for value, want := range tests {
+		if got := formatFromMediaType(value); got != want {
+			t.Errorf("formatFromMediaType(%q) = %q, want %q", value, got, want)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"products/internal/db"
+	"products/internal/models"
+	"shared/problem"
+	"shared/validate"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// DefaultReservationTTL is how long stock is held when the caller does not ask for a specific expiry.
+const DefaultReservationTTL = 15 * time.Minute
+
+type InventoryHandler struct {
+	DB *db.DB
+}
+
+// GetStock handles GET /products/{id}/stock
+func (h *InventoryHandler) GetStock(w http.ResponseWriter, r *http.Request) {
+	stock, err := h.DB.GetStock(r.Context(), r.PathValue("id"))
+	if err != nil {
+		problem.Internal(w, r, err)
+		return
+	}
+	if stock == nil {
+		problem.Write(w, r, http.StatusNotFound, problem.CodeProductNotFound, "Product not found.")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stock)
+}
+
+// SetStock handles PUT /products/{id}/stock with {"on_hand": n}
+func (h *InventoryHandler) SetStock(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		OnHand int `json:"on_hand" validate:"min=0"`
+	}
+	if !validate.DecodeJSON(w, r, &req) {
+		return
+	}
+	id := r.PathValue("id")
+	existing, err := h.DB.GetStock(r.Context(), id)
+	if err != nil {
+		problem.Internal(w, r, err)
+		return
+	}
+	if existing == nil {
+		problem.Write(w, r, http.StatusNotFound, problem.CodeProductNotFound, "Product not found.")
+		return
+	}
+	stock, err := h.DB.SetStock(r.Context(), id, req.OnHand)
+	if err != nil {
+		if errors.Is(err, db.ErrStockBelowReserved) {
+			problem.Write(w, r, http.StatusConflict, problem.CodeStockBelowReserved, "Stock cannot be set lower than the quantity currently reserved.")
+			return
+		}
+		problem.Internal(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stock)
+}
+
+// CreateReservation handles POST /reservations
+func (h *InventoryHandler) CreateReservation(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		OrderID    string                   `json:"order_id" validate:"required,max=64"`
+		Items      []models.ReservationItem `json:"items" validate:"required,max=100,dive"`
+		TTLSeconds int                      `json:"ttl_seconds" validate:"min=0,max=86400"`
+	}
+	if !validate.DecodeJSON(w, r, &req) {
+		return
+	}
+	ttl := DefaultReservationTTL
+	if req.TTLSeconds > 0 {
+		ttl = time.Duration(req.TTLSeconds) * time.Second
+	}
+	reservation := models.Reservation{
+		ID:        uuid.NewString(),
+		OrderID:   req.OrderID,
+		Status:    models.ReservationPending,
+		Items:     req.Items,
+		ExpiresAt: time.Now().Add(ttl),
+	}
+	if err := h.DB.ReserveStock(r.Context(), &reservation); err != nil {
+		if errors.Is(err, db.ErrInsufficientStock) {
+			problem.Write(w, r, http.StatusConflict, problem.CodeInsufficientStock, err.Error()+".")
+			return
+		}
+		problem.Internal(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(reservation)
+}
+
+// GetReservation handles GET /reservations/{id}
+func (h *InventoryHandler) GetReservation(w http.ResponseWriter, r *http.Request) {
+	reservation, err := h.DB.GetReservation(r.Context(), r.PathValue("id"))
+	if err != nil {
+		problem.Internal(w, r, err)
+		return
+	}
+	if reservation == nil {
+		problem.Write(w, r, http.StatusNotFound, problem.CodeReservationNotFound, "Reservation not found.")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reservation)
+}
+
+// ConfirmReservation handles POST /reservations/{id}/confirm
+func (h *InventoryHandler) ConfirmReservation(w http.ResponseWriter, r *http.Request) {
+	reservation, err := h.DB.ConfirmReservation(r.Context(), r.PathValue("id"))
+	writeReservationTransition(w, r, reservation, err)
+}
+
+// ReleaseReservation handles POST /reservations/{id}/release
+func (h *InventoryHandler) ReleaseReservation(w http.ResponseWriter, r *http.Request) {
+	reservation, err := h.DB.ReleaseReservation(r.Context(), r.PathValue("id"))
+	writeReservationTransition(w, r, reservation, err)
+}
+
+func writeReservationTransition(w http.ResponseWriter, r *http.Request, reservation *models.Reservation, err error) {
+	if err != nil {
+		switch {
+		case errors.Is(err, db.ErrReservationNotFound):
+			problem.Write(w, r, http.StatusNotFound, problem.CodeReservationNotFound, "Reservation not found.")
+		case errors.Is(err, db.ErrReservationState):
+			problem.Write(w, r, http.StatusConflict, problem.CodeReservationState, err.Error()+".")
+		default:
+			problem.Internal(w, r, err)
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reservation)
+}
@@ -1,24 +1,42 @@
 package handlers
 
 import (
+	"bytes"
 	"encoding/json"
-	"fmt"
+	"errors"
 	"net/http"
 	"products/internal/db"
 	"products/internal/models"
+	"shared/admin"
+	"shared/audit"
+	"shared/money"
+	"shared/problem"
+	"shared/validate"
+	"strconv"
+	"strings"
 
 	"github.com/google/uuid"
-	"github.com/gorilla/mux"
+	"github.com/lib/pq"
 )
 
+// errInvalidRequest is returned by handlers that already wrote an error response for a bad request.
+var errInvalidRequest = errors.New("invalid request")
+
 type ProductHandler struct {
-	DB *db.DB
+	DB    *db.DB
+	Audit *audit.Log
 }
 
+// GetAllProducts handles GET /products. Admins can add ?include_deleted=true
+// to see soft-deleted products too.
 func (h *ProductHandler) GetAllProducts(w http.ResponseWriter, r *http.Request) {
-	products, err := h.DB.GetAllProducts()
+	include, ok := includeDeleted(w, r)
+	if !ok {
+		return
+	}
+	products, err := h.DB.GetAllProducts(r.Context(), include)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		problem.Internal(w, r, err)
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
@@ -26,68 +44,339 @@ func (h *ProductHandler) GetAllProducts(w http.ResponseWriter, r *http.Request)
 }
 
 func (h *ProductHandler) GetProductByID(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	id := vars["id"]
+	id := r.PathValue("id")
 	if id == "" {
-		http.Error(w, "Product ID is required", http.StatusBadRequest)
+		problem.Write(w, r, http.StatusBadRequest, problem.CodeBadRequest, "Product ID is required.")
 		return
 	}
 
-	product, err := h.DB.GetProductByID(id)
+	product, err := h.DB.GetProductByID(r.Context(), id)
 	if err != nil {
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		problem.Internal(w, r, err)
 		return
 	}
 	if product == nil {
-		http.Error(w, "Product not found", http.StatusNotFound)
+		problem.Write(w, r, http.StatusNotFound, problem.CodeProductNotFound, "Product not found.")
 		return
 	}
 
+	w.Header().Set("ETag", productETag(product.Version))
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(product)
 }
 
+// SearchProducts handles GET /products/search?q=&category=&currency=&min_price=&max_price=&limit=&offset=
+// Price bounds are in minor units and require currency.
+func (h *ProductHandler) SearchProducts(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	search := db.ProductSearch{
+		Query:    strings.TrimSpace(query.Get("q")),
+		Category: query.Get("category"),
+		Currency: strings.ToUpper(query.Get("currency")),
+		Limit:    20,
+	}
+	if db.PrefixTSQuery(search.Query) == "" {
+		problem.Validation(w, r, []problem.FieldError{{Field: "q", Code: "required", Message: "q must contain at least one search term"}})
+		return
+	}
+	intParams := []struct {
+		name string
+		dest **int64
+	}{
+		{"min_price", &search.MinPrice},
+		{"max_price", &search.MaxPrice},
+	}
+	for _, p := range intParams {
+		if v := query.Get(p.name); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n < 0 {
+				problem.Validation(w, r, []problem.FieldError{{Field: p.name, Code: "min", Message: p.name + " must be a non-negative integer"}})
+				return
+			}
+			*p.dest = &n
+		}
+	}
+	// Minor units of different currencies cannot be compared
+	if (search.MinPrice != nil || search.MaxPrice != nil) && search.Currency == "" {
+		problem.Validation(w, r, []problem.FieldError{{Field: "currency", Code: "required", Message: "currency is required with min_price or max_price"}})
+		return
+	}
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 100 {
+			problem.Validation(w, r, []problem.FieldError{{Field: "limit", Code: "range", Message: "limit must be between 1 and 100"}})
+			return
+		}
+		search.Limit = n
+	}
+	if v := query.Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			problem.Validation(w, r, []problem.FieldError{{Field: "offset", Code: "min", Message: "offset must be a non-negative integer"}})
+			return
+		}
+		search.Offset = n
+	}
+
+	result, err := h.DB.SearchProducts(r.Context(), search)
+	if err != nil {
+		problem.Internal(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
 func (h *ProductHandler) CreateProduct(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		w.WriteHeader(http.StatusMethodNotAllowed)
+		problem.MethodNotAllowed(w, r)
 		return
 	}
 	var p models.Product
-	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+	if !validate.DecodeJSON(w, r, &p) {
 		return
 	}
 	if p.ID == "" {
 		p.ID = uuid.NewString()
 	}
-	if err := h.DB.CreateProduct(p); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+	p.DeletedAt, p.DeletedBy = nil, ""
+	if err := h.DB.CreateProduct(r.Context(), &p); err != nil {
+		if !duplicate(w, r, err) {
+			problem.Internal(w, r, err)
+		}
 		return
 	}
-	w.WriteHeader(http.StatusCreated)
+	w.Header().Set("ETag", productETag(p.Version))
 	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(p)
 }
 
+// UpdateProduct handles PUT /products/{id}, replacing the product's name and price.
+// It returns the product as it was before and after the update.
+func (h *ProductHandler) UpdateProduct(w http.ResponseWriter, r *http.Request) (*models.Product, *models.Product, error) {
+	current, ok := h.loadForUpdate(w, r)
+	if !ok {
+		return nil, nil, errInvalidRequest
+	}
+	var req struct {
+		SKU         string      `json:"sku" validate:"max=64"`
+		Name        string      `json:"name" validate:"required,max=200"`
+		Description string      `json:"description" validate:"max=5000"`
+		Category    string      `json:"category" validate:"max=100"`
+		Price       money.Money `json:"price"`
+	}
+	if !validate.DecodeJSON(w, r, &req) {
+		return nil, nil, errInvalidRequest
+	}
+	updated := *current
+	updated.SKU = req.SKU
+	updated.Name = req.Name
+	updated.Description = req.Description
+	updated.Category = req.Category
+	updated.Price = req.Price
+	return h.saveUpdate(w, r, *current, updated)
+}
+
+// PatchProduct handles PATCH /products/{id} using JSON merge patch (RFC 7396) semantics.
+// It returns the product as it was before and after the update.
+func (h *ProductHandler) PatchProduct(w http.ResponseWriter, r *http.Request) (*models.Product, *models.Product, error) {
+	current, ok := h.loadForUpdate(w, r)
+	if !ok {
+		return nil, nil, errInvalidRequest
+	}
+	validate.LimitBody(w, r)
+	var patch map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+		validate.WriteDecodeError(w, r, err)
+		return nil, nil, err
+	}
+	// id, version and deletion are managed by the service and cannot be patched
+	delete(patch, "id")
+	delete(patch, "version")
+	delete(patch, "deleted_at")
+	delete(patch, "deleted_by")
+
+	currentJSON, err := json.Marshal(current)
+	if err != nil {
+		problem.Internal(w, r, err)
+		return nil, nil, err
+	}
+	var doc map[string]interface{}
+	if err := json.Unmarshal(currentJSON, &doc); err != nil {
+		problem.Internal(w, r, err)
+		return nil, nil, err
+	}
+	mergedJSON, err := json.Marshal(mergePatch(doc, patch))
+	if err != nil {
+		problem.Internal(w, r, err)
+		return nil, nil, err
+	}
+	var updated models.Product
+	dec := json.NewDecoder(bytes.NewReader(mergedJSON))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&updated); err != nil {
+		validate.WriteDecodeError(w, r, err)
+		return nil, nil, err
+	}
+	updated.ID = current.ID
+	updated.Version = current.Version
+	return h.saveUpdate(w, r, *current, updated)
+}
+
+// loadForUpdate fetches the product addressed by the request and checks the
+// If-Match precondition against its current version.
+func (h *ProductHandler) loadForUpdate(w http.ResponseWriter, r *http.Request) (*models.Product, bool) {
+	id := r.PathValue("id")
+	if id == "" {
+		problem.Write(w, r, http.StatusBadRequest, problem.CodeBadRequest, "Product ID is required.")
+		return nil, false
+	}
+	product, err := h.DB.GetProductByID(r.Context(), id)
+	if err != nil {
+		problem.Internal(w, r, err)
+		return nil, false
+	}
+	if product == nil {
+		problem.Write(w, r, http.StatusNotFound, problem.CodeProductNotFound, "Product not found.")
+		return nil, false
+	}
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" && !etagMatches(ifMatch, product.Version) {
+		w.Header().Set("ETag", productETag(product.Version))
+		problem.Write(w, r, http.StatusPreconditionFailed, problem.CodeVersionConflict, "The product has been modified since the version given in If-Match.")
+		return nil, false
+	}
+	return product, true
+}
+
+func (h *ProductHandler) saveUpdate(w http.ResponseWriter, r *http.Request, previous, updated models.Product) (*models.Product, *models.Product, error) {
+	if errs := validate.Struct(updated); len(errs) > 0 {
+		problem.Validation(w, r, errs)
+		return nil, nil, errInvalidRequest
+	}
+	if err := h.DB.UpdateProduct(r.Context(), &updated, previous.Version); err != nil {
+		switch {
+		case errors.Is(err, db.ErrProductNotFound):
+			problem.Write(w, r, http.StatusNotFound, problem.CodeProductNotFound, "Product not found.")
+		case errors.Is(err, db.ErrVersionConflict):
+			problem.Write(w, r, http.StatusPreconditionFailed, problem.CodeVersionConflict, "The product was modified concurrently.")
+		case duplicate(w, r, err):
+		default:
+			problem.Internal(w, r, err)
+		}
+		return nil, nil, err
+	}
+	w.Header().Set("ETag", productETag(updated.Version))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(updated)
+	return &previous, &updated, nil
+}
+
+// duplicate answers 409 and returns true if err is a unique violation: a SKU
+// another product has, or the ID of an existing or soft-deleted product.
+func duplicate(w http.ResponseWriter, r *http.Request, err error) bool {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) || pqErr.Code != "23505" {
+		return false
+	}
+	if pqErr.Constraint == db.SKUConstraint {
+		problem.Write(w, r, http.StatusConflict, problem.CodeSKUExists, "A product with this SKU already exists.")
+	} else {
+		problem.Write(w, r, http.StatusConflict, problem.CodeProductExists, "A product with this ID already exists.")
+	}
+	return true
+}
+
+// includeDeleted reads the include_deleted query parameter, which only admins may set.
+func includeDeleted(w http.ResponseWriter, r *http.Request) (include, ok bool) {
+	v := r.URL.Query().Get("include_deleted")
+	if v == "" {
+		return false, true
+	}
+	include, err := strconv.ParseBool(v)
+	if err != nil {
+		problem.Validation(w, r, []problem.FieldError{{Field: "include_deleted", Code: "format", Message: "include_deleted must be true or false"}})
+		return false, false
+	}
+	if include && !admin.Is(r) {
+		problem.Write(w, r, http.StatusForbidden, problem.CodeForbidden, "Only administrators can list deleted records.")
+		return false, false
+	}
+	return include, true
+}
+
+// mergePatch applies an RFC 7396 JSON merge patch to target.
+func mergePatch(target, patch map[string]interface{}) map[string]interface{} {
+	if target == nil {
+		target = map[string]interface{}{}
+	}
+	for key, value := range patch {
+		if value == nil {
+			delete(target, key)
+			continue
+		}
+		if patchObj, ok := value.(map[string]interface{}); ok {
+			targetObj, _ := target[key].(map[string]interface{})
+			target[key] = mergePatch(targetObj, patchObj)
+			continue
+		}
+		target[key] = value
+	}
+	return target
+}
+
+func productETag(version int) string {
+	return strconv.Quote(strconv.Itoa(version))
+}
+
+// etagMatches reports whether an If-Match header value matches the given version.
+func etagMatches(header string, version int) bool {
+	current := productETag(version)
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || tag == current {
+			return true
+		}
+	}
+	return false
+}
+
 func (h *ProductHandler) DeleteProducts(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodDelete {
-		w.WriteHeader(http.StatusMethodNotAllowed)
+		problem.MethodNotAllowed(w, r)
 		return
 	}
 	var req struct {
-		IDs []string `json:"ids"`
+		IDs []string `json:"ids" validate:"required,max=1000,dive,required"`
 	}
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.IDs) == 0 {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("No IDs provided"))
+	if !validate.DecodeJSON(w, r, &req) {
 		return
 	}
-	rowsAffected, err := h.DB.DeleteProducts(req.IDs)
+	rowsAffected, err := h.DB.DeleteProducts(r.Context(), req.IDs, audit.Actor(r.Context()))
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(fmt.Sprintf("Failed to delete products: %v", err)))
+		problem.Internal(w, r, err)
 		return
 	}
+	h.Audit.Record(r, audit.Event{Action: "products.delete", Target: strings.Join(req.IDs, ","), Outcome: audit.OutcomeSuccess})
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{"deleted": rowsAffected})
 }
+
+// RestoreProducts handles POST /products/restore with an array of ids,
+// undoing their soft deletion.
+func (h *ProductHandler) RestoreProducts(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		IDs []string `json:"ids" validate:"required,max=1000,dive,required"`
+	}
+	if !validate.DecodeJSON(w, r, &req) {
+		return
+	}
+	restored, err := h.DB.RestoreProducts(r.Context(), req.IDs)
+	if err != nil {
+		problem.Internal(w, r, err)
+		return
+	}
+	h.Audit.Record(r, audit.Event{Action: "products.restore", Target: strings.Join(req.IDs, ","), Outcome: audit.OutcomeSuccess})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"restored": restored})
+}
@@ -0,0 +1,50 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"products/internal/db"
+	"shared/problem"
+	"testing"
+
+	"github.com/lib/pq"
+)
+
+func TestDuplicate(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		wantStatus int
+		wantCode   string
+	}{
+		{"duplicate SKU", &pq.Error{Code: "23505", Constraint: db.SKUConstraint}, http.StatusConflict, problem.CodeSKUExists},
+		{"duplicate ID", fmt.Errorf("insert: %w", &pq.Error{Code: "23505", Constraint: "products_pkey"}), http.StatusConflict, problem.CodeProductExists},
+		{"other constraint", &pq.Error{Code: "23514", Constraint: "products_price_check"}, 0, ""},
+		{"not a database error", errors.New("connection refused"), 0, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			got := duplicate(w, httptest.NewRequest(http.MethodPost, "/products", nil), tt.err)
+			if got != (tt.wantStatus != 0) {
+				t.Fatalf("duplicate = %v", got)
+			}
+			if !got {
+				if w.Body.Len() != 0 {
+					t.Errorf("wrote %q for an error it does not handle", w.Body)
+				}
+				return
+			}
+			var p struct {
+				Code string `json:"code"`
+			}
+			json.Unmarshal(w.Body.Bytes(), &p)
+			if w.Code != tt.wantStatus || p.Code != tt.wantCode {
+				t.Errorf("response = %d %q, want %d %q", w.Code, p.Code, tt.wantStatus, tt.wantCode)
+			}
+		})
+	}
+}
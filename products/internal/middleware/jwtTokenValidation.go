@@ -3,34 +3,70 @@ package middleware
 import (
 	"context"
 	"net/http"
-	"os"
+	"shared/problem"
+	"slices"
 	"strings"
 	"github.com/golang-jwt/jwt/v5"
 )
 
-var jwtSecret = []byte(os.Getenv("JWT_SECRET"))
+var jwtSecret []byte
+
+// SetJWTSecret sets the key tokens are verified with. Call it before serving requests.
+func SetJWTSecret(secret string) {
+	jwtSecret = []byte(secret)
+}
+
+// serviceScope is the scope service clients need to call this service. While
+// it is empty only user tokens are accepted.
+var serviceScope string
+
+// SetServiceScope sets the scope service tokens must carry. Call it before serving requests.
+func SetServiceScope(scope string) {
+	serviceScope = scope
+}
 
 func JwtTokenValidation(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		tokenString := extractToken(r)
 		if tokenString == "" {
-			http.Error(w, "Missing or invalid token", http.StatusUnauthorized)
+			problem.Write(w, r, http.StatusUnauthorized, problem.CodeUnauthorized, "Missing or invalid token.")
 			return
 		}
 		token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
 			return jwtSecret, nil
 		})
 		if err != nil || !token.Valid {
-			http.Error(w, "Invalid token", http.StatusUnauthorized)
+			problem.Write(w, r, http.StatusUnauthorized, problem.CodeUnauthorized, "Invalid token.")
 			return
 		}
 		claims, ok := token.Claims.(jwt.MapClaims)
-		if !ok || claims["username"] == nil {
-			http.Error(w, "Invalid token claims", http.StatusUnauthorized)
+		if !ok {
+			problem.Write(w, r, http.StatusUnauthorized, problem.CodeUnauthorized, "Invalid token claims.")
+			return
+		}
+		// Tokens with an audience were issued to OpenID Connect clients and
+		// are only good for the userinfo endpoint
+		if _, ok := claims["aud"]; ok {
+			problem.Write(w, r, http.StatusUnauthorized, problem.CodeUnauthorized, "The token is not valid for this service.")
 			return
 		}
 		ctx := r.Context()
-		ctx = context.WithValue(ctx, "username", claims["username"].(string))
+		if username, _ := claims["username"].(string); username != "" {
+			ctx = context.WithValue(ctx, "username", username)
+		} else if clientID, _ := claims["client_id"].(string); clientID != "" {
+			// Service principals from the client-credentials grant need this service's scope
+			scope, _ := claims["scope"].(string)
+			scopes := strings.Fields(scope)
+			if serviceScope == "" || !slices.Contains(scopes, serviceScope) {
+				problem.Write(w, r, http.StatusForbidden, problem.CodeInsufficientScope, "The token lacks the scope required by this service.")
+				return
+			}
+			ctx = context.WithValue(ctx, "client_id", clientID)
+			ctx = context.WithValue(ctx, "scopes", scopes)
+		} else {
+			problem.Write(w, r, http.StatusUnauthorized, problem.CodeUnauthorized, "Invalid token claims.")
+			return
+		}
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
@@ -0,0 +1,34 @@
+package models
+
+import "time"
+
+// Stock describes the stock level of a single product. Available is the
+// quantity that can still be reserved (on hand minus reserved).
+type Stock struct {
+	ProductID string `json:"product_id"`
+	OnHand    int    `json:"on_hand"`
+	Reserved  int    `json:"reserved"`
+	Available int    `json:"available"`
+}
+
+type ReservationItem struct {
+	ProductID string `json:"product_id" validate:"required,max=64"`
+	Quantity  int    `json:"quantity" validate:"min=1,max=10000"`
+}
+
+// Reservation holds stock for an order until it is confirmed, released or expires.
+type Reservation struct {
+	ID        string            `json:"id"`
+	OrderID   string            `json:"order_id"`
+	Status    string            `json:"status"`
+	Items     []ReservationItem `json:"items"`
+	ExpiresAt time.Time         `json:"expires_at"`
+	CreatedAt time.Time         `json:"created_at"`
+}
+
+const (
+	ReservationPending   = "pending"
+	ReservationConfirmed = "confirmed"
+	ReservationReleased  = "released"
+	ReservationExpired   = "expired"
+)
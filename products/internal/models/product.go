@@ -1,7 +1,25 @@
 package models
 
+import (
+	"shared/money"
+	"time"
+)
+
 type Product struct {
-	ID    string `json:"id"`
-	Name  string `json:"name"`
-	Price int    `json:"price"`
+	ID          string      `json:"id" validate:"max=64"`
+	SKU         string      `json:"sku" validate:"max=64"`
+	Name        string      `json:"name" validate:"required,max=200"`
+	Description string      `json:"description" validate:"max=5000"`
+	Category    string      `json:"category" validate:"max=100"`
+	Price       money.Money `json:"price"`
+	Version     int         `json:"version"`
+	// DeletedAt and DeletedBy are set while the product is soft-deleted.
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+	DeletedBy string     `json:"deleted_by,omitempty"`
+}
+
+// ProductChange pairs a product's state before and after an update.
+type ProductChange struct {
+	Previous Product
+	Updated  Product
 }
@@ -0,0 +1,34 @@
+package models
+
+// ProductSearchHit is a product matched by a search together with its relevance rank.
+type ProductSearchHit struct {
+	Product
+	Rank float64 `json:"rank"`
+}
+
+type FacetCount struct {
+	Value string `json:"value"`
+	Count int    `json:"count"`
+}
+
+// PriceBucketCount counts matches priced in Currency whose price lies in
+// [Min, Max] minor units. Max is nil for the open-ended top bucket.
+type PriceBucketCount struct {
+	Currency string `json:"currency"`
+	Bucket   string `json:"bucket"`
+	Min      int64  `json:"min"`
+	Max      *int64 `json:"max"`
+	Count    int    `json:"count"`
+}
+
+type SearchFacets struct {
+	Category []FacetCount       `json:"category"`
+	Price    []PriceBucketCount `json:"price"`
+}
+
+type ProductSearchResult struct {
+	Query   string             `json:"query"`
+	Total   int                `json:"total"`
+	Results []ProductSearchHit `json:"results"`
+	Facets  SearchFacets       `json:"facets"`
+}
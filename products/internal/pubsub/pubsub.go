@@ -0,0 +1,265 @@
+package pubsub
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"products/internal/config"
+	"products/internal/db"
+	"products/internal/models"
+	"shared/metrics"
+	"shared/money"
+	"shared/requestid"
+	"shared/tracing"
+
+	"cloud.google.com/go/pubsub"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// PubSub struct holds references to Pub/Sub client, topics, subscriptions, and DB.
+type PubSub struct {
+	Client        *pubsub.Client
+	ProductsTopic *pubsub.Topic
+	PaymentSub    *pubsub.Subscription
+	DB            *db.DB
+
+	// receiving is set while the subscription receive loop is running
+	receiving atomic.Bool
+}
+
+func NewClient(ctx context.Context, projectID string) (*pubsub.Client, error) {
+	return pubsub.NewClient(ctx, projectID)
+}
+
+// EnsureTopic checks if a Pub/Sub topic exists, and creates it if not.
+func EnsureTopic(ctx context.Context, client *pubsub.Client, topicName string) (*pubsub.Topic, error) {
+	topic := client.Topic(topicName)
+	exists, err := topic.Exists(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		topic, err = client.CreateTopic(ctx, topicName)
+		if err != nil {
+			if strings.Contains(err.Error(), "AlreadyExists") {
+				slog.Info("Topic already exists (race condition)", "topic", topicName)
+				return client.Topic(topicName), nil
+			}
+			return nil, err
+		}
+		slog.Info("Created Pub/Sub topic", "topic", topicName)
+	}
+	return topic, nil
+}
+
+// EnsureSubscription checks if a Pub/Sub subscription exists, and creates it if not.
+func EnsureSubscription(ctx context.Context, client *pubsub.Client, subName, topicName string) (*pubsub.Subscription, error) {
+	sub := client.Subscription(subName)
+	exists, err := sub.Exists(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		topic, err := EnsureTopic(ctx, client, topicName)
+		if err != nil {
+			return nil, err
+		}
+		sub, err = client.CreateSubscription(ctx, subName, pubsub.SubscriptionConfig{Topic: topic})
+		if err != nil {
+			if strings.Contains(err.Error(), "AlreadyExists") {
+				slog.Info("Subscription already exists (race condition)", "subscription", subName)
+				return client.Subscription(subName), nil
+			}
+			if strings.Contains(err.Error(), "NotFound") {
+				return nil, fmt.Errorf("subscription topic does not exist: %w", err)
+			}
+			return nil, err
+		}
+		slog.Info("Created Pub/Sub subscription", "subscription", subName)
+	}
+	return sub, nil
+}
+
+func SetupPubSub(ctx context.Context, cfg config.PubSub, dbInstance *db.DB) (*PubSub, error) {
+	client, err := NewClient(ctx, cfg.ProjectID)
+	if err != nil {
+		return nil, err
+	}
+
+	ps := &PubSub{
+		Client: client,
+		DB:     dbInstance,
+	}
+
+	if err := ps.EnsureTopicAndSubscription(ctx, cfg); err != nil {
+		return nil, err
+	}
+
+	return ps, nil
+}
+
+func (ps *PubSub) EnsureTopicAndSubscription(ctx context.Context, cfg config.PubSub) error {
+	var err error
+	ps.ProductsTopic, err = EnsureTopic(ctx, ps.Client, cfg.ProductsTopic)
+	if err != nil {
+		return err
+	}
+	ps.PaymentSub, err = EnsureSubscription(ctx, ps.Client, cfg.PaymentSubscription, cfg.PaymentTopic)
+	return err
+}
+
+// ListenForPaymentEvents confirms an order's stock reservations when it is paid
+// and releases them when the payment fails.
+func (ps *PubSub) ListenForPaymentEvents(ctx context.Context) {
+	err := ps.receive(ctx, ps.PaymentSub, func(ctx context.Context, msg *pubsub.Message) bool {
+		var paymentEvent struct {
+			OrderID string `json:"order_id"`
+			Status  string `json:"status"`
+		}
+		if err := json.Unmarshal(msg.Data, &paymentEvent); err != nil {
+			slog.ErrorContext(ctx, "Invalid payment event", "message_id", msg.ID, "error", err)
+			return false
+		}
+		slog.InfoContext(ctx, "Received payment event", "order_id", paymentEvent.OrderID, "status", paymentEvent.Status)
+		var err error
+		switch paymentEvent.Status {
+		case "paid":
+			err = ps.DB.ConfirmReservationsForOrder(ctx, paymentEvent.OrderID)
+		case "failed":
+			err = ps.DB.ReleaseReservationsForOrder(ctx, paymentEvent.OrderID)
+		}
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to update reservations", "order_id", paymentEvent.OrderID, "error", err)
+			return false
+		}
+		return true
+	})
+	if err != nil {
+		slog.Error("Error receiving payment events", "error", err)
+	}
+}
+
+// PublishProductUpdatedEvent publishes a product.updated event so other services
+// can react to catalogue changes such as price updates.
+func PublishProductUpdatedEvent(ctx context.Context, ps *PubSub, previous, updated models.Product) {
+	productEvent := struct {
+		Type          string      `json:"type"`
+		ID            string      `json:"id"`
+		Name          string      `json:"name"`
+		Price         money.Money `json:"price"`
+		PreviousPrice money.Money `json:"previous_price"`
+		Version       int         `json:"version"`
+	}{
+		Type:          "product.updated",
+		ID:            updated.ID,
+		Name:          updated.Name,
+		Price:         updated.Price,
+		PreviousPrice: previous.Price,
+		Version:       updated.Version,
+	}
+
+	data, err := json.Marshal(productEvent)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to marshal product event", "product_id", updated.ID, "error", err)
+		return
+	}
+
+	msg := &pubsub.Message{
+		Data:       data,
+		Attributes: requestid.Attributes(ctx),
+	}
+	msg.Attributes["type"] = productEvent.Type
+
+	if err := publish(ctx, ps.ProductsTopic, msg); err != nil {
+		slog.ErrorContext(ctx, "Failed to publish product event", "product_id", updated.ID, "error", err)
+	} else {
+		slog.InfoContext(ctx, "Published product updated event", "product_id", updated.ID, "version", updated.Version)
+	}
+}
+
+// CheckReceiving reports an error unless the subscription receive loop is running.
+func (ps *PubSub) CheckReceiving(ctx context.Context) error {
+	if !ps.receiving.Load() {
+		return errors.New("subscription receive loop is not running")
+	}
+	return nil
+}
+
+// CheckTopics reports an error unless every topic and subscription the service uses exists.
+func (ps *PubSub) CheckTopics(ctx context.Context) error {
+	for _, topic := range []*pubsub.Topic{ps.ProductsTopic} {
+		exists, err := topic.Exists(ctx)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return fmt.Errorf("topic %s does not exist", topic.ID())
+		}
+	}
+	exists, err := ps.PaymentSub.Exists(ctx)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("subscription %s does not exist", ps.PaymentSub.ID())
+	}
+	return nil
+}
+
+// receive handles the messages of sub until ctx is done. handle runs in a
+// consumer span continuing the publisher's trace, with the publisher's
+// correlation ID in its context, and reports whether the message should be
+// acked; receive settles the message and records Pub/Sub metrics.
+func (ps *PubSub) receive(ctx context.Context, sub *pubsub.Subscription, handle func(context.Context, *pubsub.Message) bool) error {
+	ps.receiving.Store(true)
+	defer ps.receiving.Store(false)
+	return sub.Receive(ctx, func(ctx context.Context, msg *pubsub.Message) {
+		start := time.Now()
+		metrics.ObserveReceived(sub.ID())
+		ctx = tracing.Extract(requestid.FromAttributes(ctx, msg.Attributes), msg.Attributes)
+		ctx, span := tracing.Tracer().Start(ctx, sub.ID()+" receive",
+			trace.WithSpanKind(trace.SpanKindConsumer),
+			trace.WithAttributes(tracing.MessagingAttributes(sub.ID())...),
+			trace.WithAttributes(semconv.MessagingMessageID(msg.ID)),
+		)
+		defer span.End()
+		acked := handle(ctx, msg)
+		if acked {
+			msg.Ack()
+		} else {
+			msg.Nack()
+			span.SetStatus(codes.Error, "message nacked")
+		}
+		metrics.ObserveHandled(sub.ID(), start, acked)
+	})
+}
+
+// publish sends msg to topic in a producer span, waits until the server
+// accepts it and records the result. The trace context is added to the
+// message attributes so consumers continue the trace.
+func publish(ctx context.Context, topic *pubsub.Topic, msg *pubsub.Message) error {
+	ctx, span := tracing.Tracer().Start(ctx, topic.ID()+" publish",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(tracing.MessagingAttributes(topic.ID())...),
+	)
+	defer span.End()
+	if msg.Attributes == nil {
+		msg.Attributes = map[string]string{}
+	}
+	tracing.Inject(ctx, msg.Attributes)
+	_, err := topic.Publish(ctx, msg).Get(ctx)
+	metrics.ObservePublish(topic.ID(), err)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return err
+}
@@ -0,0 +1,35 @@
+// Package admin restricts endpoints to the usernames configured as administrators.
+package admin
+
+import (
+	"net/http"
+	"shared/problem"
+)
+
+var users = map[string]bool{}
+
+// SetUsers sets the usernames allowed past Only. Call it before serving requests.
+func SetUsers(usernames []string) {
+	users = make(map[string]bool, len(usernames))
+	for _, name := range usernames {
+		users[name] = true
+	}
+}
+
+// Is reports whether the request was made by an admin user. It must run after
+// the service's JWT validation, which stores the username in the context.
+func Is(r *http.Request) bool {
+	username, _ := r.Context().Value("username").(string)
+	return users[username]
+}
+
+// Only lets only admin users through. It must run after the service's JWT validation.
+func Only(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !Is(r) {
+			problem.Write(w, r, http.StatusForbidden, problem.CodeForbidden, "This endpoint is restricted to administrators.")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,189 @@
+// Package audit keeps an append-only trail of security-relevant actions.
+// Every entry stores the hash of the entry before it, so editing, removing or
+// reordering entries breaks the chain and is detected by Verify.
+package audit
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Outcomes of an audited action.
+const (
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+	OutcomeDenied  = "denied"
+)
+
+// chainLock is the advisory lock key that serialises appends, so concurrent
+// writers, including other instances of the service, extend the chain in turn.
+const chainLock = 0x617564697400
+
+// Entry is one audited action.
+type Entry struct {
+	ID        int64     `json:"id"`
+	Time      time.Time `json:"time"`
+	Actor     string    `json:"actor"`
+	Action    string    `json:"action"`
+	Target    string    `json:"target,omitempty"`
+	IP        string    `json:"ip,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	Outcome   string    `json:"outcome"`
+	PrevHash  string    `json:"prev_hash"`
+	Hash      string    `json:"hash"`
+}
+
+// Event describes an action to record. An empty Actor is taken from the
+// request's token: the username, or client:<id> for service clients.
+type Event struct {
+	Actor   string
+	Action  string
+	Target  string
+	Outcome string
+}
+
+// Log writes and reads the audit trail in the service's database.
+type Log struct {
+	conn *sql.DB
+	// trustProxy takes the client IP from X-Forwarded-For, as set by the gateway.
+	trustProxy bool
+}
+
+func New(conn *sql.DB, trustProxy bool) *Log {
+	return &Log{conn: conn, trustProxy: trustProxy}
+}
+
+// EnsureTable creates the audit_log table and the trigger that refuses
+// updates and deletes of its rows.
+func (l *Log) EnsureTable() error {
+	_, err := l.conn.Exec(`
+	CREATE TABLE IF NOT EXISTS audit_log (
+		id BIGSERIAL PRIMARY KEY,
+		time TIMESTAMPTZ NOT NULL,
+		actor TEXT NOT NULL,
+		action TEXT NOT NULL,
+		target TEXT NOT NULL DEFAULT '',
+		ip TEXT NOT NULL DEFAULT '',
+		user_agent TEXT NOT NULL DEFAULT '',
+		outcome TEXT NOT NULL,
+		prev_hash TEXT NOT NULL,
+		hash TEXT NOT NULL
+	)`)
+	if err != nil {
+		return err
+	}
+	_, err = l.conn.Exec(`
+	CREATE INDEX IF NOT EXISTS audit_log_actor_idx ON audit_log (actor, id);
+	CREATE INDEX IF NOT EXISTS audit_log_action_idx ON audit_log (action, id);
+	CREATE OR REPLACE FUNCTION audit_log_append_only() RETURNS trigger AS $$
+	BEGIN
+		RAISE EXCEPTION 'audit_log is append-only';
+	END;
+	$$ LANGUAGE plpgsql;
+	CREATE OR REPLACE TRIGGER audit_log_append_only
+		BEFORE UPDATE OR DELETE OR TRUNCATE ON audit_log
+		FOR EACH STATEMENT EXECUTE FUNCTION audit_log_append_only()`)
+	return err
+}
+
+// Record appends e for the request r. The trail must not make the action
+// itself fail, so errors are logged rather than returned.
+func (l *Log) Record(r *http.Request, e Event) {
+	if e.Actor == "" {
+		e.Actor = Actor(r.Context())
+	}
+	entry := &Entry{
+		Time:      time.Now(),
+		Actor:     e.Actor,
+		Action:    e.Action,
+		Target:    e.Target,
+		IP:        l.clientIP(r),
+		UserAgent: truncate(r.UserAgent(), 512),
+		Outcome:   e.Outcome,
+	}
+	ctx := context.WithoutCancel(r.Context())
+	if err := l.Append(ctx, entry); err != nil {
+		slog.ErrorContext(ctx, "Failed to write audit log entry", "action", e.Action, "actor", e.Actor, "target", e.Target, "outcome", e.Outcome, "error", err)
+	}
+}
+
+// Append chains e to the last entry and stores it, filling in its ID and hashes.
+func (l *Log) Append(ctx context.Context, e *Entry) error {
+	tx, err := l.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock($1)", chainLock); err != nil {
+		return err
+	}
+	err = tx.QueryRowContext(ctx, "SELECT hash FROM audit_log ORDER BY id DESC LIMIT 1").Scan(&e.PrevHash)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	// Postgres keeps microseconds and valid UTF-8 without NULs; hash exactly what will be read back
+	e.Time = e.Time.UTC().Truncate(time.Microsecond)
+	for _, f := range []*string{&e.Actor, &e.Action, &e.Target, &e.IP, &e.UserAgent, &e.Outcome} {
+		*f = strings.ReplaceAll(strings.ToValidUTF8(*f, "\uFFFD"), "\x00", "")
+	}
+	e.Hash = hash(e)
+	err = tx.QueryRowContext(ctx,
+		"INSERT INTO audit_log (time, actor, action, target, ip, user_agent, outcome, prev_hash, hash) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) RETURNING id",
+		e.Time, e.Actor, e.Action, e.Target, e.IP, e.UserAgent, e.Outcome, e.PrevHash, e.Hash,
+	).Scan(&e.ID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// hash returns the SHA-256 of the previous hash and the entry's fields.
+func hash(e *Entry) string {
+	fields, _ := json.Marshal([]string{
+		e.PrevHash, e.Time.UTC().Format(time.RFC3339Nano), e.Actor, e.Action, e.Target, e.IP, e.UserAgent, e.Outcome,
+	})
+	sum := sha256.Sum256(fields)
+	return hex.EncodeToString(sum[:])
+}
+
+// Actor names the user or service client of the request's token.
+func Actor(ctx context.Context) string {
+	if username, _ := ctx.Value("username").(string); username != "" {
+		return username
+	}
+	if clientID, _ := ctx.Value("client_id").(string); clientID != "" {
+		return "client:" + clientID
+	}
+	return "anonymous"
+}
+
+func (l *Log) clientIP(r *http.Request) string {
+	if l.trustProxy {
+		if forwarded := r.Header.Values("X-Forwarded-For"); len(forwarded) > 0 {
+			hops := strings.Split(forwarded[len(forwarded)-1], ",")
+			if ip := strings.TrimSpace(hops[len(hops)-1]); ip != "" {
+				return ip
+			}
+		}
+	}
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
+}
+
+func truncate(s string, n int) string {
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
+}
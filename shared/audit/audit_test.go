@@ -0,0 +1,193 @@
+package audit
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+// table is a database/sql driver that keeps audit_log rows in memory. Like
+// Postgres, it stores times to the microsecond and rejects text that is not
+// valid UTF-8 or contains NUL.
+type table struct {
+	mu   sync.Mutex
+	rows [][]driver.Value // id, time, actor, action, target, ip, user_agent, outcome, prev_hash, hash
+}
+
+func (t *table) Connect(context.Context) (driver.Conn, error) { return &tableConn{t}, nil }
+func (t *table) Driver() driver.Driver                        { return nil }
+
+type tableConn struct{ t *table }
+
+func (c *tableConn) Prepare(string) (driver.Stmt, error) { return nil, errors.New("not supported") }
+func (c *tableConn) Close() error                        { return nil }
+func (c *tableConn) Begin() (driver.Tx, error)           { return c, nil }
+func (c *tableConn) Commit() error                       { return nil }
+func (c *tableConn) Rollback() error                     { return nil }
+
+func (c *tableConn) ExecContext(_ context.Context, query string, _ []driver.NamedValue) (driver.Result, error) {
+	if !strings.HasPrefix(query, "SELECT pg_advisory_xact_lock") {
+		return nil, errors.New("unexpected statement " + query)
+	}
+	return driver.RowsAffected(0), nil
+}
+
+func (c *tableConn) QueryContext(_ context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	c.t.mu.Lock()
+	defer c.t.mu.Unlock()
+	switch {
+	case strings.HasPrefix(query, "SELECT hash FROM audit_log"):
+		if len(c.t.rows) == 0 {
+			return &tableRows{columns: []string{"hash"}}, nil
+		}
+		last := c.t.rows[len(c.t.rows)-1]
+		return &tableRows{columns: []string{"hash"}, rows: [][]driver.Value{{last[9]}}}, nil
+	case strings.HasPrefix(query, "INSERT INTO audit_log"):
+		row := []driver.Value{int64(len(c.t.rows) + 1), args[0].Value.(time.Time).Truncate(time.Microsecond)}
+		for _, arg := range args[1:] {
+			s := arg.Value.(string)
+			if !utf8.ValidString(s) || strings.ContainsRune(s, 0) {
+				return nil, fmt.Errorf("invalid text %q", s)
+			}
+			row = append(row, s)
+		}
+		c.t.rows = append(c.t.rows, row)
+		return &tableRows{columns: []string{"id"}, rows: [][]driver.Value{{row[0]}}}, nil
+	case strings.HasPrefix(query, "SELECT id, time"):
+		return &tableRows{columns: make([]string, 10), rows: append([][]driver.Value(nil), c.t.rows...)}, nil
+	}
+	return nil, errors.New("unexpected query " + query)
+}
+
+type tableRows struct {
+	columns []string
+	rows    [][]driver.Value
+}
+
+func (r *tableRows) Columns() []string { return r.columns }
+func (r *tableRows) Close() error      { return nil }
+
+func (r *tableRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+// newLog returns a Log on an empty in-memory table.
+func newLog(t *testing.T) (*Log, *table) {
+	t.Helper()
+	tbl := &table{}
+	conn := sql.OpenDB(tbl)
+	t.Cleanup(func() { conn.Close() })
+	return New(conn, false), tbl
+}
+
+func TestVerifyDetectsTampering(t *testing.T) {
+	tests := []struct {
+		name         string
+		tamper       func(tbl *table)
+		wantEntries  int64
+		wantBrokenAt int64
+	}{
+		{
+			name:        "untouched chain",
+			tamper:      func(*table) {},
+			wantEntries: 4,
+		},
+		{
+			name:         "mutated row",
+			tamper:       func(tbl *table) { tbl.rows[1][2] = "mallory" },
+			wantEntries:  4,
+			wantBrokenAt: 2,
+		},
+		{
+			name: "mutated row with its hash recomputed",
+			tamper: func(tbl *table) {
+				row := tbl.rows[1]
+				row[7] = OutcomeSuccess
+				row[9] = hash(&Entry{
+					Time: row[1].(time.Time), Actor: row[2].(string), Action: row[3].(string), Target: row[4].(string),
+					IP: row[5].(string), UserAgent: row[6].(string), Outcome: row[7].(string), PrevHash: row[8].(string),
+				})
+			},
+			wantEntries:  4,
+			wantBrokenAt: 3,
+		},
+		{
+			name:         "deleted row",
+			tamper:       func(tbl *table) { tbl.rows = append(tbl.rows[:1], tbl.rows[2:]...) },
+			wantEntries:  3,
+			wantBrokenAt: 3,
+		},
+		{
+			name:         "deleted first row",
+			tamper:       func(tbl *table) { tbl.rows = tbl.rows[1:] },
+			wantEntries:  3,
+			wantBrokenAt: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, tbl := newLog(t)
+			start := time.Date(2026, 10, 19, 9, 0, 0, 0, time.UTC)
+			outcomes := []string{OutcomeSuccess, OutcomeFailure, OutcomeDenied, OutcomeSuccess}
+			for i, outcome := range outcomes {
+				e := &Entry{Time: start.Add(time.Duration(i) * time.Minute), Actor: "alice", Action: "user.login", IP: "10.0.0.1", Outcome: outcome}
+				if err := l.Append(t.Context(), e); err != nil {
+					t.Fatalf("Append: %v", err)
+				}
+			}
+			tt.tamper(tbl)
+
+			v, err := l.Verify(t.Context())
+			if err != nil {
+				t.Fatalf("Verify: %v", err)
+			}
+			want := Verification{Valid: tt.wantBrokenAt == 0, Entries: tt.wantEntries, BrokenAt: tt.wantBrokenAt}
+			if *v != want {
+				t.Errorf("Verify = %+v, want %+v", *v, want)
+			}
+		})
+	}
+}
+
+func TestAppendNormalisesText(t *testing.T) {
+	l, _ := newLog(t)
+	e := &Entry{
+		Time:      time.Date(2026, 10, 19, 9, 0, 0, 123456789, time.FixedZone("CEST", 2*60*60)),
+		Actor:     "bob\x00",
+		Action:    "user.login",
+		Target:    "caf\xe9",
+		UserAgent: "curl/8.0 \xff\xfe",
+		Outcome:   OutcomeFailure,
+	}
+	if err := l.Append(t.Context(), e); err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+	if e.Actor != "bob" || e.Target != "caf\uFFFD" || e.UserAgent != "curl/8.0 \uFFFD" {
+		t.Errorf("stored actor %q, target %q, user agent %q", e.Actor, e.Target, e.UserAgent)
+	}
+	if want := time.Date(2026, 10, 19, 7, 0, 0, 123456000, time.UTC); !e.Time.Equal(want) || e.Time.Location() != time.UTC {
+		t.Errorf("stored time %v, want %v", e.Time, want)
+	}
+
+	// The hash covers what was stored, so the entry verifies once read back
+	v, err := l.Verify(t.Context())
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if !v.Valid || v.Entries != 1 {
+		t.Errorf("Verify = %+v, want a valid chain of 1 entry", *v)
+	}
+}
@@ -0,0 +1,73 @@
+package audit
+
+import (
+	"encoding/json"
+	"net/http"
+	"shared/problem"
+	"strconv"
+	"time"
+)
+
+// ListHandler handles GET /admin/audit?actor=&action=&target=&outcome=&since=&until=&before_id=&limit=
+// Times are RFC 3339. Results are newest first; pass the smallest ID seen as
+// before_id to fetch the next page.
+func (l *Log) ListHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	f := Filter{
+		Actor:   query.Get("actor"),
+		Action:  query.Get("action"),
+		Target:  query.Get("target"),
+		Outcome: query.Get("outcome"),
+		Limit:   100,
+	}
+	var errs []problem.FieldError
+	for _, p := range []struct {
+		name string
+		dest *time.Time
+	}{{"since", &f.Since}, {"until", &f.Until}} {
+		if v := query.Get(p.name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				errs = append(errs, problem.FieldError{Field: p.name, Code: "format", Message: p.name + " must be an RFC 3339 time"})
+				continue
+			}
+			*p.dest = t
+		}
+	}
+	if v := query.Get("before_id"); v != "" {
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || id < 1 {
+			errs = append(errs, problem.FieldError{Field: "before_id", Code: "min", Message: "before_id must be a positive integer"})
+		}
+		f.BeforeID = id
+	}
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 1000 {
+			errs = append(errs, problem.FieldError{Field: "limit", Code: "max", Message: "limit must be between 1 and 1000"})
+		}
+		f.Limit = n
+	}
+	if len(errs) > 0 {
+		problem.Validation(w, r, errs)
+		return
+	}
+	entries, err := l.List(r.Context(), f)
+	if err != nil {
+		problem.Internal(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
+
+// VerifyHandler handles GET /admin/audit/verify, reporting whether the hash chain is intact.
+func (l *Log) VerifyHandler(w http.ResponseWriter, r *http.Request) {
+	v, err := l.Verify(r.Context())
+	if err != nil {
+		problem.Internal(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
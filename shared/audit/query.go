@@ -0,0 +1,113 @@
+package audit
+
+import (
+	"context"
+	"strconv"
+	"time"
+)
+
+// Filter selects entries for List. Zero fields match everything.
+type Filter struct {
+	Actor   string
+	Action  string
+	Target  string
+	Outcome string
+	Since   time.Time
+	Until   time.Time
+	// BeforeID pages backwards: only entries with a smaller ID are returned.
+	BeforeID int64
+	Limit    int
+}
+
+// List returns the entries matching f, newest first.
+func (l *Log) List(ctx context.Context, f Filter) ([]Entry, error) {
+	query := "SELECT id, time, actor, action, target, ip, user_agent, outcome, prev_hash, hash FROM audit_log WHERE TRUE"
+	var args []interface{}
+	where := func(cond string, arg interface{}) {
+		args = append(args, arg)
+		query += " AND " + cond + " $" + strconv.Itoa(len(args))
+	}
+	if f.Actor != "" {
+		where("actor =", f.Actor)
+	}
+	if f.Action != "" {
+		where("action =", f.Action)
+	}
+	if f.Target != "" {
+		where("target =", f.Target)
+	}
+	if f.Outcome != "" {
+		where("outcome =", f.Outcome)
+	}
+	if !f.Since.IsZero() {
+		where("time >=", f.Since)
+	}
+	if !f.Until.IsZero() {
+		where("time <", f.Until)
+	}
+	if f.BeforeID > 0 {
+		where("id <", f.BeforeID)
+	}
+	args = append(args, f.Limit)
+	query += " ORDER BY id DESC LIMIT $" + strconv.Itoa(len(args))
+
+	rows, err := l.conn.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	entries := []Entry{}
+	for rows.Next() {
+		e, err := scanEntry(rows)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, *e)
+	}
+	return entries, rows.Err()
+}
+
+// Verification is the result of checking the hash chain.
+type Verification struct {
+	Valid   bool  `json:"valid"`
+	Entries int64 `json:"entries"`
+	// BrokenAt is the ID of the first entry whose hash or link does not match.
+	BrokenAt int64 `json:"broken_at,omitempty"`
+}
+
+// Verify recomputes the hash chain from the first entry to the last.
+func (l *Log) Verify(ctx context.Context) (*Verification, error) {
+	rows, err := l.conn.QueryContext(ctx, "SELECT id, time, actor, action, target, ip, user_agent, outcome, prev_hash, hash FROM audit_log ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	v := &Verification{Valid: true}
+	prev := ""
+	for rows.Next() {
+		e, err := scanEntry(rows)
+		if err != nil {
+			return nil, err
+		}
+		v.Entries++
+		if v.Valid && (e.PrevHash != prev || hash(e) != e.Hash) {
+			v.Valid = false
+			v.BrokenAt = e.ID
+		}
+		prev = e.Hash
+	}
+	return v, rows.Err()
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanEntry(row rowScanner) (*Entry, error) {
+	var e Entry
+	if err := row.Scan(&e.ID, &e.Time, &e.Actor, &e.Action, &e.Target, &e.IP, &e.UserAgent, &e.Outcome, &e.PrevHash, &e.Hash); err != nil {
+		return nil, err
+	}
+	e.Time = e.Time.UTC()
+	return &e, nil
+}
@@ -0,0 +1,103 @@
+// Package health serves the liveness and readiness probes. Liveness only says
+// the process is serving HTTP; readiness runs a check against every dependency
+// the service needs to do useful work.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// DefaultTimeout bounds how long a single readiness check may take.
+const DefaultTimeout = 2 * time.Second
+
+// CheckFunc reports whether a dependency is usable. It must respect ctx.
+type CheckFunc func(ctx context.Context) error
+
+// CheckResult is the outcome of one dependency check in a readiness response.
+type CheckResult struct {
+	Name      string  `json:"name"`
+	Status    string  `json:"status"` // ok or fail
+	LatencyMS float64 `json:"latency_ms"`
+}
+
+// Report is the body of a readiness response.
+type Report struct {
+	Status string        `json:"status"` // ok or unavailable
+	Checks []CheckResult `json:"checks"`
+}
+
+type check struct {
+	name string
+	fn   CheckFunc
+}
+
+// Checker holds the readiness checks of a service.
+type Checker struct {
+	Timeout time.Duration
+	checks  []check
+}
+
+func NewChecker() *Checker {
+	return &Checker{Timeout: DefaultTimeout}
+}
+
+// Add registers a named readiness check. Checks run in the order added.
+func (c *Checker) Add(name string, fn CheckFunc) {
+	c.checks = append(c.checks, check{name: name, fn: fn})
+}
+
+// Run executes every check concurrently and reports their combined status.
+func (c *Checker) Run(ctx context.Context) Report {
+	report := Report{Status: "ok", Checks: make([]CheckResult, len(c.checks))}
+	var wg sync.WaitGroup
+	for i, chk := range c.checks {
+		wg.Add(1)
+		go func(i int, chk check) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctx, c.Timeout)
+			defer cancel()
+			start := time.Now()
+			err := chk.fn(ctx)
+			result := CheckResult{
+				Name:      chk.name,
+				Status:    "ok",
+				LatencyMS: float64(time.Since(start).Microseconds()) / 1000,
+			}
+			if err != nil {
+				result.Status = "fail"
+				// Error strings can name hosts and credentials; keep them out of the unauthenticated response
+				slog.WarnContext(ctx, "Readiness check failed", "check", chk.name, "error", err)
+			}
+			report.Checks[i] = result
+		}(i, chk)
+	}
+	wg.Wait()
+	for _, result := range report.Checks {
+		if result.Status != "ok" {
+			report.Status = "unavailable"
+		}
+	}
+	return report
+}
+
+// Live handles GET /livez. It succeeds whenever the process can serve requests.
+func (c *Checker) Live(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+// Ready handles GET /readyz, answering 200 when every check passes and 503 otherwise.
+func (c *Checker) Ready(w http.ResponseWriter, r *http.Request) {
+	report := c.Run(r.Context())
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if report.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,295 @@
+// Package idempotency makes POST requests safe to retry. A client sends an
+// Idempotency-Key header; the first request with a key runs normally and its
+// response is stored, and later requests with the same key and body get the
+// stored response back instead of running again.
+package idempotency
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"shared/audit"
+	"shared/problem"
+	"shared/validate"
+	"time"
+)
+
+const (
+	// Header is the request header carrying the idempotency key.
+	Header = "Idempotency-Key"
+	// ReplayedHeader marks responses that were replayed from the store.
+	ReplayedHeader = "Idempotent-Replayed"
+
+	maxKeyLength = 255
+	// abandonAfter is how long a request may hold a key before the key is
+	// considered abandoned, for example because the instance crashed.
+	abandonAfter = time.Minute
+)
+
+// replayedHeaders are the response headers stored and replayed with the body.
+var replayedHeaders = []string{"Content-Type", "Location", "ETag"}
+
+// Store keeps idempotency keys and the responses they produced in the
+// service's database for the configured window.
+type Store struct {
+	conn *sql.DB
+	keys keys
+}
+
+func New(conn *sql.DB, window time.Duration) *Store {
+	return &Store{conn: conn, keys: sqlKeys{conn: conn, window: window}}
+}
+
+// keys holds the claimed keys and their responses: the database in
+// production, a map in tests.
+type keys interface {
+	// claim reserves key for a new request and returns nil, or returns the
+	// record already stored for it.
+	claim(ctx context.Context, principal, key, fp string) (*record, error)
+	// complete stores the response of the request holding key.
+	complete(ctx context.Context, principal, key string, rec *record) error
+	// release frees key so the request can be retried.
+	release(ctx context.Context, principal, key string) error
+}
+
+// EnsureTable creates the idempotency key table.
+func (s *Store) EnsureTable() error {
+	_, err := s.conn.Exec(`
+	CREATE TABLE IF NOT EXISTS idempotency_keys (
+		principal TEXT NOT NULL,
+		key TEXT NOT NULL,
+		fingerprint TEXT NOT NULL,
+		status_code INT,
+		headers JSONB,
+		body BYTEA,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		expires_at TIMESTAMPTZ NOT NULL,
+		PRIMARY KEY (principal, key)
+	)`)
+	if err != nil {
+		return err
+	}
+	_, err = s.conn.Exec(`CREATE INDEX IF NOT EXISTS idempotency_keys_expires_at_idx ON idempotency_keys (expires_at)`)
+	return err
+}
+
+// Purge removes keys whose window has passed and returns how many there were.
+func (s *Store) Purge(ctx context.Context) (int64, error) {
+	res, err := s.conn.ExecContext(ctx, "DELETE FROM idempotency_keys WHERE expires_at <= now()")
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// record is a stored key. StatusCode is nil while the first request runs.
+type record struct {
+	Fingerprint string
+	StatusCode  *int
+	Headers     map[string]string
+	Body        []byte
+}
+
+// Handler applies idempotency keys to the POST requests handled by next.
+// Keys are scoped to the caller, so it must run after JWT validation.
+// Requests without a key, and other methods, pass straight through.
+//
+// A retry with the same key and body gets the stored response with an
+// Idempotent-Replayed header. Reusing a key with a different body is
+// rejected with 422, and a retry while the first request is still running
+// with 409. Server errors are not stored, so the request can be retried.
+func (s *Store) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(Header)
+		if r.Method != http.MethodPost || key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !validKey(key) {
+			problem.Validation(w, r, []problem.FieldError{{Field: Header, Code: "invalid", Message: "must be at most 255 printable ASCII characters"}})
+			return
+		}
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, validate.MaxBodyBytes))
+		if err != nil {
+			validate.WriteDecodeError(w, r, err)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		ctx := r.Context()
+		principal := audit.Actor(ctx)
+		fp := fingerprint(r, body)
+		existing, err := s.keys.claim(ctx, principal, key, fp)
+		if err != nil {
+			problem.Internal(w, r, err)
+			return
+		}
+		if existing != nil {
+			switch {
+			case existing.Fingerprint != fp:
+				problem.Write(w, r, http.StatusUnprocessableEntity, problem.CodeIdempotencyKeyReused, "The idempotency key was already used for a different request.")
+			case existing.StatusCode == nil:
+				problem.Write(w, r, http.StatusConflict, problem.CodeIdempotencyKeyInUse, "A request with this idempotency key is still being processed.")
+			default:
+				slog.InfoContext(ctx, "Replaying idempotent response", "key", key, "principal", principal, "status", *existing.StatusCode)
+				for name, value := range existing.Headers {
+					w.Header().Set(name, value)
+				}
+				w.Header().Set(ReplayedHeader, "true")
+				w.WriteHeader(*existing.StatusCode)
+				w.Write(existing.Body)
+			}
+			return
+		}
+
+		rec := &recorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		// The response is already sent; store it even if the client has gone
+		ctx = context.WithoutCancel(ctx)
+		if err := s.complete(ctx, principal, key, rec); err != nil {
+			slog.ErrorContext(ctx, "Failed to store idempotent response", "key", key, "principal", principal, "error", err)
+		}
+	})
+}
+
+// sqlKeys keeps keys in the idempotency_keys table.
+type sqlKeys struct {
+	conn   *sql.DB
+	window time.Duration
+}
+
+// claim reclaims expired and abandoned keys before reserving key.
+func (s sqlKeys) claim(ctx context.Context, principal, key, fp string) (*record, error) {
+	for attempt := 0; attempt < 3; attempt++ {
+		_, err := s.conn.ExecContext(ctx,
+			"DELETE FROM idempotency_keys WHERE principal = $1 AND key = $2 AND (expires_at <= now() OR (status_code IS NULL AND created_at <= $3))",
+			principal, key, time.Now().Add(-abandonAfter),
+		)
+		if err != nil {
+			return nil, err
+		}
+		res, err := s.conn.ExecContext(ctx,
+			"INSERT INTO idempotency_keys (principal, key, fingerprint, expires_at) VALUES ($1, $2, $3, $4) ON CONFLICT DO NOTHING",
+			principal, key, fp, time.Now().Add(s.window),
+		)
+		if err != nil {
+			return nil, err
+		}
+		if n, err := res.RowsAffected(); err != nil || n == 1 {
+			return nil, err
+		}
+		var rec record
+		var headers []byte
+		err = s.conn.QueryRowContext(ctx,
+			"SELECT fingerprint, status_code, headers, body FROM idempotency_keys WHERE principal = $1 AND key = $2",
+			principal, key,
+		).Scan(&rec.Fingerprint, &rec.StatusCode, &headers, &rec.Body)
+		if err == sql.ErrNoRows {
+			continue // Released by a failed request in the meantime
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(headers) > 0 {
+			if err := json.Unmarshal(headers, &rec.Headers); err != nil {
+				return nil, err
+			}
+		}
+		return &rec, nil
+	}
+	return nil, errors.New("idempotency key kept changing while it was claimed")
+}
+
+// complete stores the response of the request holding key, or releases the
+// key if the request failed with a server error.
+func (s *Store) complete(ctx context.Context, principal, key string, rec *recorder) error {
+	status := rec.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	if status >= 500 {
+		return s.keys.release(ctx, principal, key)
+	}
+	headers := map[string]string{}
+	for _, name := range replayedHeaders {
+		if value := rec.Header().Get(name); value != "" {
+			headers[name] = value
+		}
+	}
+	return s.keys.complete(ctx, principal, key, &record{StatusCode: &status, Headers: headers, Body: rec.body.Bytes()})
+}
+
+func (s sqlKeys) complete(ctx context.Context, principal, key string, rec *record) error {
+	headers, err := json.Marshal(rec.Headers)
+	if err != nil {
+		return err
+	}
+	_, err = s.conn.ExecContext(ctx,
+		"UPDATE idempotency_keys SET status_code = $1, headers = $2, body = $3 WHERE principal = $4 AND key = $5",
+		*rec.StatusCode, headers, rec.Body, principal, key,
+	)
+	return err
+}
+
+func (s sqlKeys) release(ctx context.Context, principal, key string) error {
+	_, err := s.conn.ExecContext(ctx, "DELETE FROM idempotency_keys WHERE principal = $1 AND key = $2", principal, key)
+	return err
+}
+
+// fingerprint identifies a request by its method, path and body. JSON bodies
+// are compared by content, so re-encoding the same body is not a new request.
+func fingerprint(r *http.Request, body []byte) string {
+	h := sha256.New()
+	io.WriteString(h, r.Method+" "+r.URL.Path+"\n")
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err == nil && !dec.More() {
+		if canonical, err := json.Marshal(v); err == nil {
+			body = canonical
+		}
+	}
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func validKey(key string) bool {
+	if len(key) > maxKeyLength {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] < 0x20 || key[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// recorder passes a response through while keeping a copy of it.
+type recorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (r *recorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *recorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
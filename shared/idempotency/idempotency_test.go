@@ -0,0 +1,207 @@
+package idempotency
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"shared/problem"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// memKeys keeps keys in a map, like the table but without expiry.
+type memKeys struct {
+	mu      sync.Mutex
+	records map[string]*record
+}
+
+func newMemKeys() *memKeys {
+	return &memKeys{records: map[string]*record{}}
+}
+
+func (m *memKeys) claim(ctx context.Context, principal, key, fp string) (*record, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if rec, ok := m.records[principal+"\x00"+key]; ok {
+		copied := *rec
+		return &copied, nil
+	}
+	m.records[principal+"\x00"+key] = &record{Fingerprint: fp}
+	return nil, nil
+}
+
+func (m *memKeys) complete(ctx context.Context, principal, key string, rec *record) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stored := m.records[principal+"\x00"+key]
+	stored.StatusCode, stored.Headers, stored.Body = rec.StatusCode, rec.Headers, rec.Body
+	return nil
+}
+
+func (m *memKeys) release(ctx context.Context, principal, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.records, principal+"\x00"+key)
+	return nil
+}
+
+// testServer counts the requests that reach the wrapped handler and answers
+// them with respond.
+type testServer struct {
+	store   *Store
+	keys    *memKeys
+	calls   int
+	respond func(w http.ResponseWriter, r *http.Request)
+}
+
+func newTestServer(respond func(w http.ResponseWriter, r *http.Request)) *testServer {
+	keys := newMemKeys()
+	return &testServer{store: &Store{keys: keys}, keys: keys, respond: respond}
+}
+
+func (ts *testServer) do(t *testing.T, user, key, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodPost, "/products", strings.NewReader(body))
+	if key != "" {
+		r.Header.Set(Header, key)
+	}
+	r = r.WithContext(context.WithValue(r.Context(), "username", user))
+	w := httptest.NewRecorder()
+	ts.store.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ts.calls++
+		ts.respond(w, r)
+	})).ServeHTTP(w, r)
+	return w
+}
+
+func created(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/products/1")
+	w.Header().Set("X-Not-Replayed", "1")
+	w.WriteHeader(http.StatusCreated)
+	w.Write([]byte(`{"id":"1"}`))
+}
+
+func problemCode(t *testing.T, w *httptest.ResponseRecorder) string {
+	t.Helper()
+	var p struct {
+		Code string `json:"code"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &p); err != nil {
+		t.Fatalf("decoding problem %q: %v", w.Body.String(), err)
+	}
+	return p.Code
+}
+
+func TestHandlerClaimsAndStoresResponse(t *testing.T) {
+	ts := newTestServer(created)
+	w := ts.do(t, "alice", "k1", `{"a":1}`)
+	if w.Code != http.StatusCreated || w.Body.String() != `{"id":"1"}` || w.Header().Get(ReplayedHeader) != "" {
+		t.Fatalf("first request = %d %q replayed=%q", w.Code, w.Body, w.Header().Get(ReplayedHeader))
+	}
+	rec := ts.keys.records["alice\x00k1"]
+	if rec == nil || rec.StatusCode == nil || *rec.StatusCode != http.StatusCreated || string(rec.Body) != `{"id":"1"}` {
+		t.Fatalf("stored record = %+v", rec)
+	}
+	if rec.Headers["Location"] != "/products/1" || rec.Headers["X-Not-Replayed"] != "" {
+		t.Errorf("stored headers = %v", rec.Headers)
+	}
+}
+
+func TestHandlerReplaysStoredResponse(t *testing.T) {
+	ts := newTestServer(created)
+	ts.do(t, "alice", "k1", `{"a":1,"b":[1,2]}`)
+	// The same JSON body encoded differently is the same request
+	w := ts.do(t, "alice", "k1", `{ "b": [1, 2], "a": 1 }`)
+	if ts.calls != 1 {
+		t.Fatalf("handler ran %d times, want 1", ts.calls)
+	}
+	if w.Code != http.StatusCreated || w.Body.String() != `{"id":"1"}` {
+		t.Errorf("replay = %d %q", w.Code, w.Body)
+	}
+	if w.Header().Get(ReplayedHeader) != "true" || w.Header().Get("Location") != "/products/1" || w.Header().Get("X-Not-Replayed") != "" {
+		t.Errorf("replay headers = %v", w.Header())
+	}
+}
+
+func TestHandlerRejectsKeyReusedForDifferentRequest(t *testing.T) {
+	ts := newTestServer(created)
+	ts.do(t, "alice", "k1", `{"a":1}`)
+	w := ts.do(t, "alice", "k1", `{"a":2}`)
+	if ts.calls != 1 {
+		t.Fatalf("handler ran %d times, want 1", ts.calls)
+	}
+	if w.Code != http.StatusUnprocessableEntity || problemCode(t, w) != problem.CodeIdempotencyKeyReused {
+		t.Errorf("reused key = %d %q", w.Code, w.Body)
+	}
+}
+
+func TestHandlerRejectsKeyInFlight(t *testing.T) {
+	var inner *httptest.ResponseRecorder
+	var ts *testServer
+	ts = newTestServer(func(w http.ResponseWriter, r *http.Request) {
+		// A retry arrives while the first request is still running
+		if inner == nil {
+			inner = ts.do(t, "alice", "k1", `{"a":1}`)
+		}
+		created(w, r)
+	})
+	ts.do(t, "alice", "k1", `{"a":1}`)
+	if ts.calls != 1 {
+		t.Fatalf("handler ran %d times, want 1", ts.calls)
+	}
+	if inner.Code != http.StatusConflict || problemCode(t, inner) != problem.CodeIdempotencyKeyInUse {
+		t.Errorf("in-flight retry = %d %q", inner.Code, inner.Body)
+	}
+}
+
+func TestHandlerReleasesKeyOnServerError(t *testing.T) {
+	status := http.StatusBadGateway
+	ts := newTestServer(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	})
+	if w := ts.do(t, "alice", "k1", `{"a":1}`); w.Code != http.StatusBadGateway {
+		t.Fatalf("first request = %d", w.Code)
+	}
+	if _, ok := ts.keys.records["alice\x00k1"]; ok {
+		t.Fatal("key still claimed after a server error")
+	}
+	status = http.StatusCreated
+	w := ts.do(t, "alice", "k1", `{"a":1}`)
+	if ts.calls != 2 || w.Code != http.StatusCreated || w.Header().Get(ReplayedHeader) != "" {
+		t.Errorf("retry = %d after %d calls", w.Code, ts.calls)
+	}
+}
+
+func TestHandlerScopesKeysToPrincipal(t *testing.T) {
+	ts := newTestServer(created)
+	ts.do(t, "alice", "k1", `{"a":1}`)
+	w := ts.do(t, "bob", "k1", `{"a":2}`)
+	if ts.calls != 2 || w.Code != http.StatusCreated || w.Header().Get(ReplayedHeader) != "" {
+		t.Errorf("other principal = %d after %d calls", w.Code, ts.calls)
+	}
+}
+
+func TestHandlerPassesThroughWithoutKey(t *testing.T) {
+	ts := newTestServer(created)
+	ts.do(t, "alice", "", `{"a":1}`)
+	ts.do(t, "alice", "", `{"a":1}`)
+	if ts.calls != 2 || len(ts.keys.records) != 0 {
+		t.Errorf("handler ran %d times with %d keys stored", ts.calls, len(ts.keys.records))
+	}
+}
+
+func TestHandlerRejectsInvalidKey(t *testing.T) {
+	ts := newTestServer(created)
+	for _, key := range []string{strings.Repeat("k", maxKeyLength+1), "bad\nkey", "ключ"} {
+		w := ts.do(t, "alice", key, `{"a":1}`)
+		if w.Code != http.StatusUnprocessableEntity || problemCode(t, w) != problem.CodeValidation {
+			t.Errorf("key %q = %d %q", key, w.Code, w.Body)
+		}
+	}
+	if ts.calls != 0 {
+		t.Errorf("handler ran %d times, want 0", ts.calls)
+	}
+}
@@ -0,0 +1,55 @@
+package metrics
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	pubsubPublished = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pubsub_messages_published_total",
+		Help: "Pub/Sub messages published, by topic and result (ok or error).",
+	}, []string{"topic", "result"})
+
+	pubsubReceived = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pubsub_messages_received_total",
+		Help: "Pub/Sub messages received, by subscription.",
+	}, []string{"subscription"})
+
+	pubsubHandled = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pubsub_messages_handled_total",
+		Help: "Pub/Sub messages handled, by subscription and outcome (ack or nack).",
+	}, []string{"subscription", "outcome"})
+
+	pubsubDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "pubsub_handler_duration_seconds",
+		Help:    "Time spent handling a Pub/Sub message, by subscription.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"subscription"})
+)
+
+// ObservePublish records the result of publishing a message to topic.
+func ObservePublish(topic string, err error) {
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	pubsubPublished.WithLabelValues(topic, result).Inc()
+}
+
+// ObserveReceived records that a message arrived on subscription.
+func ObserveReceived(subscription string) {
+	pubsubReceived.WithLabelValues(subscription).Inc()
+}
+
+// ObserveHandled records how a message received at start was settled.
+func ObserveHandled(subscription string, start time.Time, acked bool) {
+	outcome := "ack"
+	if !acked {
+		outcome = "nack"
+	}
+	pubsubHandled.WithLabelValues(subscription, outcome).Inc()
+	pubsubDuration.WithLabelValues(subscription).Observe(time.Since(start).Seconds())
+}
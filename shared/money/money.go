@@ -0,0 +1,113 @@
+// Package money represents monetary amounts as integer minor units of an
+// ISO 4217 currency. It is shared by the products, orders and payment services.
+package money
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+)
+
+// DefaultCurrency is assumed for amounts stored before currencies were tracked.
+const DefaultCurrency = "USD"
+
+var (
+	// ErrUnknownCurrency is returned for codes that are not supported ISO 4217 currencies.
+	ErrUnknownCurrency = errors.New("unknown currency")
+	// ErrCurrencyMismatch is returned when combining amounts in different currencies.
+	ErrCurrencyMismatch = errors.New("currency mismatch")
+	// ErrOverflow is returned when a result does not fit in an int64 of minor units.
+	ErrOverflow = errors.New("amount out of range")
+)
+
+// minorUnits maps supported ISO 4217 codes to the number of decimal places of their minor unit.
+var minorUnits = map[string]int{
+	"AUD": 2, "BHD": 3, "BRL": 2, "CAD": 2, "CHF": 2, "CNY": 2, "CZK": 2,
+	"DKK": 2, "EUR": 2, "GBP": 2, "HKD": 2, "HUF": 2, "IDR": 2, "ILS": 2,
+	"INR": 2, "JOD": 3, "JPY": 0, "KRW": 0, "KWD": 3, "MXN": 2, "NOK": 2,
+	"NZD": 2, "OMR": 3, "PLN": 2, "SAR": 2, "SEK": 2, "SGD": 2, "THB": 2,
+	"TRY": 2, "USD": 2, "ZAR": 2,
+}
+
+// Money is an amount in the minor unit of its currency, e.g. {1999, "USD"} is $19.99.
+type Money struct {
+	Amount   int64  `json:"amount" validate:"min=0"`
+	Currency string `json:"currency" validate:"required"`
+}
+
+// New returns an amount of minor units in the given currency.
+func New(amount int64, currency string) (Money, error) {
+	m := Money{Amount: amount, Currency: strings.ToUpper(currency)}
+	return m, m.Validate()
+}
+
+// IsKnownCurrency reports whether code is a supported ISO 4217 currency code.
+func IsKnownCurrency(code string) bool {
+	_, ok := minorUnits[code]
+	return ok
+}
+
+// Validate checks that the currency is a supported ISO 4217 code.
+func (m Money) Validate() error {
+	if !IsKnownCurrency(m.Currency) {
+		return fmt.Errorf("%w: %q", ErrUnknownCurrency, m.Currency)
+	}
+	return nil
+}
+
+// Add returns m + o. Both amounts must be in the same currency.
+func (m Money) Add(o Money) (Money, error) {
+	if m.Currency != o.Currency {
+		return Money{}, fmt.Errorf("%w: %s and %s", ErrCurrencyMismatch, m.Currency, o.Currency)
+	}
+	sum := m.Amount + o.Amount
+	if (o.Amount > 0 && sum < m.Amount) || (o.Amount < 0 && sum > m.Amount) {
+		return Money{}, fmt.Errorf("%w: %s + %s", ErrOverflow, m, o)
+	}
+	return Money{Amount: sum, Currency: m.Currency}, nil
+}
+
+// Mul returns m multiplied by a quantity.
+func (m Money) Mul(n int64) (Money, error) {
+	product := m.Amount * n
+	if m.Amount != 0 && (product/m.Amount != n || (m.Amount == -1 && n == math.MinInt64)) {
+		return Money{}, fmt.Errorf("%w: %s * %d", ErrOverflow, m, n)
+	}
+	return Money{Amount: product, Currency: m.Currency}, nil
+}
+
+// Equal reports whether both amount and currency match.
+func (m Money) Equal(o Money) bool {
+	return m.Amount == o.Amount && m.Currency == o.Currency
+}
+
+// Sum adds amounts that must all share one currency. The sum of no amounts is zero in currency.
+func Sum(currency string, amounts ...Money) (Money, error) {
+	total := Money{Currency: currency}
+	for _, a := range amounts {
+		var err error
+		if total, err = total.Add(a); err != nil {
+			return Money{}, err
+		}
+	}
+	return total, nil
+}
+
+// String formats the amount in major units, e.g. "19.99 USD".
+func (m Money) String() string {
+	digits := minorUnits[m.Currency]
+	if digits == 0 {
+		return fmt.Sprintf("%d %s", m.Amount, m.Currency)
+	}
+	scale := uint64(1)
+	for i := 0; i < digits; i++ {
+		scale *= 10
+	}
+	// Negating in uint64 keeps the smallest int64 intact
+	sign, amount := "", uint64(m.Amount)
+	if m.Amount < 0 {
+		sign, amount = "-", -amount
+	}
+	return fmt.Sprintf("%s%d.%0*d %s", sign, amount/scale, digits, amount%scale, m.Currency)
+}
@@ -0,0 +1,75 @@
+package money
+
+import (
+	"errors"
+	"math"
+	"testing"
+)
+
+func TestAdd(t *testing.T) {
+	tests := []struct {
+		name    string
+		a, b    Money
+		want    Money
+		wantErr error
+	}{
+		{"sum", Money{150, "USD"}, Money{250, "USD"}, Money{400, "USD"}, nil},
+		{"negative", Money{150, "USD"}, Money{-250, "USD"}, Money{-100, "USD"}, nil},
+		{"currency mismatch", Money{150, "USD"}, Money{250, "EUR"}, Money{}, ErrCurrencyMismatch},
+		{"overflow", Money{math.MaxInt64, "USD"}, Money{1, "USD"}, Money{}, ErrOverflow},
+		{"underflow", Money{math.MinInt64, "USD"}, Money{-1, "USD"}, Money{}, ErrOverflow},
+		{"largest", Money{math.MaxInt64 - 1, "USD"}, Money{1, "USD"}, Money{math.MaxInt64, "USD"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.a.Add(tt.b)
+			if !errors.Is(err, tt.wantErr) || got != tt.want {
+				t.Errorf("%v.Add(%v) = %v, %v; want %v, %v", tt.a, tt.b, got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMul(t *testing.T) {
+	tests := []struct {
+		name    string
+		m       Money
+		n       int64
+		want    Money
+		wantErr error
+	}{
+		{"product", Money{1999, "USD"}, 3, Money{5997, "USD"}, nil},
+		{"zero amount", Money{0, "USD"}, math.MaxInt64, Money{0, "USD"}, nil},
+		{"zero quantity", Money{1999, "USD"}, 0, Money{0, "USD"}, nil},
+		{"overflow", Money{math.MaxInt64/2 + 1, "USD"}, 2, Money{}, ErrOverflow},
+		{"large quantity", Money{1999, "USD"}, math.MaxInt64 / 1000, Money{}, ErrOverflow},
+		{"smallest negated", Money{-1, "USD"}, math.MinInt64, Money{}, ErrOverflow},
+		{"smallest times minus one", Money{math.MinInt64, "USD"}, -1, Money{}, ErrOverflow},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.m.Mul(tt.n)
+			if !errors.Is(err, tt.wantErr) || got != tt.want {
+				t.Errorf("%v.Mul(%d) = %v, %v; want %v, %v", tt.m, tt.n, got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestString(t *testing.T) {
+	tests := []struct {
+		m    Money
+		want string
+	}{
+		{Money{1999, "USD"}, "19.99 USD"},
+		{Money{-5, "EUR"}, "-0.05 EUR"},
+		{Money{1500, "JPY"}, "1500 JPY"},
+		{Money{1234, "KWD"}, "1.234 KWD"},
+		{Money{math.MinInt64, "USD"}, "-92233720368547758.08 USD"},
+	}
+	for _, tt := range tests {
+		if got := tt.m.String(); got != tt.want {
+			t.Errorf("String() = %q, want %q", got, tt.want)
+		}
+	}
+}
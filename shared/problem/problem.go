@@ -0,0 +1,130 @@
+// Package problem writes RFC 7807 application/problem+json error responses.
+package problem
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"shared/requestid"
+)
+
+// ContentType is the media type of problem responses.
+const ContentType = "application/problem+json"
+
+// Stable error codes. Clients may rely on these; never change an existing value.
+const (
+	CodeBadRequest           = "bad_request"
+	CodeValidation           = "validation_failed"
+	CodeUnauthorized         = "unauthorized"
+	CodeForbidden            = "forbidden"
+	CodeNotFound             = "not_found"
+	CodeMethodNotAllowed     = "method_not_allowed"
+	CodeNotAcceptable        = "not_acceptable"
+	CodeConflict             = "conflict"
+	CodePreconditionFailed   = "precondition_failed"
+	CodeUnsupportedMediaType = "unsupported_media_type"
+	CodeInternal             = "internal_error"
+	CodeBadGateway           = "bad_gateway"
+	CodePayloadTooLarge      = "payload_too_large"
+	CodeInsufficientScope    = "insufficient_scope"
+
+	// Shared by services that reserve stock, price orders or replay requests.
+	CodeInsufficientStock    = "insufficient_stock"
+	CodeUnknownCurrency      = "unknown_currency"
+	CodeIdempotencyKeyReused = "idempotency_key_reused"
+	CodeIdempotencyKeyInUse  = "idempotency_key_in_use"
+	CodeRateLimited          = "rate_limited"
+
+	// Products
+	CodeProductNotFound     = "product_not_found"
+	CodeProductExists       = "product_already_exists"
+	CodeSKUExists           = "sku_already_exists"
+	CodeReservationNotFound = "reservation_not_found"
+	CodeVersionConflict     = "version_conflict"
+	CodeReservationState    = "invalid_reservation_state"
+	CodeStockBelowReserved  = "stock_below_reserved"
+
+	// Orders
+	CodeOrderNotFound    = "order_not_found"
+	CodeOrderCancelled   = "order_already_cancelled"
+	CodeCurrencyMismatch = "currency_mismatch"
+	CodeAmountOutOfRange = "amount_out_of_range"
+	CodeSagaNotFound     = "saga_not_found"
+
+	// Payment
+	CodePaymentNotFound = "payment_not_found"
+
+	// Authentication
+	CodeInvalidCredentials = "invalid_credentials"
+	CodeUserExists         = "user_already_exists"
+	CodeEmailExists        = "email_already_exists"
+	CodeEmailNotVerified   = "email_not_verified"
+	CodeUserNotFound       = "user_not_found"
+	CodeAccountLocked      = "account_locked"
+	CodeInvalidToken       = "invalid_token"
+	CodeInvalidMFACode     = "invalid_mfa_code"
+	CodeMFAAlreadyEnabled  = "mfa_already_enabled"
+	CodeClientExists       = "client_already_exists"
+	CodeClientNotFound     = "client_not_found"
+
+	// Gateway
+	CodeServiceUnavailable = "service_unavailable"
+	CodeGatewayTimeout     = "gateway_timeout"
+)
+
+// FieldError describes why a single request field was rejected.
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Problem is an RFC 7807 problem details object extended with a stable code,
+// the request ID and per-field validation errors.
+type Problem struct {
+	Type      string       `json:"type"`
+	Title     string       `json:"title"`
+	Status    int          `json:"status"`
+	Detail    string       `json:"detail,omitempty"`
+	Instance  string       `json:"instance,omitempty"`
+	Code      string       `json:"code"`
+	RequestID string       `json:"request_id,omitempty"`
+	Errors    []FieldError `json:"errors,omitempty"`
+}
+
+// Write sends a problem response with the given status, code and human readable detail.
+func Write(w http.ResponseWriter, r *http.Request, status int, code, detail string) {
+	write(w, r, Problem{Status: status, Code: code, Detail: detail})
+}
+
+// Validation sends 422 Unprocessable Entity listing every rejected field.
+func Validation(w http.ResponseWriter, r *http.Request, errs []FieldError) {
+	write(w, r, Problem{
+		Status: http.StatusUnprocessableEntity,
+		Code:   CodeValidation,
+		Detail: "The request contains invalid fields.",
+		Errors: errs,
+	})
+}
+
+// Internal logs err together with the request ID and sends a generic 500
+// response. The error itself is never shown to the caller.
+func Internal(w http.ResponseWriter, r *http.Request, err error) {
+	slog.ErrorContext(r.Context(), "Internal error", "method", r.Method, "path", r.URL.Path, "error", err)
+	Write(w, r, http.StatusInternalServerError, CodeInternal, "An unexpected error occurred.")
+}
+
+// MethodNotAllowed sends 405 Method Not Allowed.
+func MethodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	Write(w, r, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "Method "+r.Method+" is not allowed on this resource.")
+}
+
+func write(w http.ResponseWriter, r *http.Request, p Problem) {
+	p.Type = "urn:problem-type:" + p.Code
+	p.Title = http.StatusText(p.Status)
+	p.Instance = r.URL.Path
+	p.RequestID = requestid.FromContext(r.Context())
+	w.Header().Set("Content-Type", ContentType)
+	w.WriteHeader(p.Status)
+	json.NewEncoder(w).Encode(p)
+}
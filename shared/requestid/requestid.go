@@ -0,0 +1,66 @@
+// Package requestid assigns every HTTP request an ID that is echoed to the
+// caller and available to handlers for logging and error responses.
+package requestid
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+
+	"github.com/google/uuid"
+)
+
+// Header is the HTTP header carrying the request ID in both directions.
+const Header = "X-Request-ID"
+
+type contextKey struct{}
+
+// validID limits caller-supplied IDs to something safe to log and echo back.
+var validID = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// Middleware reuses a well-formed incoming X-Request-ID or generates a new one,
+// sets it on the response and stores it in the request context.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(Header)
+		if !validID.MatchString(id) {
+			id = uuid.NewString()
+		}
+		w.Header().Set(Header, id)
+		next.ServeHTTP(w, r.WithContext(NewContext(r.Context(), id)))
+	})
+}
+
+// NewContext returns a copy of ctx carrying the request ID.
+func NewContext(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, contextKey{}, id)
+}
+
+// FromContext returns the request ID stored in ctx, or "" if there is none.
+func FromContext(ctx context.Context) string {
+	id, _ := ctx.Value(contextKey{}).(string)
+	return id
+}
+
+// Attribute is the Pub/Sub message attribute that carries the request ID to
+// consumers, so the work a message causes is logged under the same ID.
+const Attribute = "correlation_id"
+
+// Attributes returns message attributes carrying the request ID stored in ctx.
+func Attributes(ctx context.Context) map[string]string {
+	attrs := map[string]string{}
+	if id := FromContext(ctx); id != "" {
+		attrs[Attribute] = id
+	}
+	return attrs
+}
+
+// FromAttributes returns a copy of ctx carrying the correlation ID from
+// message attributes, or a new ID if the publisher did not set a valid one.
+func FromAttributes(ctx context.Context, attrs map[string]string) context.Context {
+	id := attrs[Attribute]
+	if !validID.MatchString(id) {
+		id = uuid.NewString()
+	}
+	return NewContext(ctx, id)
+}
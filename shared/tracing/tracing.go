@@ -0,0 +1,132 @@
+// Package tracing configures OpenTelemetry tracing: the tracer provider and
+// exporter, HTTP server and client spans, database/sql spans and propagation
+// of trace context through Pub/Sub message attributes.
+package tracing
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/XSAM/otelsql"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Setup installs the global tracer provider and the W3C trace context
+// propagator. exporter is "otlp" (OTLP over HTTP configured by the standard
+// OTEL_EXPORTER_OTLP_* variables), "stdout" for local runs, or "none".
+// Sampling follows OTEL_TRACES_SAMPLER.
+// The returned function flushes pending spans and must be called on exit.
+func Setup(ctx context.Context, service, exporterName string) (func(context.Context) error, error) {
+	tracerName = service
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch name := strings.ToLower(strings.TrimSpace(exporterName)); name {
+	case "", "otlp":
+		exporter, err = otlptracehttp.New(ctx)
+	case "stdout", "console":
+		exporter, err = stdouttrace.New(stdouttrace.WithPrettyPrint())
+	case "none":
+		return func(context.Context) error { return nil }, nil
+	default:
+		return nil, fmt.Errorf("unknown OTEL_TRACES_EXPORTER %q", name)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(semconv.ServiceName(service)))
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// tracerName names the tracer returned by Tracer; Setup sets it to the service name.
+var tracerName = "shared/tracing"
+
+// Tracer returns the tracer used for spans created by the service's own code.
+func Tracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
+
+// Middleware starts a server span for every request and continues any trace
+// propagated by the caller. It must wrap the ServeMux closely enough to see the
+// matched pattern, which names the span once the request has been routed.
+func Middleware(next http.Handler) http.Handler {
+	named := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r)
+		if r.Pattern != "" {
+			span := trace.SpanFromContext(r.Context())
+			span.SetName(r.Method + " " + r.Pattern)
+			span.SetAttributes(semconv.HTTPRoute(r.Pattern))
+		}
+	})
+	return otelhttp.NewHandler(named, "http.request",
+		otelhttp.WithFilter(func(r *http.Request) bool {
+			switch r.URL.Path {
+			case "/health", "/livez", "/readyz", "/metrics":
+				return false
+			}
+			return true
+		}),
+	)
+}
+
+// Transport wraps base so outgoing requests are traced and carry the trace context.
+func Transport(base http.RoundTripper) http.RoundTripper {
+	return otelhttp.NewTransport(base)
+}
+
+// OpenDB opens a database whose queries are recorded as spans. Only queries
+// made with a context that already carries a span are traced, so startup
+// migrations do not produce stray root spans.
+func OpenDB(driverName, dsn string) (*sql.DB, error) {
+	return otelsql.Open(driverName, dsn,
+		otelsql.WithAttributes(semconv.DBSystemPostgreSQL),
+		otelsql.WithSpanOptions(otelsql.SpanOptions{
+			OmitConnResetSession: true,
+			OmitRows:             true,
+			SpanFilter: func(ctx context.Context, _ otelsql.Method, _ string, _ []driver.NamedValue) bool {
+				return trace.SpanContextFromContext(ctx).IsValid()
+			},
+		}),
+	)
+}
+
+// Inject writes the trace context of ctx into Pub/Sub message attributes.
+func Inject(ctx context.Context, attrs map[string]string) {
+	otel.GetTextMapPropagator().Inject(ctx, propagation.MapCarrier(attrs))
+}
+
+// Extract returns a copy of ctx carrying the trace context found in message attributes.
+func Extract(ctx context.Context, attrs map[string]string) context.Context {
+	return otel.GetTextMapPropagator().Extract(ctx, propagation.MapCarrier(attrs))
+}
+
+// MessagingAttributes describes a Pub/Sub destination on publish and receive spans.
+func MessagingAttributes(destination string) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		semconv.MessagingSystemGCPPubsub,
+		semconv.MessagingDestinationName(destination),
+	}
+}
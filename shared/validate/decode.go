@@ -0,0 +1,73 @@
+package validate
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"shared/problem"
+)
+
+// MaxBodyBytes is the largest JSON request body accepted by DecodeJSON.
+const MaxBodyBytes = 1 << 20
+
+// DecodeJSON strictly decodes the request body into dst and validates it.
+// Bodies larger than MaxBodyBytes, unknown fields, trailing data and malformed
+// JSON are rejected. On failure it writes the problem response (400, 413 or
+// 422) and returns false.
+func DecodeJSON(w http.ResponseWriter, r *http.Request, dst interface{}) bool {
+	r.Body = http.MaxBytesReader(w, r.Body, MaxBodyBytes)
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(dst); err != nil {
+		writeDecodeError(w, r, err)
+		return false
+	}
+	if err := dec.Decode(&struct{}{}); err != io.EOF {
+		problem.Write(w, r, http.StatusBadRequest, problem.CodeBadRequest, "Request body must contain a single JSON value.")
+		return false
+	}
+	if errs := Struct(dst); len(errs) > 0 {
+		problem.Validation(w, r, errs)
+		return false
+	}
+	return true
+}
+
+// LimitBody caps the request body at MaxBodyBytes for handlers that decode it themselves.
+func LimitBody(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, MaxBodyBytes)
+}
+
+// WriteDecodeError reports a body decoding failure from a handler that decodes the body itself.
+func WriteDecodeError(w http.ResponseWriter, r *http.Request, err error) {
+	writeDecodeError(w, r, err)
+}
+
+func writeDecodeError(w http.ResponseWriter, r *http.Request, err error) {
+	var maxBytesErr *http.MaxBytesError
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &maxBytesErr):
+		problem.Write(w, r, http.StatusRequestEntityTooLarge, problem.CodePayloadTooLarge, fmt.Sprintf("Request body must not exceed %d bytes.", maxBytesErr.Limit))
+	case errors.Is(err, io.EOF):
+		problem.Write(w, r, http.StatusBadRequest, problem.CodeBadRequest, "Request body must not be empty.")
+	case errors.As(err, &syntaxErr), errors.Is(err, io.ErrUnexpectedEOF):
+		problem.Write(w, r, http.StatusBadRequest, problem.CodeBadRequest, "Request body is not valid JSON.")
+	case errors.As(err, &typeErr):
+		problem.Validation(w, r, []problem.FieldError{{
+			Field:   typeErr.Field,
+			Code:    "type",
+			Message: "must be of type " + typeErr.Type.String(),
+		}})
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		field := strings.Trim(strings.TrimPrefix(err.Error(), "json: unknown field "), `"`)
+		problem.Validation(w, r, []problem.FieldError{{Field: field, Code: "unknown_field", Message: "is not a recognised field"}})
+	default:
+		problem.Write(w, r, http.StatusBadRequest, problem.CodeBadRequest, "Request body could not be decoded.")
+	}
+}
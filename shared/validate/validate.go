@@ -0,0 +1,220 @@
+// Package validate checks decoded request bodies against `validate` struct tags
+// and decodes JSON bodies strictly.
+//
+// Supported rules, separated by commas:
+//
+//	required   strings must not be blank, slices and maps must not be empty,
+//	           numbers must not be zero and pointers must not be nil
+//	min=N      minimum string length (in characters), collection length or number value
+//	max=N      maximum string length (in characters), collection length or number value
+//	email      a bare email address such as user@example.com
+//	oneof=a b  the value must be one of the space separated options
+//	dive       rules after dive apply to every element of a slice
+//
+// Nested structs are always validated. Values implementing Validate() error are
+// checked as well once their fields pass, so domain types can add rules tags
+// cannot express.
+package validate
+
+import (
+	"fmt"
+	"net/mail"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"shared/problem"
+)
+
+type selfValidator interface {
+	Validate() error
+}
+
+// Struct validates v, which must be a struct or a pointer to one, and returns
+// an error for every failing field. Field names follow the JSON names, e.g.
+// "products[2].price".
+func Struct(v interface{}) []problem.FieldError {
+	var errs []problem.FieldError
+	walk(reflect.ValueOf(v), "", &errs)
+	return errs
+}
+
+func walk(v reflect.Value, path string, errs *[]problem.FieldError) {
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return
+		}
+		v = v.Elem()
+	}
+	before := len(*errs)
+	defer func() {
+		// Only ask the value to validate itself if its fields are individually valid
+		if len(*errs) > before || !v.CanInterface() {
+			return
+		}
+		if sv, ok := v.Interface().(selfValidator); ok {
+			if err := sv.Validate(); err != nil {
+				*errs = append(*errs, problem.FieldError{Field: path, Code: "invalid", Message: err.Error()})
+			}
+		}
+	}()
+	switch v.Kind() {
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if !f.IsExported() {
+				continue
+			}
+			if f.Anonymous {
+				walk(v.Field(i), path, errs)
+				continue
+			}
+			name := jsonName(f)
+			if name == "-" {
+				continue
+			}
+			fieldPath := join(path, name)
+			rules, elemRules, dive := splitRules(f.Tag.Get("validate"))
+			if !check(v.Field(i), fieldPath, rules, errs) {
+				continue
+			}
+			if dive && v.Field(i).Kind() == reflect.Slice {
+				for j := 0; j < v.Field(i).Len(); j++ {
+					elemPath := fmt.Sprintf("%s[%d]", fieldPath, j)
+					if check(v.Field(i).Index(j), elemPath, elemRules, errs) {
+						walk(v.Field(i).Index(j), elemPath, errs)
+					}
+				}
+				continue
+			}
+			walk(v.Field(i), fieldPath, errs)
+		}
+	case reflect.Slice, reflect.Array:
+		for j := 0; j < v.Len(); j++ {
+			walk(v.Index(j), fmt.Sprintf("%s[%d]", path, j), errs)
+		}
+	}
+}
+
+// check applies rules to a single value and reports whether it passed all of them.
+func check(v reflect.Value, path string, rules []string, errs *[]problem.FieldError) bool {
+	ok := true
+	for _, rule := range rules {
+		name, arg, _ := strings.Cut(rule, "=")
+		if msg := apply(v, name, arg); msg != "" {
+			*errs = append(*errs, problem.FieldError{Field: path, Code: name, Message: msg})
+			ok = false
+			if name == "required" {
+				// Further rules would only repeat that the value is missing
+				break
+			}
+		}
+	}
+	return ok
+}
+
+// apply returns a message describing why v fails rule, or "" if it passes.
+func apply(v reflect.Value, rule, arg string) string {
+	switch rule {
+	case "required":
+		if isEmpty(v) {
+			return "is required"
+		}
+	case "min", "max":
+		limit, err := strconv.ParseFloat(arg, 64)
+		if err != nil {
+			panic(fmt.Sprintf("validate: bad %s argument %q", rule, arg))
+		}
+		size, unit := measure(v)
+		if rule == "min" && size < limit {
+			return fmt.Sprintf("must be at least %s%s", arg, unit)
+		}
+		if rule == "max" && size > limit {
+			return fmt.Sprintf("must be at most %s%s", arg, unit)
+		}
+	case "email":
+		s := v.String()
+		if s == "" {
+			return ""
+		}
+		addr, err := mail.ParseAddress(s)
+		if err != nil || addr.Address != s {
+			return "must be a valid email address"
+		}
+	case "oneof":
+		s := fmt.Sprint(v.Interface())
+		for _, option := range strings.Fields(arg) {
+			if s == option {
+				return ""
+			}
+		}
+		return "must be one of: " + strings.Join(strings.Fields(arg), ", ")
+	default:
+		panic("validate: unknown rule " + rule)
+	}
+	return ""
+}
+
+func isEmpty(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.String:
+		return strings.TrimSpace(v.String()) == ""
+	case reflect.Slice, reflect.Map, reflect.Array:
+		return v.Len() == 0
+	case reflect.Ptr, reflect.Interface:
+		return v.IsNil()
+	default:
+		return v.IsZero()
+	}
+}
+
+// measure returns the quantity min and max compare against and its unit for messages.
+func measure(v reflect.Value) (float64, string) {
+	switch v.Kind() {
+	case reflect.String:
+		return float64(utf8.RuneCountInString(v.String())), " characters"
+	case reflect.Slice, reflect.Map, reflect.Array:
+		return float64(v.Len()), " items"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int()), ""
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(v.Uint()), ""
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), ""
+	}
+	panic("validate: min/max not supported for " + v.Kind().String())
+}
+
+func splitRules(tag string) (rules, elemRules []string, dive bool) {
+	if tag == "" {
+		return nil, nil, false
+	}
+	for _, rule := range strings.Split(tag, ",") {
+		switch {
+		case rule == "dive":
+			dive = true
+		case dive:
+			elemRules = append(elemRules, rule)
+		default:
+			rules = append(rules, rule)
+		}
+	}
+	return rules, elemRules, dive
+}
+
+func jsonName(f reflect.StructField) string {
+	name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+	if name == "" {
+		return f.Name
+	}
+	return name
+}
+
+func join(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}